@@ -0,0 +1,151 @@
+package smtpd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// listenFDsStart is the first file descriptor systemd passes, after stdin, stdout and stderr
+const listenFDsStart = 3
+
+// ServeActivated serves on the sockets systemd passed to the process with socket activation,
+// see https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html. systemd keeps the
+// sockets open across restarts, so no connection is refused while the server is down. It
+// returns ErrNoListenFDs when the process wasn't started that way.
+func (s *Server) ServeActivated() error {
+	return s.serveActivated(listenFDsStart)
+}
+
+func (s *Server) serveActivated(firstFD int) error {
+	if s.currentListener() != nil {
+		return ErrAlreadyRunning
+	}
+
+	defer func() {
+		close(s.Ready)
+	}()
+
+	listeners, err := activatedListeners(firstFD)
+	if err != nil {
+		s.Logger.Printf("Cannot use the activated sockets (%v)", err)
+		return err
+	}
+	listener := listeners[0]
+	if len(listeners) > 1 {
+		listener = newMultiListener(listeners)
+	}
+	if err := s.setListener(listener); err != nil {
+		listener.Close()
+		return err
+	}
+	s.Ready <- true
+
+	return s.serve(listener)
+}
+
+// activatedListeners reads LISTEN_PID and LISTEN_FDS and makes listeners of the file descriptors
+// passed from firstFD on. The variables are cleared so child processes don't pick them up too.
+func activatedListeners(firstFD int) ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// meant for another process
+		return nil, ErrNoListenFDs
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, ErrNoListenFDs
+	}
+
+	listeners := make([]net.Listener, 0, count)
+	for fd := firstFD; fd < firstFD+count; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		// FileListener works on a copy of the descriptor, the original isn't needed after
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("file descriptor %v: %v", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// multiListener accepts connections from several listeners as one, for when systemd passes more
+// than one socket
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		done:      make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				select {
+				case m.accepted <- acceptResult{conn, err}:
+				case <-m.done:
+					if conn != nil {
+						conn.Close()
+					}
+					return
+				}
+				if err != nil {
+					if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+						return
+					}
+				}
+			}
+		}(l)
+	}
+	return m
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-m.accepted:
+		return r.conn, r.err
+	case <-m.done:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: errors.New("use of closed network connection")}
+	}
+}
+
+func (m *multiListener) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, l := range m.listeners {
+			if e := l.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// Addr is the address of the first listener
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
@@ -0,0 +1,70 @@
+//go:build !windows
+
+package smtpd
+
+import (
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestServeActivated(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server takes ownership of the descriptor it is passed, hand it a copy of its own
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	ln.Close()
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+
+	server := NewServer((&MessageRecorder{}).Record)
+	errs := make(chan error, 1)
+	go func() { errs <- server.serveActivated(fd) }()
+	select {
+	case err := <-errs:
+		t.Fatalf("Expected the passed socket to be served, got: %v", err)
+	case <-server.Ready:
+	}
+	defer server.Close()
+
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("Expected LISTEN_FDS to be cleared")
+	}
+
+	c, err := smtp.Dial(server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial the activated socket: %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Errorf("Expected the session to work: %v", err)
+	}
+}
+
+func TestServeActivatedWithoutSockets(t *testing.T) {
+	os.Unsetenv("LISTEN_FDS")
+	server := NewServer(nil)
+	if err := server.ServeActivated(); err != ErrNoListenFDs {
+		t.Errorf("Expected ErrNoListenFDs, got: %v", err)
+	}
+
+	// meant for another process
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	if _, err := activatedListeners(listenFDsStart); err != ErrNoListenFDs {
+		t.Errorf("Expected ErrNoListenFDs for another process's sockets, got: %v", err)
+	}
+}
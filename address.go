@@ -0,0 +1,108 @@
+package smtpd
+
+import (
+	"strings"
+)
+
+// RFC 5321 size limits, see https://tools.ietf.org/html/rfc5321#section-4.5.3.1
+const (
+	maxLocalPartLength = 64
+	maxDomainLength    = 255
+	maxPathLength      = 256
+)
+
+// ValidateEnvelopeAddress checks a MAIL or RCPT address, with or without the angle brackets,
+// against the RFC 5321 syntax and length limits, which mail.ParseAddress doesn't enforce. The
+// error is a 501 5.1.3 SMTPError, ready to be sent back.
+func ValidateEnvelopeAddress(s string) error {
+	address := strings.TrimSuffix(strings.TrimPrefix(s, "<"), ">")
+	if len(address)+2 > maxPathLength {
+		return NewError(501, "5.1.3 address longer than 256 octets")
+	}
+
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return NewError(501, "5.1.3 address has no domain")
+	}
+	local, domain := address[:at], address[at+1:]
+
+	if len(local) > maxLocalPartLength {
+		return NewError(501, "5.1.3 local part longer than 64 octets")
+	}
+	if !validLocalPart(local) {
+		return NewError(501, "5.1.3 invalid local part")
+	}
+	if len(domain) > maxDomainLength {
+		return NewError(501, "5.1.3 domain longer than 255 octets")
+	}
+	if !validDomain(domain) {
+		return NewError(501, "5.1.3 invalid domain")
+	}
+	return nil
+}
+
+// validLocalPart checks for a Dot-string or a Quoted-string. Non-ASCII is let through for
+// SMTPUTF8 clients.
+func validLocalPart(local string) bool {
+	if local == "" {
+		return false
+	}
+
+	if strings.HasPrefix(local, `"`) {
+		if len(local) < 2 || !strings.HasSuffix(local, `"`) {
+			return false
+		}
+		quoted := local[1 : len(local)-1]
+		for i := 0; i < len(quoted); i++ {
+			switch c := quoted[i]; {
+			case c == '\\':
+				// quoted-pair, any printable character
+				i++
+				if i == len(quoted) || quoted[i] < 32 || quoted[i] == 127 {
+					return false
+				}
+			case c == '"' || c < 32 || c == 127:
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, atom := range strings.Split(local, ".") {
+		if atom == "" {
+			return false
+		}
+		for i := 0; i < len(atom); i++ {
+			if c := atom[i]; c < 128 && !isAtext(c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validDomain checks for a domain name or an address literal like [192.0.2.1]
+func validDomain(domain string) bool {
+	if strings.HasPrefix(domain, "[") {
+		return strings.HasSuffix(domain, "]") && len(domain) > 2 &&
+			!strings.ContainsAny(domain[1:len(domain)-1], "[]\\ ")
+	}
+
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if c < 128 && c != '-' && !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isAtext(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+}
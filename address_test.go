@@ -0,0 +1,68 @@
+package smtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateEnvelopeAddress(t *testing.T) {
+	valid := []string{
+		"user@example.com",
+		"<user@example.com>",
+		"first.last+tag@mail.example.com",
+		`"john doe"@example.com`,
+		"user@[192.0.2.1]",
+		strings.Repeat("a", 64) + "@example.com",
+		"用户@例子.example",
+	}
+	for _, address := range valid {
+		if err := ValidateEnvelopeAddress(address); err != nil {
+			t.Errorf("Expected %q to be valid, got: %v", address, err)
+		}
+	}
+
+	invalid := map[string]string{
+		strings.Repeat("a", 65) + "@example.com":           "local part longer",
+		"user@exa_mple.com":                                "invalid domain",
+		"user@-example.com":                                "invalid domain",
+		"user@example..com":                                "invalid domain",
+		"user..name@example.com":                           "invalid local part",
+		"user@" + strings.Repeat("a.", 130) + "com":        "address longer",
+		"@example.com":                                     "invalid local part",
+		"nobody":                                           "no domain",
+		"user@" + strings.Repeat("a", 64) + ".example.com": "invalid domain",
+		`"unterminated@example.com`:                        "invalid local part",
+	}
+	for address, reason := range invalid {
+		err := ValidateEnvelopeAddress(address)
+		if err == nil {
+			t.Errorf("Expected %q to be rejected", address)
+			continue
+		}
+		if serr, ok := err.(SMTPError); !ok || serr.Code != 501 || !strings.HasPrefix(serr.Error(), "5.1.3 ") {
+			t.Errorf("Expected a 501 5.1.3 error for %q, got: %v", address, err)
+		}
+		if !strings.Contains(err.Error(), reason) {
+			t.Errorf("Expected %q to be rejected for %q, got: %v", address, reason, err)
+		}
+	}
+}
+
+func TestSMTPServerRejectsInvalidEnvelopeAddress(t *testing.T) {
+	server := NewServer(nil)
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+
+	if msg := expectReply(t, c, 501, "MAIL FROM:<%v@example.org>", strings.Repeat("x", 65)); !strings.HasPrefix(msg, "5.1.3 ") {
+		t.Errorf("Expected an over-long local part to get 5.1.3, got: %v", msg)
+	}
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	if msg := expectReply(t, c, 501, "RCPT TO:<recipient@exa$mple.net>"); !strings.HasPrefix(msg, "5.1.3 ") {
+		t.Errorf("Expected a domain with illegal characters to get 5.1.3, got: %v", msg)
+	}
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+}
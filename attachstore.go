@@ -0,0 +1,102 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+// BlobStore is where StoreAttachments puts attachment contents, like a directory, a database or
+// an object storage bucket. Put is called with a key derived from the contents, so storing the
+// same key twice stores the same bytes and can be skipped.
+type BlobStore interface {
+	Put(key string, r io.Reader) error
+}
+
+// AttachmentRef describes an attachment that was put in a BlobStore
+type AttachmentRef struct {
+	Name        string
+	ContentType string
+	Size        int
+	// Key is the hex SHA-256 of the decoded contents, the key they were stored under
+	Key string
+}
+
+// StoreAttachments puts each attachment of the message in store, keyed by its content hash, and
+// returns references to them. An attachment sent to many mailboxes is only stored once that way,
+// and an archive can keep the references with the message instead of the contents.
+//
+// Attachments are the parts with an attachment disposition or a filename, at any depth. They are
+// decoded as they are read, never held in memory whole: once to hash them and again for Put, as
+// the key has to be known before the contents are stored.
+func (m *Message) StoreAttachments(store BlobStore) ([]AttachmentRef, error) {
+	refs := []AttachmentRef{}
+	err := m.walkAttachments(func(part *Part, content io.Reader) error {
+		hash := sha256.New()
+		size, err := io.Copy(hash, content)
+		if err != nil {
+			return fmt.Errorf("reading attachment %q: %v", part.FileName(), err)
+		}
+		refs = append(refs, AttachmentRef{
+			Name:        part.FileName(),
+			ContentType: part.ContentType(),
+			Size:        int(size),
+			Key:         hex.EncodeToString(hash.Sum(nil)),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stored := 0
+	err = m.walkAttachments(func(part *Part, content io.Reader) error {
+		ref := refs[stored]
+		stored++
+		if err := store.Put(ref.Key, content); err != nil {
+			return fmt.Errorf("storing attachment %q: %v", ref.Name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// walkAttachments calls fn for each attachment in the message, in order, with its headers and a
+// reader undoing its transfer encoding
+func (m *Message) walkAttachments(fn func(part *Part, content io.Reader) error) error {
+	return walkAttachments(textproto.MIMEHeader(m.Header), bytes.NewReader(m.RawBody), fn)
+}
+
+func walkAttachments(header textproto.MIMEHeader, content io.Reader, fn func(part *Part, content io.Reader) error) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		// a part we can't make out the type of is still saved if it says it's an attachment
+		part := &Part{Header: header}
+		if !part.IsAttachment() {
+			return nil
+		}
+		return fn(part, transferReader(header.Get("Content-Transfer-Encoding"), content))
+	}
+
+	mr := multipart.NewReader(content, params["boundary"])
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("MIME error: %v", err)
+		}
+		if err := walkAttachments(p.Header, p, fn); err != nil {
+			return err
+		}
+	}
+}
@@ -88,7 +88,7 @@ type AuthPlain struct {
 func (a *AuthPlain) unpack(line string) (string, string, error) {
 	rawCreds, err := base64.StdEncoding.DecodeString(line)
 	if err != nil {
-		return "", "", err
+		return "", "", ErrAuthBadEncoding
 	}
 	creds := strings.SplitN(string(rawCreds), "\x00", 3)
 
@@ -99,31 +99,44 @@ func (a *AuthPlain) unpack(line string) (string, string, error) {
 	return creds[1], creds[2], nil
 }
 
-// Handles the negotiation of an AUTH PLAIN request
+// Handles the negotiation of an AUTH PLAIN request, either with the credentials as an initial
+// response on the AUTH line (SASL-IR) or sent on their own line after a 334 challenge
+// see: https://tools.ietf.org/html/rfc4954#section-4
 func (a *AuthPlain) Handle(conn *Conn, params string) (AuthUser, error) {
 
-	if !conn.IsTLS {
+	if !conn.plaintextAuthAllowed() {
 		return nil, ErrRequiresTLS
 	}
 
-	if strings.TrimSpace(params) == "" {
+	params = strings.TrimSpace(params)
+	if params == "" {
 		conn.WriteSMTP(334, "")
-		if line, err := conn.ReadLine(); err == nil {
-			username, password, err := a.unpack(line)
-			if err != nil {
-				return nil, err
-			} else if user, isAuth := a.Auth(username, password); isAuth {
-				return user, nil
-			}
-		} else {
+		line, err := conn.ReadLine()
+		if err != nil {
 			return nil, err
 		}
-	} else if username, password, err := a.unpack(params); err == nil {
-		if user, isAuth := a.Auth(username, password); isAuth {
-			return user, nil
+		params = strings.TrimSpace(line)
+		if params == "*" {
+			return nil, ErrAuthCancelled
 		}
 	}
 
+	// a lone "=" is an initial response of zero length, which can't hold any credentials
+	if params == "=" {
+		return nil, ErrAuthFailed
+	}
+
+	username, password, err := a.unpack(params)
+	if err == ErrAuthBadEncoding {
+		// not base64 at all is a syntax error, see https://tools.ietf.org/html/rfc4954#section-4
+		return nil, err
+	} else if err != nil {
+		return nil, ErrAuthFailed
+	}
+	if user, isAuth := a.Auth(username, password); isAuth {
+		return user, nil
+	}
+
 	return nil, ErrAuthFailed
 }
 
@@ -180,12 +193,8 @@ func (a *AuthCramMd5) CheckResponse(response string, challenge []byte) (AuthUser
 // Handles the negotiation of an AUTH CRAM-MD5 request
 // https://en.wikipedia.org/wiki/CRAM-MD5
 // http://www.samlogic.net/articles/smtp-commands-reference-auth.htm
+// The password never goes over the wire, so unlike PLAIN and LOGIN it's offered before STARTTLS.
 func (a *AuthCramMd5) Handle(conn *Conn, params string) (AuthUser, error) {
-
-	if !conn.IsTLS {
-		return nil, ErrRequiresTLS
-	}
-
 	myChallenge := a.challenge()
 	conn.WriteSMTP(334, base64.StdEncoding.EncodeToString(myChallenge))
 	if line, err := conn.ReadLine(); err == nil {
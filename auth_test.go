@@ -1,8 +1,15 @@
 package smtpd
 
 import (
+	"bytes"
 	"crypto/tls"
+	"encoding/base64"
+	"log"
+	"net"
 	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -211,3 +218,320 @@ func TestSMTPAuthCramMd5(t *testing.T) {
 		t.Errorf("Auth should have succeeded: %v", err)
 	}
 }
+
+func TestSMTPAuthCramMd5BeforeTLS(t *testing.T) {
+	server := NewServer((&MessageRecorder{}).Record)
+
+	serverAuth := NewAuth()
+	serverAuth.Extend("PLAIN", &AuthPlain{
+		Auth: func(username, password string) (AuthUser, bool) {
+			return &TestUser{username, password}, true
+		},
+	})
+	serverAuth.Extend("CRAM-MD5", &AuthCramMd5{
+		FindUser: func(username string) (AuthUser, error) {
+			return &TestUser{"user@test.com", "password"}, nil
+		},
+	})
+	server.Auth = serverAuth
+	server.TLSConfig = TestingTLSConfig()
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	ehlo := expectReply(t, c, 250, "EHLO client.example.com")
+	if !strings.Contains(ehlo, "CRAM-MD5") {
+		t.Errorf("Expected CRAM-MD5 to be offered before STARTTLS, got: %v", ehlo)
+	}
+	if strings.Contains(ehlo, "PLAIN") {
+		t.Errorf("Expected PLAIN not to be offered before STARTTLS, got: %v", ehlo)
+	}
+
+	encoded := expectReply(t, c, 334, "AUTH CRAM-MD5")
+	challenge, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("Expected a base64 challenge, got %q: %v", encoded, err)
+	}
+	response, err := smtp.CRAMMD5Auth("user@test.com", "password").Next(challenge, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, c, 235, "%s", base64.StdEncoding.EncodeToString(response))
+}
+
+// startTLSSession dials the server, upgrades to TLS and returns a raw protocol connection
+func startTLSSession(t *testing.T, server *Server) *textproto.Conn {
+	conn, err := net.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	c := textproto.NewConn(conn)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	if err := c.PrintfLine("STARTTLS"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected STARTTLS to be accepted: %v", err)
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: server.Name, InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("Should be able to negotiate TLS: %v", err)
+	}
+	return textproto.NewConn(tlsConn)
+}
+
+func TestSMTPAuthPlainInitialResponse(t *testing.T) {
+	server := NewServer((&MessageRecorder{}).Record)
+
+	serverAuth := NewAuth()
+	serverAuth.Extend("PLAIN", &AuthPlain{
+		Auth: func(username, password string) (AuthUser, bool) {
+			return &TestUser{username, password}, username == "user@example.com" && password == "password"
+		},
+	})
+
+	server.Auth = serverAuth
+	server.TLSConfig = TestingTLSConfig()
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	creds := base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00password"))
+
+	t.Run("credentials on the AUTH line", func(t *testing.T) {
+		c := startTLSSession(t, server)
+		defer c.Close()
+
+		if err := c.PrintfLine("AUTH PLAIN %v", creds); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.ReadResponse(235); err != nil {
+			t.Errorf("Auth with an initial response should have succeeded: %v", err)
+		}
+	})
+
+	t.Run("credentials after a 334 challenge", func(t *testing.T) {
+		c := startTLSSession(t, server)
+		defer c.Close()
+
+		if err := c.PrintfLine("AUTH PLAIN"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.ReadResponse(334); err != nil {
+			t.Fatalf("Expected a 334 challenge: %v", err)
+		}
+		if err := c.PrintfLine("%v", creds); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.ReadResponse(235); err != nil {
+			t.Errorf("Two-step auth should have succeeded: %v", err)
+		}
+	})
+
+	t.Run("cancelled after a 334 challenge", func(t *testing.T) {
+		c := startTLSSession(t, server)
+		defer c.Close()
+
+		if err := c.PrintfLine("AUTH PLAIN"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.ReadResponse(334); err != nil {
+			t.Fatalf("Expected a 334 challenge: %v", err)
+		}
+		if err := c.PrintfLine("*"); err != nil {
+			t.Fatal(err)
+		}
+		if code, _, _ := c.ReadResponse(501); code != 501 {
+			t.Errorf("Expected a cancelled auth to get 501, got: %v", code)
+		}
+	})
+
+	t.Run("credentials that aren't base64", func(t *testing.T) {
+		c := startTLSSession(t, server)
+		defer c.Close()
+
+		if msg := expectReply(t, c, 501, "AUTH PLAIN not-base64!"); !strings.HasPrefix(msg, "5.5.2 ") {
+			t.Errorf("Expected a syntax error reply, got: %v", msg)
+		}
+		// the wrong credentials, well encoded, are still a 535
+		wrong := base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00wrong"))
+		expectReply(t, c, 535, "AUTH PLAIN %v", wrong)
+	})
+}
+
+func TestSMTPAuthPlaintextNeedsTLS(t *testing.T) {
+	server := NewServer((&MessageRecorder{}).Record)
+
+	serverAuth := NewAuth()
+	serverAuth.Extend("PLAIN", &AuthPlain{
+		Auth: func(username, password string) (AuthUser, bool) {
+			return &TestUser{username, password}, username == "user@example.com" && password == "password"
+		},
+	})
+	server.Auth = serverAuth
+	server.TLSConfig = TestingTLSConfig()
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	creds := base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00password"))
+
+	t.Run("refused before STARTTLS", func(t *testing.T) {
+		c, _ := pipeSession(server)
+		defer c.Close()
+
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("Expected greeting: %v", err)
+		}
+		if ehlo := expectReply(t, c, 250, "EHLO client.example.com"); strings.Contains(ehlo, "PLAIN") {
+			t.Errorf("Expected PLAIN not to be offered before STARTTLS, got: %v", ehlo)
+		}
+		if msg := expectReply(t, c, 538, "AUTH PLAIN %v", creds); !strings.HasPrefix(msg, "5.7.11 ") {
+			t.Errorf("Expected an encryption required reply, got: %v", msg)
+		}
+	})
+
+	t.Run("accepted after STARTTLS", func(t *testing.T) {
+		c := startTLSSession(t, server)
+		defer c.Close()
+
+		if ehlo := expectReply(t, c, 250, "EHLO client.example.com"); !strings.Contains(ehlo, "AUTH PLAIN") {
+			t.Errorf("Expected PLAIN to be offered after STARTTLS, got: %v", ehlo)
+		}
+		expectReply(t, c, 235, "AUTH PLAIN %v", creds)
+	})
+
+	t.Run("accepted in the clear when allowed", func(t *testing.T) {
+		open := NewServer((&MessageRecorder{}).Record)
+		open.Auth = serverAuth
+		open.AllowPlaintextAuth = true
+
+		c, _ := pipeSession(open)
+		defer c.Close()
+
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("Expected greeting: %v", err)
+		}
+		if ehlo := expectReply(t, c, 250, "EHLO client.example.com"); !strings.Contains(ehlo, "AUTH PLAIN") {
+			t.Errorf("Expected PLAIN to be offered, got: %v", ehlo)
+		}
+		expectReply(t, c, 235, "AUTH PLAIN %v", creds)
+	})
+}
+
+func TestSMTPAuthRedactedFromLogs(t *testing.T) {
+	var logged bytes.Buffer
+	var lock sync.Mutex
+	var tapped []byte
+
+	server := NewServerWithLogger((&MessageRecorder{}).Record, log.New(&logged, "", 0))
+	server.Verbose = true
+	server.AllowPlaintextAuth = true
+	server.WireTap = func(conn *Conn, dir Direction, b []byte) {
+		lock.Lock()
+		tapped = append(tapped, b...)
+		lock.Unlock()
+	}
+	serverAuth := NewAuth()
+	serverAuth.Extend("PLAIN", &AuthPlain{
+		Auth: func(username, password string) (AuthUser, bool) {
+			return &TestUser{username, password}, username == "user@example.com" && password == "hunter2"
+		},
+	})
+	server.Auth = serverAuth
+	closed := make(chan struct{}, 2)
+	server.ConnState = func(conn *Conn, state ConnState) {
+		if state == StateClosed {
+			closed <- struct{}{}
+		}
+	}
+
+	creds := base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00hunter2"))
+
+	c, _ := pipeSession(server)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, c, 235, "AUTH PLAIN %v", creds)
+	c.Close()
+
+	c, _ = pipeSession(server)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, c, 334, "AUTH PLAIN")
+	expectReply(t, c, 235, "%v", creds)
+	expectReply(t, c, 221, "QUIT")
+	c.Close()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("Expected both sessions to end")
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for name, output := range map[string]string{"verbose log": logged.String(), "wire tap": string(tapped)} {
+		if strings.Contains(output, creds) {
+			t.Errorf("Expected the credentials to be kept out of the %v, got: %v", name, output)
+		}
+		if !strings.Contains(output, "AUTH PLAIN [REDACTED]") {
+			t.Errorf("Expected the AUTH arguments to be redacted in the %v, got: %v", name, output)
+		}
+	}
+	if !strings.Contains(string(tapped), "QUIT") {
+		t.Errorf("Expected commands after AUTH to be tapped, got: %v", string(tapped))
+	}
+}
+
+func TestSMTPAuthReauth(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		server := NewServer((&MessageRecorder{}).Record)
+		serverAuth := NewAuth()
+		serverAuth.Extend("PLAIN", &AuthPlain{
+			Auth: func(username, password string) (AuthUser, bool) {
+				return &TestUser{username, password}, password == "password"
+			},
+		})
+		server.Auth = serverAuth
+		server.AllowPlaintextAuth = true
+		server.AllowReauth = allow
+
+		c, _ := pipeSession(server)
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("Expected greeting: %v", err)
+		}
+		first := base64.StdEncoding.EncodeToString([]byte("\x00first@example.com\x00password"))
+		second := base64.StdEncoding.EncodeToString([]byte("\x00second@example.com\x00password"))
+		wrong := base64.StdEncoding.EncodeToString([]byte("\x00second@example.com\x00wrong"))
+		expectReply(t, c, 235, "AUTH PLAIN %v", first)
+
+		if !allow {
+			if msg := expectReply(t, c, 503, "AUTH PLAIN %v", second); msg != "5.5.1 already authenticated" {
+				t.Errorf("Expected a second AUTH to be refused, got: %v", msg)
+			}
+			expectReply(t, c, 250, "MAIL FROM:<first@example.com>")
+		} else {
+			expectReply(t, c, 235, "AUTH PLAIN %v", second)
+			// a failed attempt drops the identity the client had
+			expectReply(t, c, 535, "AUTH PLAIN %v", wrong)
+			expectReply(t, c, 530, "MAIL FROM:<second@example.com>")
+			expectReply(t, c, 235, "AUTH PLAIN %v", second)
+			expectReply(t, c, 250, "MAIL FROM:<second@example.com>")
+		}
+		c.Close()
+	}
+}
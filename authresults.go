@@ -0,0 +1,121 @@
+package smtpd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AuthResult is one verdict from an Authentication-Results header, like "spf=pass
+// smtp.mailfrom=example.com", see https://tools.ietf.org/html/rfc8601#section-2.2
+type AuthResult struct {
+	// AuthServID names the server that did the check, empty when the header left it out
+	AuthServID string
+	// Method is the kind of check, like "spf", "dkim" or "dmarc"
+	Method string
+	// Result is the verdict, like "pass", "fail" or "none"
+	Result string
+	// Reason is the optional human readable explanation
+	Reason string
+	// Properties hold the rest of the result keyed by name, like "header.d" or "smtp.mailfrom"
+	Properties map[string]string
+}
+
+// ParsedAuthResults parses the Authentication-Results headers added by servers the message
+// passed through earlier, so their spf, dkim and dmarc verdicts can be read without checking
+// again. Keep in mind anybody could have added these headers before the message reached a
+// server you trust.
+func (m *Message) ParsedAuthResults() ([]AuthResult, error) {
+	var results []AuthResult
+	for _, header := range m.Header["Authentication-Results"] {
+		parsed, err := parseAuthResults(header)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, parsed...)
+	}
+	return results, nil
+}
+
+func parseAuthResults(header string) ([]AuthResult, error) {
+	sections := splitAuthResults(header)
+
+	// the authserv-id comes first, though some servers leave it out and start with the results
+	var authServID string
+	if first := sections[0]; len(first) > 0 && !strings.Contains(first[0], "=") {
+		authServID = first[0]
+		sections = sections[1:]
+	}
+
+	var results []AuthResult
+	for _, fields := range sections {
+		if len(fields) == 0 || (len(fields) == 1 && strings.EqualFold(fields[0], "none")) {
+			continue
+		}
+
+		kv := strings.SplitN(fields[0], "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("malformed Authentication-Results entry %q", strings.Join(fields, " "))
+		}
+		result := AuthResult{
+			AuthServID: authServID,
+			Method:     strings.ToLower(kv[0]),
+			Result:     strings.ToLower(kv[1]),
+			Properties: make(map[string]string),
+		}
+
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			name, value := strings.ToLower(kv[0]), strings.Trim(kv[1], `"`)
+			if name == "reason" {
+				result.Reason = value
+			} else {
+				result.Properties[name] = value
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// splitAuthResults breaks a header value into its ";" separated sections of whitespace separated
+// fields. (Comments) are dropped and "quoted strings" are kept whole, quotes included.
+func splitAuthResults(value string) [][]string {
+	sections := [][]string{nil}
+	var field strings.Builder
+	depth, quoted := 0, false
+
+	endField := func() {
+		if field.Len() > 0 {
+			sections[len(sections)-1] = append(sections[len(sections)-1], field.String())
+			field.Reset()
+		}
+	}
+
+	for _, r := range value {
+		switch {
+		case quoted:
+			field.WriteRune(r)
+			quoted = r != '"'
+		case r == '(':
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+		case depth > 0:
+		case r == '"':
+			field.WriteRune(r)
+			quoted = true
+		case r == ';':
+			endField()
+			sections = append(sections, nil)
+		case r == ' ' || r == '\t' || r == '\r' || r == '\n':
+			endField()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	endField()
+	return sections
+}
@@ -0,0 +1,61 @@
+package smtpd_test
+
+import (
+	"testing"
+
+	"github.com/mailsac/smtpd"
+)
+
+func TestMessageParsedAuthResults(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte(emailWithNoBody), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+
+	results, err := msg.ParsedAuthResults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected dkim and dmarc results, got: %+v", results)
+	}
+	if r := results[0]; r.Method != "dkim" || r.Result != "none" || r.Properties["header.d"] != "none" {
+		t.Errorf("Wrong dkim result: %+v", r)
+	}
+	if r := results[1]; r.Method != "dmarc" || r.Result != "none" || r.Properties["header.from"] != "forkingsoftware.com" {
+		t.Errorf("Wrong dmarc result: %+v", r)
+	}
+
+	msg, err = smtpd.NewMessage(nil, withHeaders(plainHTMLEmail,
+		"Authentication-Results: mx.example.com;",
+		" spf=pass (sender IP is 192.0.2.1) smtp.mailfrom=example.com;",
+		" dkim=fail reason=\"bad signature\" header.d=example.com header.s=selector1;",
+		" dmarc=pass action=none header.from=example.com",
+	), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+	if results, err = msg.ParsedAuthResults(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []smtpd.AuthResult{
+		{AuthServID: "mx.example.com", Method: "spf", Result: "pass", Properties: map[string]string{"smtp.mailfrom": "example.com"}},
+		{AuthServID: "mx.example.com", Method: "dkim", Result: "fail", Reason: "bad signature", Properties: map[string]string{"header.d": "example.com", "header.s": "selector1"}},
+		{AuthServID: "mx.example.com", Method: "dmarc", Result: "pass", Properties: map[string]string{"action": "none", "header.from": "example.com"}},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("Expected %v results, got: %+v", len(want), results)
+	}
+	for i, w := range want {
+		got := results[i]
+		if got.AuthServID != w.AuthServID || got.Method != w.Method || got.Result != w.Result || got.Reason != w.Reason {
+			t.Errorf("Wrong result %v, want: %+v, got: %+v", i, w, got)
+		}
+		for name, value := range w.Properties {
+			if got.Properties[name] != value {
+				t.Errorf("Wrong %v on result %v, want: %v, got: %v", name, i, value, got.Properties[name])
+			}
+		}
+	}
+}
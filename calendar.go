@@ -0,0 +1,95 @@
+package smtpd
+
+import (
+	"mime"
+	"strings"
+)
+
+// CalendarEvent is the gist of a VEVENT from an iCalendar invite, see
+// https://tools.ietf.org/html/rfc5545. Values are kept as written, so Start and End are in the
+// iCalendar date format, like "20170118T110000".
+type CalendarEvent struct {
+	// Method comes from the calendar holding the event, like "REQUEST" or "CANCEL"
+	Method   string
+	UID      string
+	Summary  string
+	Location string
+	Start    string
+	End      string
+}
+
+// CalendarInvites returns the text/calendar parts of the message, whether they were sent as the
+// body or as an attachment, in message order
+func (m *Message) CalendarInvites() ([]*Part, error) {
+	parts, err := m.Parts()
+	if err != nil {
+		return nil, err
+	}
+
+	var invites []*Part
+	var walk func(parts []*Part)
+	walk = func(parts []*Part) {
+		for _, part := range parts {
+			mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if strings.HasPrefix(mediaType, "multipart/") {
+				walk(part.Children)
+			} else if mediaType == "text/calendar" {
+				invites = append(invites, part)
+			}
+		}
+	}
+	walk(parts)
+
+	return invites, nil
+}
+
+// CalendarEvents does a light parse of a text/calendar part, returning its events
+func (p *Part) CalendarEvents() []CalendarEvent {
+	// unfold continuation lines first, see https://tools.ietf.org/html/rfc5545#section-3.1
+	decoded, _ := p.DecodedBody()
+	body := strings.ReplaceAll(string(decoded), "\r\n", "\n")
+	body = strings.NewReplacer("\n ", "", "\n\t", "").Replace(body)
+
+	var events []CalendarEvent
+	var method string
+	var event *CalendarEvent
+	for _, line := range strings.Split(body, "\n") {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		name, value := strings.ToUpper(line[:colon]), line[colon+1:]
+		if i := strings.Index(name, ";"); i >= 0 {
+			// drop parameters, like DTSTART;TZID=America/New_York
+			name = name[:i]
+		}
+
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VEVENT"):
+			event = &CalendarEvent{}
+		case name == "END" && strings.EqualFold(value, "VEVENT") && event != nil:
+			events = append(events, *event)
+			event = nil
+		case name == "METHOD" && event == nil:
+			method = strings.ToUpper(value)
+		case event != nil:
+			switch name {
+			case "UID":
+				event.UID = value
+			case "SUMMARY":
+				event.Summary = value
+			case "LOCATION":
+				event.Location = value
+			case "DTSTART":
+				event.Start = value
+			case "DTEND":
+				event.End = value
+			}
+		}
+	}
+
+	for i := range events {
+		events[i].Method = method
+	}
+	return events
+}
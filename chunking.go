@@ -0,0 +1,91 @@
+package smtpd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// checkChunk refuses a chunk that would take the message over MaxSize, or the transaction over
+// MaxBDATChunks
+func (s *Server) checkChunk(conn *Conn, size int64) error {
+	if s.MaxBDATChunks > 0 && conn.chunkCount >= s.MaxBDATChunks {
+		return ErrTooManyChunks
+	}
+	if conn.MaxSize > 0 && int64(len(conn.chunks))+size > conn.MaxSize {
+		return ErrMessageSizeExceeded
+	}
+	return nil
+}
+
+// handleBDAT takes one chunk of a message sent with BDAT, see
+// https://tools.ietf.org/html/rfc3030#section-2. The chunk is always read off the connection,
+// even when it gets rejected, so the client and server stay in step. The message is handed
+// over once the LAST chunk is in, the same way as one sent with DATA.
+func (s *Server) handleBDAT(conn *Conn, args string) error {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 || (len(fields) == 2 && !strings.EqualFold(fields[1], "LAST")) {
+		conn.WriteSMTP(501, "5.5.4 Syntax: BDAT <size> [LAST]")
+		return nil
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		conn.WriteSMTP(501, "5.5.4 Syntax: BDAT <size> [LAST]")
+		return nil
+	}
+	last := len(fields) == 2
+
+	if conn.MaxSize > 0 && size > conn.drainLimit() {
+		// too much to even read off and throw away
+		return ErrMessageSizeOverrun
+	}
+	if err := s.checkChunk(conn, size); err != nil {
+		// turned away on the declared size alone, so say so right away rather than after the
+		// client has sent what could be a huge chunk. The client may well still be sending, not
+		// reading, so the reply goes out while the chunk is read off and thrown away.
+		s.rejectError(conn, PhaseData, err, err.Error())
+		flushed := make(chan error, 1)
+		go func() { flushed <- conn.Flush() }()
+		err := conn.discardChunk(size)
+		<-flushed
+		// the message can't be completed anymore, later chunks need a new MAIL
+		conn.ResetBuffers()
+		return err
+	}
+
+	if err := conn.readChunk(size); err != nil {
+		return err
+	}
+
+	if conn.transaction == 0 || conn.FromAddr == nil {
+		conn.chunks = nil
+		s.reject(conn, PhaseData, 503, "5.5.1 MAIL first")
+		return nil
+	}
+
+	if conn.chunkID == "" {
+		// the first chunk of the message, run the checks DATA would run before its 354
+		messageID := NewMessageID()
+		if !s.readyForData(conn, messageID) {
+			// the rest of the chunks can't make up a whole message anymore
+			conn.ResetBuffers()
+			return nil
+		}
+		conn.chunkID = messageID
+	}
+
+	if !last {
+		conn.WriteSMTP(250, fmt.Sprintf("2.0.0 %v octets received", size))
+		return nil
+	}
+
+	data, messageID := conn.chunkedData(), conn.chunkID
+	conn.chunks, conn.chunkID, conn.chunkCount = nil, "", 0
+	if tooManyHeaderLines(data, conn.MaxHeaderLines) {
+		conn.EndTX()
+		s.rejectError(conn, PhaseData, ErrTooManyHeaderLines, ErrTooManyHeaderLines.Error())
+		return nil
+	}
+	s.acceptMessage(conn, messageID, data)
+	return nil
+}
@@ -0,0 +1,357 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CommandHandler runs one SMTP verb, writing whatever reply it needs to conn. Returning an
+// error ends the session, ErrCloseSession does so quietly while anything else gets logged.
+type CommandHandler func(conn *Conn, args string) error
+
+// builtinCommands are the verbs a server handles out of the box, see Server.Commands
+func (s *Server) builtinCommands() map[string]CommandHandler {
+	return map[string]CommandHandler{
+		"HELO":     s.handleHELO,
+		"EHLO":     s.handleEHLO,
+		"NAME":     s.handleNAME,
+		"MAIL":     s.handleMAIL,
+		"RCPT":     s.handleRCPT,
+		"DATA":     s.handleDATA,
+		"BDAT":     s.handleBDATCommand,
+		"RSET":     s.handleRSET,
+		"VRFY":     s.handleVRFY,
+		"EXPN":     s.handleEXPN,
+		"HELP":     s.handleHELP,
+		"NOOP":     s.handleNOOP,
+		"QUIT":     s.handleQUIT,
+		"STARTTLS": s.handleSTARTTLS,
+		"AUTH":     s.handleAUTH,
+		"SEND":     s.handleObsolete,
+		"SOML":     s.handleObsolete,
+		"SAML":     s.handleObsolete,
+		"TURN":     s.handleObsolete,
+	}
+}
+
+// https://tools.ietf.org/html/rfc2821#section-4.1.1.1
+func (s *Server) handleHELO(conn *Conn, args string) error {
+	conn.setClientHostname(args)
+	conn.WriteSMTP(250, fmt.Sprintf("%v Hello", s.ServerName))
+	return nil
+}
+
+// see: https://tools.ietf.org/html/rfc2821#section-4.1.4
+func (s *Server) handleEHLO(conn *Conn, args string) error {
+	conn.Reset()
+	conn.setClientHostname(args)
+
+	conn.WriteEHLO(fmt.Sprintf("%v %v", s.ServerName, s.Greeting(conn)))
+	conn.writeEHLOLines(s.ehloExtensions(conn))
+	conn.WriteSMTP(250, "HELP")
+	return nil
+}
+
+func (s *Server) handleNAME(conn *Conn, args string) error {
+	conn.setClientHostname(args)
+	return nil
+}
+
+// The MAIL command starts off a new mail transaction
+// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.2
+// This doesn't implement the RFC4594 addition of an AUTH param to the MAIL command
+// see: http://tools.ietf.org/html/rfc4954#section-3 for details
+func (s *Server) handleMAIL(conn *Conn, args string) error {
+	// clear to/from but must not clear auth
+	conn.ResetBuffers()
+	if from, err := s.mailFromArg(args); err == nil {
+		if conn.User == nil || from.Address == "" || conn.User.IsUser(from.Address) {
+			params := mailParams(args)
+			bodyType := strings.ToUpper(params["BODY"])
+			if !s.bodyTypeSupported(bodyType) {
+				s.reject(conn, PhaseMail, 555, fmt.Sprintf("5.5.4 BODY=%v not supported", params["BODY"]))
+			} else if s.RequireResolvableSenderDomain && !s.senderDomainResolves(conn, from) {
+				s.reject(conn, PhaseMail, 450, "4.1.8 sender domain does not resolve")
+			} else if err := conn.StartTX(from); err == nil {
+				conn.DeclaredSize, _ = strconv.ParseInt(params["SIZE"], 10, 64)
+				conn.BodyType = bodyType
+				conn.WriteSMTP(250, "Accepted")
+			} else {
+				s.reject(conn, PhaseMail, 501, err.Error())
+			}
+		} else {
+			s.reject(conn, PhaseMail, 501, fmt.Sprintf("Cannot send mail as %v", from))
+		}
+	} else {
+		s.reject(conn, PhaseMail, 501, err.Error())
+	}
+	return nil
+}
+
+// mailFromArg is the sender of a MAIL command. The null sender <> of bounces and other
+// notifications, see https://tools.ietf.org/html/rfc5321#section-4.5.5, is an empty address.
+func (s *Server) mailFromArg(args string) (*mail.Address, error) {
+	if isNullPath("FROM", args) {
+		return &mail.Address{}, nil
+	}
+	return s.GetAddressArg("FROM", args)
+}
+
+// https://tools.ietf.org/html/rfc2821#section-4.1.1.3
+func (s *Server) handleRCPT(conn *Conn, args string) error {
+	if conn.transaction == 0 {
+		s.reject(conn, PhaseRcpt, 503, "5.5.1 MAIL first")
+		return nil
+	}
+	if !s.addRecipient(conn, args) && s.RejectAllOnFirstBadRcpt {
+		// the rejection was the answer for the whole transaction, the client starts over with MAIL
+		conn.ResetBuffers()
+	}
+	return nil
+}
+
+// addRecipient adds the RCPT address to the transaction, or rejects it and returns false
+func (s *Server) addRecipient(conn *Conn, args string) bool {
+	if isNullPath("TO", args) {
+		// <> is only a valid sender, there's nobody to deliver to
+		s.reject(conn, PhaseRcpt, 501, "5.1.3 bad recipient address")
+		return false
+	}
+	to, err := s.GetAddressArg("TO", args)
+	if err != nil {
+		s.reject(conn, PhaseRcpt, 501, err.Error())
+		return false
+	}
+	if s.DeduplicateRecipients && hasRecipient(conn.ToAddr, to) {
+		conn.WriteSMTP(250, "Accepted")
+		return true
+	}
+	if s.MaxRecipients > 0 && len(conn.ToAddr) >= s.MaxRecipients {
+		s.reject(conn, PhaseRcpt, 452, s.response(ResponseTooManyRecipients, "4.5.3 too many recipients"))
+		return false
+	}
+	if s.OpenRelayRecipientPolicy != nil && !s.recipientAllowed(conn, s.OpenRelayRecipientPolicy(conn, to)) {
+		return false
+	}
+	conn.ToAddr = append(conn.ToAddr, to)
+	conn.WriteSMTP(250, "Accepted")
+	return true
+}
+
+// isNullPath reports whether args gives the empty <> path for argName, like "TO:<>"
+func isNullPath(argName string, args string) bool {
+	argSplit := strings.SplitN(args, ":", 2)
+	if len(argSplit) != 2 || !strings.EqualFold(strings.TrimSpace(argSplit[0]), argName) {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimSpace(argSplit[1]), "<>")
+}
+
+// hasRecipient looks for to among the recipients, the domain compared ignoring case since only
+// the local part of an address is case sensitive
+func hasRecipient(recipients []*mail.Address, to *mail.Address) bool {
+	at := strings.LastIndex(to.Address, "@")
+	for _, rcpt := range recipients {
+		if len(rcpt.Address) == len(to.Address) && rcpt.Address[:at+1] == to.Address[:at+1] &&
+			strings.EqualFold(rcpt.Address[at+1:], to.Address[at+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// https://tools.ietf.org/html/rfc2821#section-4.1.1.4
+func (s *Server) handleDATA(conn *Conn, args string) error {
+	if conn.BodyType == "BINARYMIME" {
+		// see: https://tools.ietf.org/html/rfc3030#section-3
+		s.reject(conn, PhaseData, 503, "5.5.1 BINARYMIME messages have to be sent with BDAT")
+		return nil
+	}
+	messageID := NewMessageID()
+	if !s.readyForData(conn, messageID) {
+		return nil
+	}
+
+	conn.WriteSMTP(354, "Enter message, ending with \".\" on a line by itself")
+	data, err := conn.ReadData()
+	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+		s.Logger.Println(conn.ID, "Client timed out sending DATA", neterr)
+		conn.WriteSMTP(421, "4.4.2 timeout waiting for message data")
+		return ErrCloseSession
+	}
+	if err == ErrMessageSizeOverrun {
+		s.Logger.Println(conn.ID, "Client sent far more than MaxSize with DATA")
+		s.rejectError(conn, PhaseData, err, err.Error())
+		return ErrCloseSession
+	}
+	if err == ErrDataInterrupted {
+		// nobody is left to read a reply, but say so all the same and don't hand anything on
+		s.Logger.Println(conn.ID, "Connection lost during DATA")
+		conn.WriteSMTP(ErrDataInterrupted.Code, ErrDataInterrupted.Error())
+		return ErrCloseSession
+	}
+	if err != nil {
+		e := fmt.Sprintf("Error DATA read: %s", err.Error())
+		s.Logger.Println(conn.ID, e)
+		s.rejectError(conn, PhaseData, err, e)
+		return nil
+	}
+	s.acceptMessage(conn, messageID, data)
+	return nil
+}
+
+// see: https://tools.ietf.org/html/rfc3030#section-2
+func (s *Server) handleBDATCommand(conn *Conn, args string) error {
+	err := s.handleBDAT(conn, args)
+	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+		s.Logger.Println(conn.ID, "Client timed out sending BDAT", neterr)
+		conn.WriteSMTP(421, "4.4.2 timeout waiting for message data")
+		return ErrCloseSession
+	}
+	if err == ErrMessageSizeOverrun {
+		s.Logger.Println(conn.ID, "Client sent far more than MaxSize with BDAT")
+		s.rejectError(conn, PhaseData, err, err.Error())
+		return ErrCloseSession
+	}
+	if err == ErrDataInterrupted {
+		s.Logger.Println(conn.ID, "Connection lost during BDAT")
+		conn.WriteSMTP(ErrDataInterrupted.Code, ErrDataInterrupted.Error())
+		return ErrCloseSession
+	}
+	if err != nil {
+		e := fmt.Sprintf("Error BDAT read: %s", err.Error())
+		s.Logger.Println(conn.ID, e)
+		s.rejectError(conn, PhaseData, err, e)
+	}
+	return nil
+}
+
+// Reset the connection
+// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.5
+func (s *Server) handleRSET(conn *Conn, args string) error {
+	conn.Reset()
+	conn.WriteOK()
+	return nil
+}
+
+// Since this is a commonly abused SPAM aid, it's better to just
+// default to 252 (apparent validity / could not verify). If this is not a concern, then
+// the full `params` value will be the address to verify, respond with `conn.WriteOK()`
+// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.6
+func (s *Server) handleVRFY(conn *Conn, args string) error {
+	conn.WriteSMTP(252, "But it was worth a shot, right?")
+	return nil
+}
+
+// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.7
+func (s *Server) handleEXPN(conn *Conn, args string) error {
+	conn.WriteSMTP(252, "Maybe, maybe not")
+	return nil
+}
+
+// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.8
+func (s *Server) handleHELP(conn *Conn, args string) error {
+	msg := fmt.Sprintf("contact the owner of %v for more information", s.ServerName)
+	if s.Help != "" {
+		msg = s.Help
+	}
+	conn.WriteSMTP(214, msg)
+	return nil
+}
+
+// NOOP doesn't do anything. Big surprise
+// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.9
+func (s *Server) handleNOOP(conn *Conn, args string) error {
+	conn.WriteOK()
+	return nil
+}
+
+// Say goodbye and close the connection. A transaction still open is dropped, messages already
+// accepted with DATA or BDAT LAST were handed over before their 250 and stay delivered.
+// see: https://tools.ietf.org/html/rfc5321#section-4.1.1.10
+func (s *Server) handleQUIT(conn *Conn, args string) error {
+	conn.ResetBuffers()
+	conn.WriteSMTP(221, "2.0.0 Bye")
+	return ErrCloseSession
+}
+
+// https://tools.ietf.org/html/rfc2487
+func (s *Server) handleSTARTTLS(conn *Conn, args string) error {
+	if s.TLSConfig == nil {
+		conn.WriteSMTP(454, "TLS is not available on this server")
+		return nil
+	}
+
+	if n := conn.discardBuffered(); n > 0 {
+		s.Logger.Println(conn.ID, "Discarded", n, "bytes sent after STARTTLS before the TLS handshake")
+	}
+	conn.WriteSMTP(220, "Ready to start TLS")
+	conn.Flush()
+
+	// upgrade to TLS
+	tlsConn := tls.Server(conn.Conn, s.TLSConfig)
+	if tlsConn == nil {
+		s.Logger.Println(conn.ID, "Error during TLS upgrade")
+		return ErrCloseSession
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(s.WriteTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		s.Logger.Println(conn.ID, "Could not TLS handshake: ", err)
+		return ErrCloseSession
+	}
+	newID := NewMessageID()
+	if conn.server.Verbose {
+		s.Logger.Printf("Upgraded TLS. Changed pre-TLS connection ID from %v to %v", conn.ID, newID)
+	}
+	conn.upgradeTLS(tlsConn, newID)
+	return nil
+}
+
+// AUTH uses the configured authentication handler to perform an SMTP-AUTH
+// as defined by the ESMTP AUTH extension
+// see: http://tools.ietf.org/html/rfc4954
+func (s *Server) handleAUTH(conn *Conn, args string) error {
+	if conn.User != nil && s.AllowReauth {
+		// start over as nobody, a transaction was only allowed for the previous identity
+		conn.ResetBuffers()
+		conn.User = nil
+	}
+	if conn.User != nil {
+		conn.WriteSMTP(503, "5.5.1 already authenticated")
+	} else if s.Auth != nil && isPlaintextMechanism(args) && !conn.plaintextAuthAllowed() {
+		conn.WriteSMTP(ErrRequiresTLS.Code, ErrRequiresTLS.Error())
+	} else if s.Auth != nil {
+		conn.authenticating = true
+		err := s.Auth.Handle(conn, args)
+		conn.authenticating = false
+		if err != nil {
+			if serr, ok := err.(SMTPError); ok {
+				conn.WriteSMTP(serr.Code, serr.Error())
+			} else {
+				conn.WriteSMTP(500, "Authentication failed")
+			}
+			if err == ErrReadTimeout {
+				return ErrCloseSession
+			}
+		} else {
+			conn.WriteSMTP(235, "Authentication succeeded")
+		}
+	} else {
+		conn.WriteSMTP(502, "Command not implemented")
+	}
+	return nil
+}
+
+// Obsolete verbs that some legacy clients still probe for. They're known, just not
+// supported, so they don't count as bad input.
+// see: https://tools.ietf.org/html/rfc5321#appendix-F
+func (s *Server) handleObsolete(conn *Conn, args string) error {
+	conn.WriteSMTP(502, "5.5.1 command not implemented")
+	return nil
+}
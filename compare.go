@@ -0,0 +1,106 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"sort"
+)
+
+// Equal compares two messages on what they say rather than how they arrived: the sender,
+// recipients, subject, headers, text and HTML bodies and attachments. Connection details and
+// the server assigned MessageID are left out. Besides the verdict it lists the differences,
+// which makes for readable test failures.
+func (m *Message) Equal(other *Message) (bool, []string) {
+	var diffs []string
+	differ := func(format string, args ...interface{}) {
+		diffs = append(diffs, fmt.Sprintf(format, args...))
+	}
+
+	if a, b := addressString(m.From), addressString(other.From); a != b {
+		differ("From: %q != %q", a, b)
+	}
+	if a, b := addressStrings(m.To), addressStrings(other.To); !reflect.DeepEqual(a, b) {
+		differ("To: %q != %q", a, b)
+	}
+	if a, b := addressStrings(m.Rcpt), addressStrings(other.Rcpt); !reflect.DeepEqual(a, b) {
+		differ("Rcpt: %q != %q", a, b)
+	}
+	if m.Subject != other.Subject {
+		differ("Subject: %q != %q", m.Subject, other.Subject)
+	}
+
+	names := make(map[string]struct{})
+	for name := range m.Header {
+		names[name] = struct{}{}
+	}
+	for name := range other.Header {
+		names[name] = struct{}{}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		if a, b := m.Header[name], other.Header[name]; !reflect.DeepEqual(a, b) {
+			differ("Header %v: %q != %q", name, a, b)
+		}
+	}
+
+	bodies := []struct {
+		name string
+		get  func(*Message) ([]byte, error)
+	}{
+		{"Plain", (*Message).Plain},
+		{"HTML", (*Message).HTML},
+	}
+	for _, body := range bodies {
+		a, errA := body.get(m)
+		b, errB := body.get(other)
+		if (errA == nil) != (errB == nil) {
+			differ("%v: error %v != %v", body.name, errA, errB)
+		} else if !bytes.Equal(a, b) {
+			differ("%v: %q != %q", body.name, a, b)
+		}
+	}
+
+	a, errA := m.Attachments()
+	b, errB := other.Attachments()
+	switch {
+	case (errA == nil) != (errB == nil):
+		differ("Attachments: error %v != %v", errA, errB)
+	case len(a) != len(b):
+		differ("Attachments: %v != %v", len(a), len(b))
+	default:
+		for i := range a {
+			if typeA, typeB := a[i].Header.Get("Content-Type"), b[i].Header.Get("Content-Type"); typeA != typeB {
+				differ("Attachment %v Content-Type: %q != %q", i, typeA, typeB)
+			}
+			if nameA, nameB := a[i].FileName(), b[i].FileName(); nameA != nameB {
+				differ("Attachment %v name: %q != %q", i, nameA, nameB)
+			}
+			if !bytes.Equal(a[i].Body, b[i].Body) {
+				differ("Attachment %v body: %v bytes differ from %v bytes", i, len(a[i].Body), len(b[i].Body))
+			}
+		}
+	}
+
+	return len(diffs) == 0, diffs
+}
+
+func addressString(address *mail.Address) string {
+	if address == nil {
+		return ""
+	}
+	return address.String()
+}
+
+func addressStrings(addresses []*mail.Address) []string {
+	list := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		list = append(list, address.String())
+	}
+	return list
+}
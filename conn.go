@@ -2,16 +2,31 @@ package smtpd
 
 import (
 	"bufio"
-	"errors"
-	"fmt"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/mail"
 	"net/textproto"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// A message over MaxSize is still read to the end, so the client gets its 552 in step, but only
+// up to drainFactor times MaxSize (or minDrainSize, for a small MaxSize). Past that the client
+// is cut off rather than read from for as long as it keeps sending.
+const (
+	drainFactor  = 4
+	minDrainSize = 1 << 20
 )
 
 // LimitedReader keeps from reading past the suggested max size. It was copied from io and
@@ -32,7 +47,7 @@ func (l *LimitedReader) Read(p []byte) (n int, err error) {
 		l.ReadsRemaining--
 		// it will still Read a few more times as TextProto fills the buffer
 		// before responding with the error
-		err = SMTPError{552, errors.New("message size too large")}
+		err = ErrMessageSizeExceeded
 		if l.ReadsRemaining <= 0 {
 			// bufio builtin needs regular error. we will already have written 552 to smtp by
 			// the time this code path is traveled.
@@ -41,20 +56,70 @@ func (l *LimitedReader) Read(p []byte) (n int, err error) {
 	}
 
 	n, rerr := l.R.Read(p)
-	if err != nil && rerr != nil {
+	if rerr != nil {
 		err = rerr
 	}
 	l.N -= int64(n)
 	return n, err
 }
 
+// Direction tells a WireTap which way bytes were travelling
+type Direction int
+
+const (
+	// DirectionIn is data read from the client
+	DirectionIn Direction = iota
+	// DirectionOut is data written to the client
+	DirectionOut
+)
+
+func (d Direction) String() string {
+	if d == DirectionIn {
+		return "in"
+	}
+	return "out"
+}
+
+// ConnState is a stage in a connection's life, reported to Server.ConnState
+type ConnState int
+
+const (
+	// StateNew is a connection that was just accepted, before the greeting is sent. Every
+	// connection starts here, including the ones turned away.
+	StateNew ConnState = iota
+	// StateActive is a connection handling a command, from reading it until the reply is sent.
+	// DATA stays active until the whole message has been handled.
+	StateActive
+	// StateIdle is a connection waiting for the client's next command
+	StateIdle
+	// StateClosed is a closed connection. It is always reported, exactly once.
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateNew:
+		return "new"
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
 // Conn is a wrapper for net.Conn that provides
 // convenience handlers for SMTP requests
 type Conn struct {
 	// ID is this connection ID which changes after TLS connection
 	ID string
-	// optional hostname given during NAME
+	// ClientHostname is the name the client gave in HELO, EHLO or NAME, lowercased, as sent
 	ClientHostname string
+	// ClientHostnameASCII is ClientHostname with any internationalized labels in their punycode
+	// (xn--) form, or empty when the name isn't a valid IDN
+	ClientHostnameASCII string
 	// Conn is primarily a wrapper around a net.Conn object
 	net.Conn
 
@@ -66,6 +131,11 @@ type Conn struct {
 	User     AuthUser
 	FromAddr *mail.Address
 	ToAddr   []*mail.Address
+	// DeclaredSize is the SIZE given with MAIL FROM, zero when the client didn't declare one
+	DeclaredSize int64
+	// BodyType is the BODY given with MAIL FROM in upper case, like "8BITMIME" or "BINARYMIME",
+	// empty when the client didn't declare one
+	BodyType string
 	// any additional text information here, like custom headers you will later prepend when passing along to another server
 	AdditionalHeaders string
 
@@ -73,10 +143,30 @@ type Conn struct {
 	MaxSize      int64
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
+	// MaxWriteTime caps the time spent writing to the client over the connection, zero for no cap
+	MaxWriteTime time.Duration
+	// DataTimeout is the longest wait for more message data, restarted as data arrives. Zero
+	// uses ReadTimeout.
+	DataTimeout time.Duration
+	// MaxHeaderLines caps the lines in the header block of a message, zero for no cap
+	MaxHeaderLines int
 
 	// internal state
 	lock        sync.Mutex
 	transaction int
+	aborted     bool
+	readingData bool
+	// writeTime adds up the time spent in writes, writeStalled is set once it went over MaxWriteTime
+	writeTime    time.Duration
+	writeStalled bool
+	// the PTR name of the client, see RemoteHostname
+	remoteHostname     string
+	remoteHostnameOnce sync.Once
+	// authenticating is set while an AUTH exchange reads credentials from the client
+	authenticating bool
+	ctx            context.Context
+	cancel         context.CancelFunc
+	closed         bool
 
 	asTextProto sync.Once
 	textProto   *textproto.Conn
@@ -88,6 +178,172 @@ type Conn struct {
 	limitedReader *LimitedReader
 
 	DiscardBody bool
+	// TruncateOnMaxSize cuts off message data at MaxSize instead of failing the DATA command
+	TruncateOnMaxSize bool
+	// truncated is set when the last ReadData had to cut off the message
+	truncated bool
+
+	// chunks holds the BDAT data received so far, chunkID is the id of the message they make up
+	chunks     []byte
+	chunkID    string
+	chunkCount int
+}
+
+// Read reads from the underlying connection, showing the bytes to the server's WireTap if any
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.readingData {
+		// every read during DATA gets a fresh deadline, so only a stalled transfer times out
+		c.Conn.SetReadDeadline(time.Now().Add(c.dataTimeout()))
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.tap(DirectionIn, b[:n])
+	}
+	return n, err
+}
+
+// Write writes to the underlying connection, showing the bytes to the server's WireTap if any
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.writeStalled {
+		return 0, ErrWriteStalled
+	}
+	if c.MaxWriteTime > 0 {
+		// a single write can't go past what's left of MaxWriteTime either
+		if left := c.MaxWriteTime - c.writeTime; c.WriteTimeout <= 0 || left < c.WriteTimeout {
+			c.Conn.SetWriteDeadline(time.Now().Add(left))
+		}
+	}
+	start := time.Now()
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.tap(DirectionOut, b[:n])
+	}
+	if c.MaxWriteTime > 0 {
+		c.writeTime += time.Since(start)
+		if c.writeTime >= c.MaxWriteTime {
+			// hang up, so the session ends instead of waiting for the next command
+			c.writeStalled = true
+			c.Conn.Close()
+			if err == nil {
+				err = ErrWriteStalled
+			}
+		}
+	}
+	return n, err
+}
+
+func (c *Conn) dataTimeout() time.Duration {
+	if c.DataTimeout > 0 {
+		return c.DataTimeout
+	}
+	return c.ReadTimeout
+}
+
+func (c *Conn) tap(dir Direction, b []byte) {
+	if c.server == nil || c.server.WireTap == nil {
+		return
+	}
+	// hand over a copy so the tap can't disturb the bytes in flight
+	b = append([]byte(nil), b...)
+	if dir == DirectionIn {
+		b = c.redactCredentials(b)
+	}
+	c.server.WireTap(c, dir, b)
+}
+
+// authArgs matches the credentials of an AUTH command sent with an initial response
+var authArgs = regexp.MustCompile(`(?im)^(AUTH[ \t]+[^ \t\r\n]+)[ \t]+[^\r\n]+`)
+
+// redactCredentials keeps passwords out of the WireTap, replacing the initial response of an
+// AUTH command and every line sent during the AUTH exchange with [REDACTED]
+func (c *Conn) redactCredentials(b []byte) []byte {
+	if c.authenticating {
+		lines := bytes.Count(b, []byte("\n"))
+		if lines == 0 {
+			return []byte("[REDACTED]")
+		}
+		return bytes.Repeat([]byte("[REDACTED]\r\n"), lines)
+	}
+	return authArgs.ReplaceAll(b, []byte("$1 [REDACTED]"))
+}
+
+// redactArgs hides the credentials in the arguments of an AUTH command for logging
+func redactArgs(verb, args string) string {
+	if verb != "AUTH" {
+		return args
+	}
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		return args
+	}
+	return fields[0] + " [REDACTED]"
+}
+
+// ClientIP is the IP address of the client, which is ForwardedForIP when that has been set
+func (c *Conn) ClientIP() net.IP {
+	if c.ForwardedForIP != "" {
+		if ip := net.ParseIP(c.ForwardedForIP); ip != nil {
+			return ip
+		}
+	}
+	return c.peerIP()
+}
+
+// IsTrusted reports whether the peer is on the loopback interface or in one of nets. It goes by
+// the address actually connected rather than ForwardedForIP, as it's meant to decide whether to
+// believe things like forwarded addresses (XCLIENT, PROXY) or to relay for the peer.
+func (c *Conn) IsTrusted(nets []*net.IPNet) bool {
+	ip := c.peerIP()
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ipInNetworks(ip, nets)
+}
+
+// ResolveForwardedFor finds the client behind a chain of proxies and sets it as ForwardedForIP.
+// chain is a comma separated list of addresses like an X-Forwarded-For header, the client first
+// and each proxy after, with the connected peer as the last hop. Hops are peeled off from the
+// end while they are in trusted, the first one that isn't is the client. Nothing is set, and nil
+// returned, when the peer isn't trusted (see IsTrusted), since anything could be in its chain.
+func (c *Conn) ResolveForwardedFor(chain string, trusted []*net.IPNet) net.IP {
+	if !c.IsTrusted(trusted) {
+		return nil
+	}
+	var client net.IP
+	hops := strings.Split(chain, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// whatever is left can't be told apart from made up, go with the last good hop
+			break
+		}
+		client = ip
+		if !ipInNetworks(ip, trusted) {
+			break
+		}
+	}
+	if client != nil {
+		c.ForwardedForIP = client.String()
+	}
+	return client
+}
+
+// peerIP is the IP address of the other end of the connection
+func (c *Conn) peerIP() net.IP {
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// plaintextAuthAllowed reports whether mechanisms sending credentials in the clear may be used,
+// which needs TLS unless the server's AllowPlaintextAuth says otherwise
+func (c *Conn) plaintextAuthAllowed() bool {
+	return c.IsTLS || (c.server != nil && c.server.AllowPlaintextAuth)
 }
 
 // AddInfoHeader adds an additional header to the beginning of the list, such that the newest
@@ -139,16 +395,59 @@ func (c *Conn) Reset() {
 	}
 }
 
+// setClientHostname records the name the client introduced itself with, both as sent and in the
+// ASCII form used in Received headers and to compare against reverse DNS
+func (c *Conn) setClientHostname(name string) {
+	c.ClientHostname = strings.ToLower(name)
+	c.ClientHostnameASCII = ""
+	for i := 0; i < len(c.ClientHostname); i++ {
+		if c.ClientHostname[i] >= utf8.RuneSelf {
+			if ascii, err := idna.Lookup.ToASCII(c.ClientHostname); err == nil {
+				c.ClientHostnameASCII = ascii
+			} else if c.server.Verbose {
+				c.Logger.Println(c.ID, "Invalid internationalized hostname", c.ClientHostname, err)
+			}
+			return
+		}
+	}
+	// plain ASCII names and address literals are already in their ASCII form
+	c.ClientHostnameASCII = c.ClientHostname
+}
+
 // ResetBuffers resets the mail buffers (to, from) but not auth
 func (c *Conn) ResetBuffers() {
 	c.FromAddr = nil
 	c.ToAddr = make([]*mail.Address, 0)
+	c.DeclaredSize = 0
+	c.BodyType = ""
+	c.truncated = false
+	c.chunks = nil
+	c.chunkID = ""
+	c.chunkCount = 0
 	c.AdditionalHeaders = ""
 	c.transaction = 0
 
-	c.limitedReader.N = c.MaxSize
-	c.limitedReader.DidHitLimit = false
-	c.limitedReader.ReadsRemaining = 0
+	if c.limitedReader != nil {
+		c.limitedReader.N = c.MaxSize
+		c.limitedReader.DidHitLimit = false
+		c.limitedReader.ReadsRemaining = 0
+	}
+}
+
+// AbortTransaction lets a hook reject the current mail transaction. The reply is sent, the
+// sender and recipients are forgotten (authentication is kept) and the command that ran the
+// hook stops there, so the client has to start over with MAIL.
+func (c *Conn) AbortTransaction(code int, msg string) error {
+	c.ResetBuffers()
+	c.aborted = true
+	return c.WriteSMTP(code, msg)
+}
+
+// wasAborted reports whether AbortTransaction was called since the last check
+func (c *Conn) wasAborted() bool {
+	aborted := c.aborted
+	c.aborted = false
+	return aborted
 }
 
 // ReadSMTP pulls a single SMTP command line (ending in a carriage return + newline)
@@ -165,83 +464,412 @@ func (c *Conn) ReadSMTP() (string, string, error) {
 
 		return verb, args, nil
 	} else {
-		return "", "", err
+		return "", "", readTimeout(err)
 	}
 }
 
+// readTimeout turns an expired read deadline into ErrReadTimeout, other errors are kept as is
+func readTimeout(err error) error {
+	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+		return ErrReadTimeout
+	}
+	return err
+}
+
+// talksWithin reports whether the client sends anything within the wait period. Whatever was
+// sent stays buffered for the next read.
+func (c *Conn) talksWithin(wait time.Duration) bool {
+	c.SetReadDeadline(time.Now().Add(wait))
+	defer c.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+	_, err := c.tp().R.Peek(1)
+	return err == nil
+}
+
 // ReadLine reads a single line from the client
 func (c *Conn) ReadLine() (string, error) {
 	c.SetReadDeadline(time.Now().Add(c.ReadTimeout))
-	return c.tp().ReadLine()
+	line, err := c.tp().ReadLine()
+	return line, readTimeout(err)
 }
 
-// ReadData brokers the special case of SMTP data messages
+// ReadData brokers the special case of SMTP data messages. Dot-stuffing is removed but line
+// endings are kept exactly as sent, so CRLF-sensitive and 8bit content survives intact.
 func (c *Conn) ReadData() (string, error) {
-	c.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+	// the client waits on the 354 before sending the message
+	if err := c.Flush(); err != nil {
+		return "", err
+	}
+	c.readingData = true
+	defer func() { c.readingData = false }()
 
 	if c.DiscardBody {
-		// Use DotReader to handle the special \r\n.\r\n termination in SMTP
-		reader := c.tp().DotReader()
-		// Step 1: Read headers first and keep them intact
-		headers := make([]byte, 4096)
-		n, err := reader.Read(headers)
-		if err != nil && err != io.EOF {
+		// keep the start of the message (the headers) and discard the rest of the body
+		data, _, err := c.readDotBytes(4096)
+		if err != nil {
 			return "", err
 		}
+		return string(data), nil
+	}
 
-		// Convert headers to string
-		headerString := string(headers[:n])
+	if c.limitedReader != nil {
+		// keep what fits in MaxSize, then lift the limit to read on to the dot. The commands
+		// before DATA don't count towards the message. A message that is too large is still
+		// read to the end, so the client gets the 552 rather than the rest of its message
+		// taken for commands, as long as the end comes before drainLimit.
+		c.limitedReader.N = c.drainLimit()
+		defer func() { c.limitedReader.N = c.MaxSize }()
+
+		data, dropped, err := c.readDotBytes(int(c.MaxSize))
+		if err != nil && c.limitedReader.DidHitLimit {
+			return "", ErrMessageSizeOverrun
+		} else if err != nil {
+			return "", err
+		}
+		if dropped && !c.TruncateOnMaxSize {
+			return "", ErrMessageSizeExceeded
+		}
+		c.truncated = dropped
+		return string(data), nil
+	}
 
-		// Step 2: Discard the message body
-		buf := make([]byte, 4096)
-		for {
-			n, err := reader.Read(buf)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return "", err
-			}
-			if n == 0 {
-				break
+	data, _, err := c.readDotBytes(0)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// readChunk reads the size bytes of a BDAT chunk and adds them to the chunks of the current
+// message. Chunks aren't dot-stuffed, so the bytes are kept exactly as sent.
+func (c *Conn) readChunk(size int64) error {
+	c.readingData = true
+	defer func() { c.readingData = false }()
+
+	if c.limitedReader != nil {
+		// the chunk was held against MaxSize already (see checkChunk), so the allowance left
+		// after the commands mustn't cut it off
+		c.limitedReader.N = c.drainLimit()
+		defer func() { c.limitedReader.N = c.MaxSize }()
+	}
+	// counted whether it's kept or not, for MaxBDATChunks
+	c.chunkCount++
+
+	if c.DiscardBody {
+		// keep the start of the message (the headers) and discard the rest of the body
+		keep := int64(4096 - len(c.chunks))
+		if keep < 0 {
+			keep = 0
+		}
+		if keep > size {
+			keep = size
+		}
+		var err error
+		if c.chunks, err = appendFull(c.chunks, c.tp().R, keep); err != nil {
+			return err
+		}
+		if _, err = io.CopyN(io.Discard, c.tp().R, size-keep); err != nil {
+			return dataReadError(err)
+		}
+		return nil
+	}
+
+	var err error
+	c.chunks, err = appendFull(c.chunks, c.tp().R, size)
+	return err
+}
+
+// discardChunk reads the size bytes of a rejected BDAT chunk and throws them away, to stay in
+// step with the client
+func (c *Conn) discardChunk(size int64) error {
+	c.readingData = true
+	defer func() { c.readingData = false }()
+
+	if c.limitedReader != nil {
+		c.limitedReader.N = c.drainLimit()
+		defer func() { c.limitedReader.N = c.MaxSize }()
+	}
+	if _, err := io.CopyN(io.Discard, c.tp().R, size); err != nil {
+		return dataReadError(err)
+	}
+	return nil
+}
+
+// drainLimit is how much may be read for one message, or one BDAT chunk, before the client is
+// cut off
+func (c *Conn) drainLimit() int64 {
+	if c.MaxSize > math.MaxInt64/drainFactor {
+		return math.MaxInt64
+	}
+	if limit := c.MaxSize * drainFactor; limit > minDrainSize {
+		return limit
+	}
+	return minDrainSize
+}
+
+// chunkedData is the message made up of the BDAT chunks, with the final line ending dropped
+// like ReadData does, so a message comes out the same whichever way it was sent
+func (c *Conn) chunkedData() string {
+	data := bytes.TrimSuffix(c.chunks, []byte("\n"))
+	data = bytes.TrimSuffix(data, []byte("\r"))
+	return string(data)
+}
+
+// dataReadError tells a client that went away in the middle of a message apart from one that
+// was too slow (a net.Error timeout) or was refused (an SMTPError, like the message being too
+// large), returning ErrDataInterrupted for the former
+func dataReadError(err error) error {
+	if _, ok := err.(SMTPError); ok {
+		return err
+	}
+	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+		return err
+	}
+	return ErrDataInterrupted
+}
+
+func appendFull(b []byte, r io.Reader, n int64) ([]byte, error) {
+	buf := bytes.NewBuffer(b)
+	if _, err := io.CopyN(buf, r, n); err != nil {
+		return b, dataReadError(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// readDotBytes reads a dot-terminated DATA block, keeping at most keep bytes (zero for all of
+// them) and discarding the remainder, reporting whether anything was discarded. Unlike
+// textproto's DotReader the original line endings are preserved, only the line ending
+// belonging to the terminating "." is dropped.
+func (c *Conn) readDotBytes(keep int) ([]byte, bool, error) {
+	r := c.tp().R
+	var data []byte
+	dropped := false
+	lineStart := true
+	// header lines are counted until the blank line ending the header block, once there are too
+	// many the rest is read but not kept
+	inHeader, headerLines, tooManyHeaders := c.MaxHeaderLines > 0, 0, false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if lineStart && err == nil && (string(chunk) == ".\r\n" || string(chunk) == ".\n") {
+			break
+		}
+		if lineStart && len(chunk) > 0 && chunk[0] == '.' {
+			chunk = chunk[1:]
+		}
+		if inHeader && lineStart {
+			if string(chunk) == "\r\n" || string(chunk) == "\n" {
+				inHeader = false
+			} else if headerLines++; headerLines > c.MaxHeaderLines {
+				inHeader, tooManyHeaders = false, true
 			}
 		}
+		if tooManyHeaders {
+			// nothing more to keep
+		} else if keep <= 0 {
+			data = append(data, chunk...)
+		} else if len(data)+len(chunk) <= keep {
+			data = append(data, chunk...)
+		} else {
+			data = append(data, chunk[:keep-len(data)]...)
+			dropped = true
+		}
 
-		// Return only the headers, indicating that the body has been discarded
-		return headerString, nil
+		switch err {
+		case nil:
+			lineStart = true
+		case bufio.ErrBufferFull:
+			// a line longer than the read buffer, keep going without treating the
+			// next chunk as the start of a line
+			lineStart = false
+		default:
+			return nil, false, dataReadError(err)
+		}
 	}
 
-	// If DiscardBody is not enabled, read and return the full message content
-	lines, err := c.tp().ReadDotLines()
-	if err != nil {
-		return "", err
+	if tooManyHeaders {
+		return nil, false, ErrTooManyHeaderLines
 	}
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	data = bytes.TrimSuffix(data, []byte("\r"))
+	return data, dropped, nil
+}
 
-	return strings.Join(lines, "\n"), nil
+// tooManyHeaderLines reports whether the header block of data has more than max lines
+func tooManyHeaderLines(data string, max int) bool {
+	if max <= 0 {
+		return false
+	}
+	lines := 0
+	for data != "" {
+		line := data
+		if i := strings.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = ""
+		}
+		if strings.TrimSuffix(line, "\r") == "" {
+			return false
+		}
+		if lines++; lines > max {
+			return true
+		}
+	}
+	return false
 }
 
-// WriteSMTP writes a general SMTP line
+// WriteSMTP writes a general SMTP line. Replies are buffered and sent in one go once there are no
+// more pipelined commands waiting to be handled.
 func (c *Conn) WriteSMTP(code int, message string) error {
 	c.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
-	msg := fmt.Sprintf("%v %v", code, message) + "\r\n"
-	_, err := c.Write([]byte(msg))
-	if c.server.Verbose {
-		c.Logger.Println(c.ID, " SERVER: ", msg)
+	if err := c.writeLine(strconv.Itoa(code) + " " + message); err != nil {
+		return err
 	}
-	return err
+	if c.pipelined() {
+		return nil
+	}
+	return c.Flush()
 }
 
 // WriteEHLO writes an EHLO line, see https://tools.ietf.org/html/rfc2821#section-4.1.1.1
+// The line stays buffered until the final line of the reply is written with WriteSMTP.
 func (c *Conn) WriteEHLO(message string) error {
 	c.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
-	msg := fmt.Sprintf("250-%v", message) + "\r\n"
-	_, err := c.Write([]byte(msg))
+	return c.writeLine("250-" + message)
+}
+
+// writeEHLOLines writes EHLO lines that are already formatted, see Server.ehloExtensions
+func (c *Conn) writeEHLOLines(lines []string) error {
+	c.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	for _, line := range lines {
+		if err := c.writeLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendResponse writes a multiline reply, one line per entry, like "550-first" ... "550 last". It
+// is sent along with any other buffered replies the same way WriteSMTP does.
+func (c *Conn) SendResponse(code int, lines []string) error {
+	if len(lines) == 0 {
+		return c.WriteSMTP(code, "")
+	}
+	c.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	for _, line := range lines[:len(lines)-1] {
+		if err := c.writeLine(strconv.Itoa(code) + "-" + line); err != nil {
+			return err
+		}
+	}
+	return c.WriteSMTP(code, lines[len(lines)-1])
+}
+
+// writeLine buffers a single reply line. Every write to the client goes through here, so each
+// line ends in exactly one CRLF: line breaks inside the text (like from a multiline error
+// message) become spaces, strict clients would take a bare LF as the end of the line.
+func (c *Conn) writeLine(line string) error {
+	if strings.ContainsAny(line, "\r\n") {
+		line = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(line)
+	}
+	w := c.tp().W
+	if _, err := w.WriteString(line); err != nil {
+		return err
+	}
+	if _, err := w.WriteString("\r\n"); err != nil {
+		return err
+	}
 	if c.server.Verbose {
-		c.Logger.Println(c.ID, " SERVER: ", msg)
+		c.Logger.Println(c.ID, " SERVER: ", line)
+	}
+	return nil
+}
+
+// Flush sends any buffered replies to the client
+func (c *Conn) Flush() error {
+	return c.tp().W.Flush()
+}
+
+// pipelined reports whether the client has already sent another complete command, in which case
+// replies can be held back and sent together with the next ones
+func (c *Conn) pipelined() bool {
+	r := c.tp().R
+	n := r.Buffered()
+	if n == 0 {
+		return false
+	}
+	buffered, _ := r.Peek(n)
+	return bytes.IndexByte(buffered, '\n') >= 0
+}
+
+// Close flushes any pending replies and closes the connection
+func (c *Conn) Close() error {
+	c.Flush()
+
+	c.lock.Lock()
+	wasClosed := c.closed
+	c.closed = true
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.lock.Unlock()
+
+	err := c.Conn.Close()
+	if !wasClosed {
+		c.setState(StateClosed)
 	}
 	return err
 }
 
+// setState reports a change of state to the server's ConnState hook, if any
+func (c *Conn) setState(state ConnState) {
+	if c.server != nil && c.server.ConnState != nil {
+		c.server.ConnState(c, state)
+	}
+}
+
+// discardBuffered drops whatever the client sent that hasn't been read yet, returning how many
+// bytes. Commands pipelined behind STARTTLS were sent in plaintext and mustn't be run once the
+// session is encrypted, see https://tools.ietf.org/html/rfc3207#section-6
+func (c *Conn) discardBuffered() int {
+	r := c.tp().R
+	n, _ := r.Discard(r.Buffered())
+	return n
+}
+
+// upgradeTLS carries on the session over tlsConn after STARTTLS. Like a new connection, anything
+// the client said before the upgrade is forgotten, see https://tools.ietf.org/html/rfc3207#section-4.2
+func (c *Conn) upgradeTLS(tlsConn *tls.Conn, id string) {
+	c.Conn = tlsConn
+	c.ID = id
+	c.IsTLS = true
+
+	c.ClientHostname = ""
+	c.ClientHostnameASCII = ""
+	c.FromAddr = nil
+	c.ToAddr = nil
+	c.DeclaredSize = 0
+	c.BodyType = ""
+	c.transaction = 0
+	c.truncated = false
+
+	// start over with an empty reader and writer on top of the TLS connection
+	c.asTextProto = sync.Once{}
+	c.textProto = nil
+	c.limitedReader = nil
+}
+
+// Context returns a context that is cancelled once the connection is closed, so handlers can
+// abandon downstream calls when the client goes away. It carries over a STARTTLS upgrade.
+func (c *Conn) Context() context.Context {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.ctx == nil {
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+		if c.closed {
+			c.cancel()
+		}
+	}
+	return c.ctx
+}
+
 const OK string = "OK"
 
 // WriteOK is a convenience function for sending the default OK response
@@ -0,0 +1,536 @@
+package smtpd
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingConn records how many writes reach the underlying connection
+type countingConn struct {
+	net.Conn
+	lock   sync.Mutex
+	writes int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	c.writes++
+	c.lock.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *countingConn) Writes() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.writes
+}
+
+// pipeSession starts handling an in-memory connection with the server and returns the client end
+func pipeSession(s *Server) (*textproto.Conn, *countingConn) {
+	serverSide, clientSide := net.Pipe()
+	counted := &countingConn{Conn: serverSide}
+	go s.HandleSMTP(s.newConn(counted))
+	return textproto.NewConn(clientSide), counted
+}
+
+func TestConnEHLOSingleFlush(t *testing.T) {
+	server := NewServer(nil)
+	for _, verb := range []string{"XONE", "XTWO", "XTHREE", "XFOUR", "XFIVE", "XSIX"} {
+		server.Extend(verb, &SimpleExtension{Ehlo: "enabled"})
+	}
+
+	client, counted := pipeSession(server)
+	defer client.Close()
+
+	if _, _, err := client.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	before := counted.Writes()
+
+	if err := client.PrintfLine("EHLO client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := client.ReadResponse(250)
+	if err != nil {
+		t.Fatalf("Expected EHLO reply: %v", err)
+	}
+
+	if lines := len(strings.Split(msg, "\n")); lines < 8 {
+		t.Errorf("Expected a multiline EHLO reply, got %v lines", lines)
+	}
+	if writes := counted.Writes() - before; writes != 1 {
+		t.Errorf("Expected the EHLO reply in a single write, got: %v", writes)
+	}
+}
+
+func BenchmarkConnEHLO(b *testing.B) {
+	server := NewServer(nil)
+	server.TLSConfig = TestingTLSConfig()
+	server.Auth = NewAuth()
+	server.Auth.(*Auth).Extend("PLAIN", &AuthPlain{})
+	for _, verb := range []string{"XONE", "XTWO", "XTHREE"} {
+		server.Extend(verb, &SimpleExtension{Ehlo: "enabled"})
+	}
+	server.MaxCommands = b.N + 1
+
+	client, _ := pipeSession(server)
+	defer client.Close()
+	if _, _, err := client.ReadResponse(220); err != nil {
+		b.Fatalf("Expected greeting: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.PrintfLine("EHLO client.example.com"); err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := client.ReadResponse(250); err != nil {
+			b.Fatalf("Expected EHLO reply: %v", err)
+		}
+	}
+}
+
+func TestConnPipelinedRepliesSingleFlush(t *testing.T) {
+	server := NewServer(nil)
+
+	client, counted := pipeSession(server)
+	defer client.Close()
+
+	if _, _, err := client.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	before := counted.Writes()
+
+	if _, err := client.W.WriteString("NOOP\r\nNOOP\r\nNOOP\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.W.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := client.ReadResponse(250); err != nil {
+			t.Fatalf("Expected NOOP reply %v: %v", i, err)
+		}
+	}
+
+	if writes := counted.Writes() - before; writes != 1 {
+		t.Errorf("Expected the pipelined replies in a single write, got: %v", writes)
+	}
+}
+
+func TestConnWireTap(t *testing.T) {
+	var lock sync.Mutex
+	seen := map[Direction]string{}
+
+	server := NewServer(nil)
+	server.WireTap = func(conn *Conn, dir Direction, b []byte) {
+		lock.Lock()
+		seen[dir] += string(b)
+		lock.Unlock()
+	}
+
+	client, _ := pipeSession(server)
+	defer client.Close()
+
+	if _, _, err := client.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	if err := client.PrintfLine("EHLO client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.ReadResponse(250); err != nil {
+		t.Fatalf("Expected EHLO reply: %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !strings.HasPrefix(seen[DirectionOut], "220 "+server.Name) {
+		t.Errorf("Expected the tap to see the greeting, got: %q", seen[DirectionOut])
+	}
+	if seen[DirectionIn] != "EHLO client.example.com\r\n" {
+		t.Errorf("Expected the tap to see the client EHLO, got: %q", seen[DirectionIn])
+	}
+}
+
+func TestConnRepliesEndInCRLF(t *testing.T) {
+	var lock sync.Mutex
+	var out []byte
+
+	server := NewServer(func(*Message) error {
+		return NewError(550, "first line\nsecond line\r\nthird line")
+	})
+	server.Extend("XMULTI", &SimpleExtension{
+		Ehlo: "enabled",
+		Handler: func(conn *Conn, args string) error {
+			return conn.SendResponse(250, []string{"one\n", "two\r", "three"})
+		},
+	})
+	server.WireTap = func(conn *Conn, dir Direction, b []byte) {
+		if dir == DirectionOut {
+			lock.Lock()
+			out = append(out, b...)
+			lock.Unlock()
+		}
+	}
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, c, 250, "EHLO client.example.com")
+	expectReply(t, c, 250, "XMULTI")
+	expectReply(t, c, 500, "NOPE")
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	expectReply(t, c, 550, "From: sender@example.org\r\n\r\nHi\r\n.")
+	expectReply(t, c, 221, "QUIT")
+
+	lock.Lock()
+	defer lock.Unlock()
+	for i, b := range out {
+		if b == '\n' && (i == 0 || out[i-1] != '\r') {
+			t.Errorf("Bare LF at %v in server output: %q", i, out)
+		}
+		if b == '\r' && (i == len(out)-1 || out[i+1] != '\n') {
+			t.Errorf("Bare CR at %v in server output: %q", i, out)
+		}
+	}
+}
+
+// remoteAddrConn pretends the client is connecting from somewhere else
+type remoteAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (r *remoteAddrConn) RemoteAddr() net.Addr {
+	return r.remote
+}
+
+func TestConnClientIP(t *testing.T) {
+	c := &Conn{Conn: &remoteAddrConn{remote: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 25}}}
+	if ip := c.ClientIP(); !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("Wrong client IP from the remote address, got: %v", ip)
+	}
+
+	c.ForwardedForIP = "192.0.2.7"
+	if ip := c.ClientIP(); !ip.Equal(net.ParseIP("192.0.2.7")) {
+		t.Errorf("Expected ForwardedForIP to take precedence, got: %v", ip)
+	}
+}
+
+func TestConnIsTrusted(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.20.0.0/16")
+	nets := []*net.IPNet{trusted}
+
+	cases := map[string]bool{
+		"127.0.0.1":   true,
+		"::1":         true,
+		"10.20.30.40": true,
+		"10.21.0.1":   false,
+		"192.0.2.7":   false,
+	}
+	for ip, want := range cases {
+		c := &Conn{Conn: &remoteAddrConn{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25}}}
+		if got := c.IsTrusted(nets); got != want {
+			t.Errorf("Wrong trust for %v, want: %v, got: %v", ip, want, got)
+		}
+	}
+
+	// a forwarded address doesn't make an untrusted peer trusted
+	c := &Conn{Conn: &remoteAddrConn{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 25}}}
+	c.ForwardedForIP = "10.20.0.1"
+	if c.IsTrusted(nets) {
+		t.Error("Expected ForwardedForIP to be ignored")
+	}
+	if c.IsTrusted(nil) {
+		t.Error("Expected no trust without trusted networks")
+	}
+}
+
+func TestConnResolveForwardedFor(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.20.0.0/16")
+	trusted := []*net.IPNet{proxies}
+
+	tests := []struct {
+		name  string
+		peer  string
+		chain string
+		want  string
+	}{
+		{"one trusted hop", "10.20.0.1", "198.51.100.4", "198.51.100.4"},
+		{"two trusted hops", "10.20.0.1", "198.51.100.4, 10.20.0.2", "198.51.100.4"},
+		{"spoofed client", "10.20.0.1", "192.0.2.66, 198.51.100.4, 10.20.0.2", "198.51.100.4"},
+		{"spoofed proxy", "10.20.0.1", "10.20.9.9, 198.51.100.4", "198.51.100.4"},
+		{"garbage", "10.20.0.1", "not-an-ip, 10.20.0.2", "10.20.0.2"},
+		{"untrusted peer", "203.0.113.5", "198.51.100.4", ""},
+	}
+	for _, tt := range tests {
+		c := &Conn{Conn: &remoteAddrConn{remote: &net.TCPAddr{IP: net.ParseIP(tt.peer), Port: 25}}}
+		c.ResolveForwardedFor(tt.chain, trusted)
+		if c.ForwardedForIP != tt.want {
+			t.Errorf("%v: expected ForwardedForIP %q, got %q", tt.name, tt.want, c.ForwardedForIP)
+		}
+	}
+}
+
+type fakeResolver struct {
+	names   map[string][]string
+	mx      map[string][]*net.MX
+	hosts   map[string][]string
+	txt     map[string][]string
+	lookups int
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.lookups++
+	if names, ok := r.names[addr]; ok {
+		return names, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.lookups++
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.lookups++
+	if records, ok := r.txt[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.lookups++
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestConnRemoteHostname(t *testing.T) {
+	resolver := &fakeResolver{names: map[string][]string{"192.0.2.7": {"Mail.Example.org."}}}
+	server := NewServer(nil)
+	server.Resolver = resolver
+
+	newConn := func(ip string) *Conn {
+		return &Conn{Conn: &remoteAddrConn{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25}}, server: server}
+	}
+
+	c := newConn("192.0.2.7")
+	for i := 0; i < 3; i++ {
+		if name := c.RemoteHostname(); name != "mail.example.org" {
+			t.Errorf("Wrong remote hostname: %q", name)
+		}
+	}
+	if resolver.lookups != 1 {
+		t.Errorf("Expected the name to be looked up once, got: %v lookups", resolver.lookups)
+	}
+
+	if name := newConn("198.51.100.4").RemoteHostname(); name != "" {
+		t.Errorf("Expected no name for an address without a PTR, got: %q", name)
+	}
+
+	server.DisableReverseDNS = true
+	resolver.lookups = 0
+	if name := newConn("192.0.2.7").RemoteHostname(); name != "" || resolver.lookups != 0 {
+		t.Errorf("Expected no lookup with DisableReverseDNS, got: %q after %v lookups", name, resolver.lookups)
+	}
+}
+
+func TestConnContextCancelledOnClose(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+
+	c := NewServer(nil).newConn(serverSide)
+	ctx := c.Context()
+	select {
+	case <-ctx.Done():
+		t.Fatal("Expected the context to stay open while the connection is")
+	default:
+	}
+
+	c.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the context to be cancelled when the connection closed")
+	}
+	if c.Context() != ctx {
+		t.Error("Expected the same context after closing")
+	}
+}
+
+func TestConnStateTransitions(t *testing.T) {
+	var lock sync.Mutex
+	var states []string
+	closed := make(chan struct{})
+
+	server := NewServer(nil)
+	server.ConnState = func(conn *Conn, state ConnState) {
+		lock.Lock()
+		states = append(states, state.String())
+		lock.Unlock()
+		if state == StateClosed {
+			close(closed)
+		}
+	}
+
+	client, _ := pipeSession(server)
+	defer client.Close()
+
+	if _, _, err := client.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	if err := client.PrintfLine("NOOP"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.ReadResponse(250); err != nil {
+		t.Fatalf("Expected NOOP reply: %v", err)
+	}
+	if err := client.PrintfLine("QUIT"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.ReadResponse(221); err != nil {
+		t.Fatalf("Expected QUIT reply: %v", err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected StateClosed to be reported")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	want := "new idle active idle active closed"
+	if got := strings.Join(states, " "); got != want {
+		t.Errorf("Wrong state sequence, want: %v, got: %v", want, got)
+	}
+}
+
+func TestConnSendResponse(t *testing.T) {
+	server := NewServer(nil)
+	server.Extend("XEXPLAIN", &SimpleExtension{
+		Handler: func(conn *Conn, args string) error {
+			return conn.SendResponse(550, []string{
+				"5.7.1 message rejected",
+				"5.7.1 see https://example.com/policy",
+				"5.7.1 for details",
+			})
+		},
+	})
+
+	client, _ := pipeSession(server)
+	defer client.Close()
+
+	if _, _, err := client.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	if err := client.PrintfLine("XEXPLAIN"); err != nil {
+		t.Fatal(err)
+	}
+	code, msg, err := client.ReadResponse(550)
+	if err != nil {
+		t.Fatalf("Expected a 550 reply: %v", err)
+	}
+	want := "5.7.1 message rejected\n5.7.1 see https://example.com/policy\n5.7.1 for details"
+	if code != 550 || msg != want {
+		t.Errorf("Wrong multiline reply, got: %v %q", code, msg)
+	}
+
+	// the session carries on normally afterwards
+	if err := client.PrintfLine("NOOP"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.ReadResponse(250); err != nil {
+		t.Errorf("Expected NOOP reply: %v", err)
+	}
+}
+
+func TestConnAbortTransaction(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.OnRcpt = func(addresses []*mail.Address, conn *Conn, messageID string) error {
+		for _, addr := range addresses {
+			if addr.Address == "blocked@example.net" {
+				return conn.AbortTransaction(550, "5.7.1 recipient refused")
+			}
+		}
+		return nil
+	}
+
+	client, _ := pipeSession(server)
+	defer client.Close()
+
+	if _, _, err := client.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, client, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, client, 250, "RCPT TO:<blocked@example.net>")
+	if msg := expectReply(t, client, 550, "DATA"); msg != "5.7.1 recipient refused" {
+		t.Errorf("Expected the hook's reply, got: %v", msg)
+	}
+
+	// the aborted recipient is gone, a new transaction starts from scratch
+	expectReply(t, client, 250, "MAIL FROM:<other@example.org>")
+	expectReply(t, client, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, client, 354, "DATA")
+	expectReply(t, client, 250, "From: other@example.org\r\n\r\nHello\r\n.")
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+	msg := recorder.Messages[0]
+	if len(msg.Rcpt) != 1 || msg.Rcpt[0].Address != "recipient@example.net" {
+		t.Errorf("Expected only the new recipient, got: %v", msg.Rcpt)
+	}
+	if msg.Conn.FromAddr == nil || msg.Conn.FromAddr.Address != "other@example.org" {
+		t.Errorf("Expected the new sender, got: %v", msg.Conn.FromAddr)
+	}
+}
+
+func TestConnClientHostnameIDN(t *testing.T) {
+	server := NewServer(nil)
+	server.Commands["XNAME"] = func(conn *Conn, args string) error {
+		conn.WriteSMTP(250, conn.ClientHostname+" "+conn.ClientHostnameASCII)
+		return nil
+	}
+
+	client, _ := pipeSession(server)
+	defer client.Close()
+	if _, _, err := client.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+
+	tests := []struct {
+		helo string
+		want string
+	}{
+		{"Bücher.example", "bücher.example xn--bcher-kva.example"},
+		{"mail.example.com", "mail.example.com mail.example.com"},
+		{"[192.0.2.1]", "[192.0.2.1] [192.0.2.1]"},
+		{"bad_ü.example", "bad_ü.example "},
+	}
+	for _, tt := range tests {
+		expectReply(t, client, 250, "HELO %v", tt.helo)
+		if got := expectReply(t, client, 250, "XNAME"); got != tt.want {
+			t.Errorf("HELO %v: expected %q, got %q", tt.helo, tt.want, got)
+		}
+	}
+}
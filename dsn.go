@@ -0,0 +1,119 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// dsnStatus is an RFC 3463 enhanced status code, like 5.1.1
+var dsnStatus = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}$`)
+
+// GenerateDSN builds a delivery status notification, see https://tools.ietf.org/html/rfc3464,
+// telling the sender of original what became of it. status is an enhanced status code like
+// "5.1.1", a 5 making it a bounce, a 4 a delay warning. diagnostic is the reason, usually the
+// reply of the server that turned the message away, like "550 5.1.1 no such user".
+//
+// The notification is a multipart/report with a human readable text/plain part, the
+// message/delivery-status with a block for each recipient of original (Rcpt, or the To
+// addresses when it has none), and the headers of original as text/rfc822-headers. It is
+// addressed to the From of original and comes from MAILER-DAEMON at the name of the server
+// original was received by. When relaying it, use an empty MAIL FROM so it can't bounce in turn.
+func GenerateDSN(original *Message, status, diagnostic string) (*Message, error) {
+	if !dsnStatus.MatchString(status) {
+		return nil, fmt.Errorf("invalid DSN status %q", status)
+	}
+	if original.From == nil {
+		return nil, fmt.Errorf("original message has no sender to notify")
+	}
+
+	reportingMTA := "localhost"
+	if original.Conn != nil && original.Conn.server != nil {
+		reportingMTA = original.Conn.server.ServerName
+	} else if name, err := os.Hostname(); err == nil {
+		reportingMTA = name
+	}
+
+	recipients := original.Rcpt
+	if len(recipients) == 0 {
+		recipients = original.To
+	}
+
+	action, subject, summary := "failed", "Undelivered Mail Returned to Sender",
+		"Your message could not be delivered to the following recipients:"
+	switch status[0] {
+	case '4':
+		action, subject, summary = "delayed", "Delayed Mail (still being retried)",
+			"Your message has not been delivered yet to the following recipients. Delivery will be retried, no action is needed for now:"
+	case '2':
+		action, subject, summary = "delivered", "Successful Mail Delivery Report",
+			"Your message was delivered to the following recipients:"
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	// the human readable explanation
+	text, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {`text/plain; charset="UTF-8"`}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(text, "This is the mail system at %v.\r\n\r\n%v\r\n\r\n", reportingMTA, summary)
+	for _, rcpt := range recipients {
+		fmt.Fprintf(text, "<%v>: %v\r\n", rcpt.Address, diagnostic)
+	}
+
+	// the machine readable report, a per-message block and one per recipient
+	report, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(report, "Reporting-MTA: dns; %v\r\n", reportingMTA)
+	if date := original.Header.Get("Date"); date != "" {
+		fmt.Fprintf(report, "Arrival-Date: %v\r\n", date)
+	}
+	for _, rcpt := range recipients {
+		fmt.Fprintf(report, "\r\nFinal-Recipient: rfc822; %v\r\nAction: %v\r\nStatus: %v\r\n", rcpt.Address, action, status)
+		if diagnostic != "" {
+			fmt.Fprintf(report, "Diagnostic-Code: smtp; %v\r\n", strings.Join(strings.Fields(diagnostic), " "))
+		}
+	}
+
+	// the headers of the original, enough to tell which message it was without sending it all back
+	headers, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/rfc822-headers"}})
+	if err != nil {
+		return nil, err
+	}
+	headers.Write(crlf(original.RawHeaders))
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	from := mail.Address{Name: "Mail Delivery System", Address: "MAILER-DAEMON@" + reportingMTA}
+	var source bytes.Buffer
+	fmt.Fprintf(&source, "From: %v\r\n", from.String())
+	fmt.Fprintf(&source, "To: %v\r\n", original.From.String())
+	fmt.Fprintf(&source, "Subject: %v\r\n", subject)
+	fmt.Fprintf(&source, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&source, "Message-ID: <%v@%v>\r\n", NewMessageID(), reportingMTA)
+	if id := original.Header.Get("Message-ID"); id != "" {
+		fmt.Fprintf(&source, "In-Reply-To: %v\r\nReferences: %v\r\n", id, id)
+	}
+	source.WriteString("Auto-Submitted: auto-replied\r\nMIME-Version: 1.0\r\n")
+	fmt.Fprintf(&source, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n\r\n", parts.Boundary())
+	source.Write(body.Bytes())
+
+	return NewMessage(nil, source.Bytes(), []*mail.Address{original.From}, original.Logger)
+}
+
+// crlf makes every line ending CRLF, leaving ones that already are alone
+func crlf(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
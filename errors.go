@@ -4,11 +4,27 @@ import "errors"
 
 // Well-defined errors
 var (
-	ErrAlreadyRunning = errors.New("This server is already listening for requests")
-	ErrAuthFailed     = SMTPError{535, errors.New("Authentication credentials invalid")}
-	ErrAuthCancelled  = SMTPError{501, errors.New("Cancelled")}
-	ErrRequiresTLS    = SMTPError{538, errors.New("Encryption required for requested authentication mechanism")}
-	ErrTransaction    = SMTPError{501, errors.New("Transaction unsuccessful")}
+	ErrAlreadyRunning      = errors.New("This server is already listening for requests")
+	ErrCloseSession        = errors.New("session closed")
+	ErrWriteStalled        = errors.New("client stalled reading replies")
+	ErrNoListenFDs         = errors.New("no listeners were passed with LISTEN_FDS")
+	ErrAuthFailed          = SMTPError{535, errors.New("Authentication credentials invalid")}
+	ErrAuthCancelled       = SMTPError{501, errors.New("Cancelled")}
+	ErrAuthBadEncoding     = SMTPError{501, errors.New("5.5.2 Cannot decode the response")}
+	ErrRequiresTLS         = SMTPError{538, errors.New("5.7.11 Encryption required for requested authentication mechanism")}
+	ErrTransaction         = SMTPError{501, errors.New("Transaction unsuccessful")}
+	ErrHandlerTimeout      = SMTPError{451, errors.New("4.4.7 delivery timeout")}
+	ErrReadTimeout         = SMTPError{421, errors.New("4.4.2 timeout")}
+	ErrRoutingLoop         = SMTPError{554, errors.New("5.4.6 routing loop detected")}
+	ErrAttachmentBlocked   = SMTPError{550, errors.New("5.7.1 attachment type not allowed")}
+	ErrDataInterrupted     = SMTPError{421, errors.New("4.4.2 connection lost during message data")}
+	ErrMessageSizeExceeded = SMTPError{552, errors.New("message size too large")}
+	ErrMessageSizeOverrun  = SMTPError{552, errors.New("5.3.4 message size too large, closing connection")}
+	ErrTooManyHeaderLines  = SMTPError{552, errors.New("5.3.4 too many header lines")}
+	ErrTooManyChunks       = SMTPError{552, errors.New("5.3.4 too many BDAT chunks")}
+	ErrMailboxFull         = SMTPError{452, errors.New("4.2.2 mailbox full")}
+	ErrRelayTLSRequired    = SMTPError{451, errors.New("4.7.5 TLS is required for this domain but the upstream server does not offer it")}
+	ErrRelayMXNotAllowed   = SMTPError{451, errors.New("4.7.5 the upstream server is not an MX allowed by the domain's MTA-STS policy")}
 )
 
 // SMTPError is an error + SMTP response code
@@ -26,3 +42,21 @@ func (a SMTPError) Error() string {
 func NewError(code int, message string) SMTPError {
 	return SMTPError{code, errors.New(message)}
 }
+
+// Defer is for handlers to turn a message away for now, the client gets a 451 4.3.0 and should
+// try again later
+func Defer(reason string) error {
+	if reason == "" {
+		reason = "try again later"
+	}
+	return NewError(451, "4.3.0 "+reason)
+}
+
+// Reject is for handlers to turn a message away for good, the client gets a 550 5.7.1 and
+// shouldn't try again
+func Reject(reason string) error {
+	if reason == "" {
+		reason = "message rejected"
+	}
+	return NewError(550, "5.7.1 "+reason)
+}
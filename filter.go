@@ -0,0 +1,229 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"mime"
+	"net/textproto"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// BodyFilterAction is what happens to a message whose body matches a BodyFilter
+type BodyFilterAction int
+
+const (
+	// BodyFilterReject refuses the message
+	BodyFilterReject BodyFilterAction = iota
+	// BodyFilterTag delivers the message with a header added
+	BodyFilterTag
+)
+
+// BodyFilter is a content rule checked against the decoded text and HTML bodies of a message
+type BodyFilter struct {
+	Pattern *regexp.Regexp
+	Action  BodyFilterAction
+
+	// Code and Message are the reply when rejecting, 550 "5.7.1 message content rejected" by default
+	Code    int
+	Message string
+
+	// Header and Tag are added to the message when tagging, "X-Body-Filter" with the pattern by default
+	Header string
+	Tag    string
+}
+
+// applyBodyFilters runs the message bodies through the BodyFilters in order. The first rejecting
+// filter that matches stops the message, tags from matching filters before it are kept.
+func (s *Server) applyBodyFilters(m *Message) error {
+	if len(s.BodyFilters) == 0 {
+		return nil
+	}
+
+	var bodies [][]byte
+	if plain, err := m.Plain(); err == nil || isCharsetError(err) {
+		bodies = append(bodies, plain)
+	}
+	if html, err := m.HTML(); err == nil || isCharsetError(err) {
+		bodies = append(bodies, html)
+	}
+
+	for _, filter := range s.BodyFilters {
+		if !matchesAny(filter.Pattern, bodies) {
+			continue
+		}
+
+		switch filter.Action {
+		case BodyFilterReject:
+			code, msg := filter.Code, filter.Message
+			if code == 0 {
+				code = 550
+			}
+			if msg == "" {
+				msg = "5.7.1 message content rejected"
+			}
+			return NewError(code, msg)
+		case BodyFilterTag:
+			header, tag := filter.Header, filter.Tag
+			if header == "" {
+				header = "X-Body-Filter"
+			}
+			if tag == "" {
+				tag = filter.Pattern.String()
+			}
+			m.AddHeader(header, tag)
+		}
+	}
+	return nil
+}
+
+func matchesAny(pattern *regexp.Regexp, bodies [][]byte) bool {
+	for _, body := range bodies {
+		if pattern.Match(body) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedAttachment reports whether a part is an attachment the server doesn't take, going by
+// BlockedAttachmentExtensions and BlockedAttachmentTypes
+func (s *Server) blockedAttachment(p *Part) bool {
+	if ext := strings.ToLower(path.Ext(p.FileName())); ext != "" {
+		for _, blocked := range s.BlockedAttachmentExtensions {
+			if strings.ToLower("."+strings.TrimPrefix(blocked, ".")) == ext {
+				return true
+			}
+		}
+	}
+	for _, blocked := range s.BlockedAttachmentTypes {
+		if strings.EqualFold(blocked, p.ContentType()) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAttachments rejects messages carrying blocked attachments, or with
+// StripBlockedAttachments takes those attachments out and names them in an
+// X-Attachment-Stripped header. Every part is looked at, nested ones included, and a message
+// that can't be taken apart is rejected, as there's no telling what it carries.
+func (s *Server) checkAttachments(m *Message) error {
+	if len(s.BlockedAttachmentExtensions) == 0 && len(s.BlockedAttachmentTypes) == 0 {
+		return nil
+	}
+
+	if blocked, err := s.hasBlockedPart(m); err != nil {
+		return ErrAttachmentBlocked
+	} else if !blocked {
+		return nil
+	}
+	if !s.StripBlockedAttachments {
+		return ErrAttachmentBlocked
+	}
+
+	stripped, err := m.removeParts(s.blockedAttachment)
+	if err != nil {
+		// can't take it out, so the message can't go through either
+		return ErrAttachmentBlocked
+	}
+	// only top level parts can be taken out, one further down still blocks the message
+	if blocked, err := s.hasBlockedPart(m); err != nil || blocked {
+		return ErrAttachmentBlocked
+	}
+	for _, name := range stripped {
+		m.AddHeader("X-Attachment-Stripped", name)
+	}
+	return nil
+}
+
+// hasBlockedPart walks all the leaf parts of the message looking for a blocked one
+func (s *Server) hasBlockedPart(m *Message) (bool, error) {
+	parts, err := m.Parts()
+	if err != nil {
+		return false, err
+	}
+	var walk func(parts []*Part) bool
+	walk = func(parts []*Part) bool {
+		for _, part := range parts {
+			if len(part.Children) > 0 {
+				if walk(part.Children) {
+					return true
+				}
+			} else if s.blockedAttachment(part) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(parts), nil
+}
+
+// removeParts takes the top level parts of a multipart/mixed message that drop picks out of
+// RawBody and Source, returning their file names
+func (m *Message) removeParts(drop func(*Part) bool) ([]string, error) {
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != "multipart/mixed" || params["boundary"] == "" {
+		return nil, errors.New("parts can only be removed from multipart/mixed messages")
+	}
+	if !bytes.HasSuffix(m.Source, m.RawBody) {
+		return nil, errors.New("message body doesn't match its source")
+	}
+	delimiter := []byte("--" + params["boundary"])
+
+	// where each delimiter line starts, the line ending before it belongs to the delimiter
+	var starts []int
+	for offset := 0; offset < len(m.RawBody); {
+		i := bytes.Index(m.RawBody[offset:], delimiter)
+		if i < 0 {
+			break
+		}
+		i += offset
+		if i == 0 || m.RawBody[i-1] == '\n' {
+			start := i
+			if start > 0 {
+				start--
+				if start > 0 && m.RawBody[start-1] == '\r' {
+					start--
+				}
+			}
+			starts = append(starts, start)
+		}
+		offset = i + len(delimiter)
+	}
+
+	var body []byte
+	var stripped []string
+	kept := 0
+	for i := 0; i+1 < len(starts); i++ {
+		section := m.RawBody[starts[i]:starts[i+1]]
+		eol := bytes.IndexByte(section[bytes.Index(section, delimiter):], '\n')
+		if eol < 0 {
+			continue
+		}
+		content := section[bytes.Index(section, delimiter)+eol+1:]
+		header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(content))).ReadMIMEHeader()
+		if err != nil {
+			continue
+		}
+		if part := (&Part{Header: header}); drop(part) {
+			body = append(body, m.RawBody[kept:starts[i]]...)
+			kept = starts[i+1]
+			stripped = append(stripped, part.FileName())
+		}
+	}
+	if len(stripped) == 0 {
+		return nil, nil
+	}
+	body = append(body, m.RawBody[kept:]...)
+
+	headers := m.Source[:len(m.Source)-len(m.RawBody)]
+	m.Source = append(append([]byte(nil), headers...), body...)
+	m.RawBody = m.Source[len(headers):]
+	return stripped, nil
+}
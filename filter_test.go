@@ -0,0 +1,182 @@
+package smtpd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSMTPServerBodyFilters(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.BodyFilters = []BodyFilter{
+		{Pattern: regexp.MustCompile(`(?i)newsletter`), Action: BodyFilterTag, Header: "X-Category", Tag: "bulk"},
+		{Pattern: regexp.MustCompile(`(?i)free\s+money`), Action: BodyFilterReject, Code: 554, Message: "5.7.1 no thanks"},
+	}
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	send := func(contentType, body string) error {
+		data := fmt.Sprintf("From: sender@example.org\nContent-Type: %v\n\n%v", contentType, body)
+		return server.SendTestMessage("sender@example.org", []string{"recipient@example.net"}, []byte(data))
+	}
+
+	err := send("text/html", "<p>Get your FREE\nMONEY today</p>")
+	if serr, ok := err.(SMTPError); !ok || serr.Code != 554 || serr.Err.Error() != "5.7.1 no thanks" {
+		t.Errorf("Expected the banned phrase to be rejected with the filter's reply, got: %v", err)
+	}
+
+	if err := send("text/plain", "This week's newsletter"); err != nil {
+		t.Errorf("Expected a tagged message to be accepted, got: %v", err)
+	}
+	if err := send("text/plain", "Just saying hi"); err != nil {
+		t.Errorf("Expected a clean message to be accepted, got: %v", err)
+	}
+
+	if len(recorder.Messages) != 2 {
+		t.Fatalf("Expected 2 messages delivered, got: %v", len(recorder.Messages))
+	}
+	if tag := recorder.Messages[0].Header.Get("X-Category"); tag != "bulk" {
+		t.Errorf("Expected the newsletter to be tagged, got: %q", tag)
+	}
+	if tag := recorder.Messages[1].Header.Get("X-Category"); tag != "" {
+		t.Errorf("Expected the clean message to be left alone, got: %q", tag)
+	}
+}
+
+const exeAttachmentEmail = "From: sender@example.org\r\n" +
+	"Subject: Invoice\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"mixed\"\r\n" +
+	"\r\n" +
+	"--mixed\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Please see attached\r\n" +
+	"--mixed\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=\"Invoice.EXE\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"TVqQAAMAAAAEAAAA\r\n" +
+	"--mixed\r\n" +
+	"Content-Type: text/plain; name=\"notes.txt\"\r\n" +
+	"Content-Disposition: attachment; filename=\"notes.txt\"\r\n" +
+	"\r\n" +
+	"some notes\r\n" +
+	"--mixed--\r\n"
+
+func TestSMTPServerBlockedAttachments(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.BlockedAttachmentExtensions = []string{".exe", "js"}
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	send := func(code int) string {
+		t.Helper()
+		expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+		expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+		expectReply(t, c, 354, "DATA")
+		return expectReply(t, c, code, "%v.", exeAttachmentEmail)
+	}
+
+	if msg := send(550); msg != "5.7.1 attachment type not allowed" {
+		t.Errorf("Expected the .exe attachment to be rejected, got: %v", msg)
+	}
+	if len(recorder.Messages) != 0 {
+		t.Fatalf("Expected nothing delivered, got: %v", len(recorder.Messages))
+	}
+
+	server.StripBlockedAttachments = true
+	send(250)
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected the stripped message delivered, got: %v", len(recorder.Messages))
+	}
+	msg := recorder.Messages[0]
+	if got := msg.Header.Get("X-Attachment-Stripped"); got != "Invoice.EXE" {
+		t.Errorf("Expected the stripped attachment named, got: %q", got)
+	}
+	attachments, err := msg.Attachments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, attachment := range attachments {
+		names = append(names, attachment.FileName())
+	}
+	if len(names) != 2 || names[1] != "notes.txt" {
+		t.Errorf("Expected the text body and notes.txt left, got: %q", names)
+	}
+	if strings.Contains(string(msg.Source), "TVqQ") {
+		t.Error("Expected the attachment gone from the source")
+	}
+	if !strings.HasPrefix(string(msg.Source), "X-Attachment-Stripped: Invoice.EXE\r\nFrom:") {
+		t.Errorf("Expected the header at the top of the source, got: %q", msg.Source[:60])
+	}
+}
+
+func TestSMTPServerBlockedAttachmentShapes(t *testing.T) {
+	server := NewServer(nil)
+	server.BlockedAttachmentExtensions = []string{".exe"}
+
+	tests := map[string]string{
+		"single part": "From: sender@example.org\r\n" +
+			"Content-Type: application/octet-stream\r\n" +
+			"Content-Disposition: attachment; filename=\"evil.exe\"\r\n" +
+			"\r\n" +
+			"MZ\r\n",
+		"nested": "From: sender@example.org\r\n" +
+			"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+			"\r\n" +
+			"--outer\r\n" +
+			"Content-Type: multipart/mixed; boundary=\"inner\"\r\n" +
+			"\r\n" +
+			"--inner\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"Please see attached\r\n" +
+			"--inner\r\n" +
+			"Content-Type: application/octet-stream\r\n" +
+			"Content-Disposition: attachment; filename=\"evil.exe\"\r\n" +
+			"\r\n" +
+			"MZ\r\n" +
+			"--inner--\r\n" +
+			"--outer--\r\n",
+		"malformed part": "From: sender@example.org\r\n" +
+			"Content-Type: multipart/mixed; boundary=\"mixed\"\r\n" +
+			"\r\n" +
+			"--mixed\r\n" +
+			"Content-Type: text/plain; charset=\r\n" +
+			"\r\n" +
+			"hello\r\n" +
+			"--mixed\r\n" +
+			"Content-Type: application/octet-stream\r\n" +
+			"Content-Disposition: attachment; filename=\"evil.exe\"\r\n" +
+			"\r\n" +
+			"MZ\r\n" +
+			"--mixed--\r\n",
+	}
+	for name, raw := range tests {
+		for _, strip := range []bool{false, true} {
+			server.StripBlockedAttachments = strip
+			msg, err := NewMessage(nil, []byte(raw), nil, nil)
+			if err != nil {
+				t.Fatalf("%v: error creating message: %v", name, err)
+			}
+			if err := server.checkAttachments(msg); err != ErrAttachmentBlocked {
+				t.Errorf("%v (strip %v): expected the message blocked, got: %v", name, strip, err)
+			}
+		}
+	}
+
+	clean, _ := NewMessage(nil, []byte("From: sender@example.org\r\nContent-Type: text/plain\r\n\r\nhello\r\n"), nil, nil)
+	if err := server.checkAttachments(clean); err != nil {
+		t.Errorf("Expected a plain message through, got: %v", err)
+	}
+}
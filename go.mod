@@ -1,3 +1,10 @@
 module github.com/mailsac/smtpd
 
 go 1.18
+
+require go.mozilla.org/pkcs7 v0.9.0
+
+require (
+	golang.org/x/net v0.35.0
+	golang.org/x/text v0.22.0
+)
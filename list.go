@@ -0,0 +1,61 @@
+package smtpd
+
+import (
+	"strings"
+)
+
+// ListID splits the List-Id header of a mailing list message, see
+// https://tools.ietf.org/html/rfc2919, into the optional description and the identifier in angle
+// brackets, like "Go Nuts" and "golang-nuts.googlegroups.com". ok is false when the message has no
+// List-Id.
+func (m *Message) ListID() (description, id string, ok bool) {
+	value := strings.TrimSpace(m.DecodeHeader("List-Id"))
+	if value == "" {
+		return "", "", false
+	}
+	start := strings.LastIndex(value, "<")
+	end := strings.LastIndex(value, ">")
+	if start < 0 || end < start {
+		// no brackets, the odd list puts just the identifier there
+		return "", value, true
+	}
+	description = strings.Trim(strings.TrimSpace(value[:start]), `"`)
+	return description, strings.TrimSpace(value[start+1 : end]), true
+}
+
+// ListPost is the List-Post URLs, usually a mailto: for writing to the list. It is empty when the
+// message has no List-Post, or the list doesn't take posts ("List-Post: NO").
+func (m *Message) ListPost() []string {
+	return listURLs(m.Header.Get("List-Post"))
+}
+
+// ListArchive is the List-Archive URLs, where past messages of the list can be read
+func (m *Message) ListArchive() []string {
+	return listURLs(m.Header.Get("List-Archive"))
+}
+
+// ListHelp is the List-Help URLs, for instructions on using the list
+func (m *Message) ListHelp() []string {
+	return listURLs(m.Header.Get("List-Help"))
+}
+
+// listURLs picks the <url> tokens out of an RFC 2369 list header, dropping the comments between
+// them and any whitespace inside, which is only there from folding
+func listURLs(value string) []string {
+	var urls []string
+	for rest := value; ; {
+		start := strings.Index(rest, "<")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], ">")
+		if end < 0 {
+			break
+		}
+		if url := strings.Join(strings.Fields(rest[start+1:start+end]), ""); url != "" {
+			urls = append(urls, url)
+		}
+		rest = rest[start+end+1:]
+	}
+	return urls
+}
@@ -2,7 +2,11 @@ package smtpd
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,7 +16,11 @@ import (
 	"mime/quotedprintable"
 	"net/mail"
 	"net/textproto"
+	"regexp"
+	"sort"
 	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 // Message is a nicely packaged representation of the received message
@@ -25,20 +33,154 @@ type Message struct {
 	Subject string
 	RawBody []byte
 	Source  []byte
+	// RawHeaders is the header block exactly as received, folding, order and casing intact,
+	// up to and including the line ending of the last header but not the blank line after it.
+	// It shares memory with Source.
+	RawHeaders []byte
 
 	MessageID string
 	Rcpt      []*mail.Address
+	// BodyType is the BODY the client declared with MAIL FROM, see Conn.BodyType
+	BodyType string
+
+	// Truncated is set when the message went over MaxSize and was cut off, see Server.TruncateOnMaxSize
+	Truncated bool
+
+	// AcceptReply can be set by the handler to replace the text of the 250 reply accepting the
+	// message, like "2.0.0 Message accepted for delivery: <id>"
+	AcceptReply string
+
+	// PreserveHeaderOrder makes Headers list the headers in the order they are in the message,
+	// rather than sorted by name
+	PreserveHeaderOrder bool
+
+	// KeepRawParts keeps the content of each part as it was sent, before any base64 or
+	// quoted-printable decoding, in Part.RawBody. This holds every part body twice, so it is off
+	// by default.
+	KeepRawParts bool
+
+	// CharsetReader turns text in the named charset into UTF-8 for Plain, HTML and FindBody,
+	// like mime.WordDecoder's. Nil handles the charsets browsers know, see
+	// https://encoding.spec.whatwg.org/#names-and-labels.
+	CharsetReader func(charset string, input io.Reader) (io.Reader, error)
 
 	// meta info
 	Logger *log.Logger
+
+	// the Conn.AdditionalHeaders when the message was created, see Bytes
+	additionalHeaders string
+
+	// ctx is what Context returns while the Handler runs under Server.HandlerTimeout
+	ctx context.Context
+
+	// parsed part tree, cached for the RawBody it was parsed from
+	parts      []*Part
+	partsErr   error
+	partsOf    []byte
+	partsRaw   bool
+	partsValid bool
 }
 
 // Part represents a single part of the message
 type Part struct {
-	Header   textproto.MIMEHeader
-	part     *multipart.Part
-	Body     []byte
+	Header textproto.MIMEHeader
+	part   *multipart.Part
+	// Body is the content with the transfer encoding undone, but still in its own charset.
+	// DecodedBody is the way to read it, Body is kept for existing callers.
+	Body []byte
+	// RawBody is the content still transfer encoded, only set when Message.KeepRawParts is
+	RawBody  []byte
 	Children []*Part
+
+	// the message the part is from, for its CharsetReader
+	message *Message
+}
+
+// FileName is the filename from the Content-Disposition, or failing that the name from the
+// Content-Type, empty when the part has neither
+func (p *Part) FileName() string {
+	if _, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if _, params, err := mime.ParseMediaType(p.Header.Get("Content-Type")); err == nil {
+		return params["name"]
+	}
+	return ""
+}
+
+// IsAttachment reports whether the part is meant to be saved as a file, having an attachment
+// disposition or a filename
+func (p *Part) IsAttachment() bool {
+	if disposition, _, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition")); disposition == "attachment" {
+		return true
+	}
+	return p.FileName() != ""
+}
+
+// IsInline reports whether the part is meant to be shown in the message, having an inline
+// disposition or a Content-ID for the HTML to refer to with cid: URLs
+func (p *Part) IsInline() bool {
+	if disposition, _, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition")); disposition == "inline" {
+		return true
+	}
+	return p.Header.Get("Content-ID") != ""
+}
+
+// DecodedBody is the content of the part ready to use: the Content-Transfer-Encoding (base64 or
+// quoted-printable) undone and text in a charset other than UTF-8 transcoded, with the
+// Message's CharsetReader. It is the one way to read a part that doesn't depend on what Body
+// holds. A charset that can't be read gives a *CharsetError along with the content as it is.
+func (p *Part) DecodedBody() ([]byte, error) {
+	body := p.Body
+	if body == nil && p.RawBody != nil {
+		var err error
+		if body, err = decodeTransfer(p.Header.Get("Content-Transfer-Encoding"), p.RawBody); err != nil {
+			return nil, err
+		}
+	}
+
+	_, params, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+	charset := strings.ToLower(strings.TrimSpace(params["charset"]))
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii":
+		return body, nil
+	}
+
+	reader := defaultCharsetReader
+	if p.message != nil && p.message.CharsetReader != nil {
+		reader = p.message.CharsetReader
+	}
+	r, err := reader(charset, bytes.NewReader(body))
+	if err != nil {
+		return body, &CharsetError{charset, err}
+	}
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		return body, &CharsetError{charset, err}
+	}
+	return decoded, nil
+}
+
+// ContentType is the media type of the part without parameters, like "text/plain". Parts
+// without a usable Content-Type are "application/octet-stream".
+func (p *Part) ContentType() string {
+	mediaType, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+// Context is for the Handler to pass on to what it calls to deliver the message. It is
+// cancelled when the client goes away, or once Server.HandlerTimeout runs out.
+func (m *Message) Context() context.Context {
+	if m.ctx != nil {
+		return m.ctx
+	}
+	if m.Conn != nil {
+		return m.Conn.Context()
+	}
+	return context.Background()
 }
 
 // BCC returns a list of addresses this message should be
@@ -59,6 +201,298 @@ func (m *Message) BCC() []*mail.Address {
 	return bcc
 }
 
+// TopLevelType is the media type of the message without parameters, like "multipart/mixed".
+// Messages without a Content-Type are "text/plain" as RFC 2045 has it, ones with a
+// Content-Type that can't be parsed are "application/octet-stream".
+func (m *Message) TopLevelType() string {
+	value := m.Header.Get("Content-Type")
+	if strings.TrimSpace(value) == "" {
+		return "text/plain"
+	}
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+// IsMultipart reports whether the message is made of parts, like multipart/alternative
+func (m *Message) IsMultipart() bool {
+	return strings.HasPrefix(m.TopLevelType(), "multipart/")
+}
+
+// SubjectDecoded is the Subject with RFC 2047 encoded words, like "=?UTF-8?Q?Bees_=F0=9F=90=9D?=",
+// decoded. Subject itself stays as it was sent. Subjects that can't be decoded, like ones in a
+// charset Go doesn't know, come back raw.
+func (m *Message) SubjectDecoded() string {
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Subject)
+	if err != nil {
+		return m.Subject
+	}
+	return subject
+}
+
+// DecodeHeader is the first value of any header with RFC 2047 encoded words decoded, for showing
+// headers like Thread-Topic or X-Mailer. Like SubjectDecoded, values that can't be decoded come
+// back raw, and it is empty when the message doesn't have the header.
+func (m *Message) DecodeHeader(key string) string {
+	value := m.Header.Get(key)
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// Sender is the address in the Sender header, the agent that actually submitted the message
+// when that isn't who it's From (like a mailing list or a secretary). It is nil, without an
+// error, when the message has no Sender header.
+func (m *Message) Sender() (*mail.Address, error) {
+	if m.Header.Get("Sender") == "" {
+		return nil, nil
+	}
+	senders, err := m.Header.AddressList("Sender")
+	if err != nil {
+		return nil, err
+	}
+	return senders[0], nil
+}
+
+// Headers returns every header as a single "Name: value" line, with folded values already joined.
+// Headers are sorted by name, repeated headers keep the order they appeared in. With
+// PreserveHeaderOrder they come in the order of the message instead, top to bottom, as long as
+// the message has its Source or RawHeaders to take the order from.
+func (m *Message) Headers() []string {
+	if m.PreserveHeaderOrder {
+		if len(m.Source) >= len(m.RawBody) && bytes.HasSuffix(m.Source, m.RawBody) {
+			// Source has the headers added with AddHeader too, RawHeaders doesn't
+			return orderedHeaders(m.Source[:len(m.Source)-len(m.RawBody)])
+		}
+		if m.RawHeaders != nil {
+			return orderedHeaders(m.RawHeaders)
+		}
+	}
+
+	keys := make([]string, 0, len(m.Header))
+	for key := range m.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var headers []string
+	for _, key := range keys {
+		for _, value := range m.Header[key] {
+			headers = append(headers, key+": "+value)
+		}
+	}
+	return headers
+}
+
+// orderedHeaders unfolds a header block into "Name: value" lines, names canonicalized and values
+// trimmed the way they are in Header
+func orderedHeaders(block []byte) []string {
+	var headers []string
+	for _, line := range strings.Split(string(block), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// a continuation of the header before
+			if len(headers) > 0 {
+				last := &headers[len(headers)-1]
+				if strings.HasSuffix(*last, ": ") {
+					*last += strings.TrimSpace(line)
+				} else {
+					*last += " " + strings.TrimSpace(line)
+				}
+			}
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		key := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:colon]))
+		headers = append(headers, key+": "+strings.TrimSpace(line[colon+1:]))
+	}
+	return headers
+}
+
+// ContentHash is a hex SHA-256 of the message for spotting duplicates, the same for a message
+// however many hops it took or how its lines were wrapped. What is hashed is:
+//
+//   - every header in Header but Received and Return-Path, which each hop adds to, as
+//     "Name:value\r\n" lines with the canonical name (like Message-Id), sorted by name and
+//     repeated headers in the order they appeared, with runs of whitespace in the value turned
+//     into one space and the ends trimmed
+//   - an empty line, "\r\n"
+//   - RawBody with every line ending as "\r\n" and the empty lines at the end left out
+func (m *Message) ContentHash() string {
+	keys := make([]string, 0, len(m.Header))
+	for key := range m.Header {
+		if key != "Received" && key != "Return-Path" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, key := range keys {
+		for _, value := range m.Header[key] {
+			io.WriteString(h, key+":"+strings.Join(strings.Fields(value), " ")+"\r\n")
+		}
+	}
+	io.WriteString(h, "\r\n")
+
+	body := bytes.ReplaceAll(m.RawBody, []byte("\r\n"), []byte("\n"))
+	body = bytes.TrimRight(body, "\n")
+	if len(body) > 0 {
+		h.Write(bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n")))
+		io.WriteString(h, "\r\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Importance levels returned by Message.Importance
+const (
+	ImportanceHigh   = "high"
+	ImportanceNormal = "normal"
+	ImportanceLow    = "low"
+)
+
+// ContentLanguage returns the language tags listed in the Content-Language header, if any
+func (m *Message) ContentLanguage() []string {
+	var languages []string
+	for _, lang := range strings.Split(m.Header.Get("Content-Language"), ",") {
+		if lang = strings.TrimSpace(lang); lang != "" {
+			languages = append(languages, lang)
+		}
+	}
+	return languages
+}
+
+// Importance normalizes the Importance header, or failing that X-Priority (1-2 high, 3 normal,
+// 4-5 low), into ImportanceHigh, ImportanceNormal or ImportanceLow. Defaults to normal.
+func (m *Message) Importance() string {
+	switch strings.ToLower(strings.TrimSpace(m.Header.Get("Importance"))) {
+	case ImportanceHigh:
+		return ImportanceHigh
+	case ImportanceLow:
+		return ImportanceLow
+	case ImportanceNormal:
+		return ImportanceNormal
+	}
+
+	// X-Priority values often carry a label, like "1 (Highest)"
+	if priority := strings.TrimSpace(m.Header.Get("X-Priority")); priority != "" {
+		switch priority[0] {
+		case '1', '2':
+			return ImportanceHigh
+		case '4', '5':
+			return ImportanceLow
+		}
+	}
+	return ImportanceNormal
+}
+
+// AutoSubmitted returns the lower case Auto-Submitted keyword, like "auto-replied", without any
+// parameters. Messages without the header are "no", meaning they were sent by a person.
+func (m *Message) AutoSubmitted() string {
+	value := m.Header.Get("Auto-Submitted")
+	if i := strings.Index(value, ";"); i >= 0 {
+		value = value[:i]
+	}
+	if value = strings.ToLower(strings.TrimSpace(value)); value != "" {
+		return value
+	}
+	return "no"
+}
+
+// IsAutoSubmitted reports whether the message was sent by a machine rather than a person, going
+// by Auto-Submitted (anything but "no") and Precedence (bulk, junk or list). Autoresponders
+// should leave these alone to keep from looping with other automated senders.
+func (m *Message) IsAutoSubmitted() bool {
+	if m.AutoSubmitted() != "no" {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(m.Header.Get("Precedence"))) {
+	case "bulk", "junk", "list":
+		return true
+	}
+	return false
+}
+
+// DKIMDomains returns the d= signing domains of every DKIM-Signature header, without checking
+// the signatures. Each domain is listed once, in header order.
+func (m *Message) DKIMDomains() []string {
+	return signatureDomains(m.Header["Dkim-Signature"])
+}
+
+// ARCDomains is like DKIMDomains, for the ARC-Seal and ARC-Message-Signature headers
+func (m *Message) ARCDomains() []string {
+	return signatureDomains(m.Header["Arc-Seal"], m.Header["Arc-Message-Signature"])
+}
+
+// signatureDomains picks the d= tag out of DKIM style tag lists, see https://tools.ietf.org/html/rfc6376#section-3.2
+func signatureDomains(headers ...[]string) []string {
+	var domains []string
+	seen := make(map[string]bool)
+	for _, signatures := range headers {
+		for _, signature := range signatures {
+			for _, tag := range strings.Split(signature, ";") {
+				kv := strings.SplitN(tag, "=", 2)
+				if len(kv) != 2 || strings.TrimSpace(kv[0]) != "d" {
+					continue
+				}
+				domain := strings.ToLower(strings.Join(strings.Fields(kv[1]), ""))
+				if domain != "" && !seen[domain] {
+					seen[domain] = true
+					domains = append(domains, domain)
+				}
+			}
+		}
+	}
+	return domains
+}
+
+// Bytes returns the whole message, headers and body, as one slice. That is Source, which
+// includes the headers the server added (like X-Truncated), with the headers hooks left in
+// Conn.AdditionalHeaders put in front. Without those it shares memory with Source, so don't
+// modify it.
+func (m *Message) Bytes() []byte {
+	if m.additionalHeaders == "" {
+		return m.Source
+	}
+	headers := m.additionalHeaders
+	if bytes.Contains(m.Source, []byte("\r\n")) {
+		headers = strings.ReplaceAll(strings.ReplaceAll(headers, "\r\n", "\n"), "\n", "\r\n")
+	}
+	full := make([]byte, 0, len(headers)+len(m.Source))
+	full = append(full, headers...)
+	return append(full, m.Source...)
+}
+
+// AddHeader puts a header at the top of the message, in Header as well as Source, so it is
+// kept when the message is written out with WriteTo or Bytes
+func (m *Message) AddHeader(name, value string) {
+	lineEnding := "\n"
+	if bytes.Contains(m.Source, []byte("\r\n")) {
+		lineEnding = "\r\n"
+	}
+	key := textproto.CanonicalMIMEHeaderKey(name)
+	m.Header[key] = append([]string{value}, m.Header[key]...)
+	m.Source = append([]byte(name+": "+value+lineEnding), m.Source...)
+}
+
+// WriteTo writes the whole message as Bytes has it, the source as it was received (after
+// dot-stuffing was removed) with the headers the server and its hooks added. When writing to
+// another SMTP server, the DATA writer has to stuff leading dots again.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(m.Bytes())
+	return int64(n), err
+}
+
 // Plain returns the text/plain content of the message, if any
 func (m *Message) Plain() ([]byte, error) {
 	return m.FindBody("text/plain")
@@ -69,6 +503,16 @@ func (m *Message) HTML() ([]byte, error) {
 	return m.FindBody("text/html")
 }
 
+// PlainPart returns the text/plain part of the message, if any
+func (m *Message) PlainPart() (*Part, error) {
+	return m.FindPart("text/plain")
+}
+
+// HTMLPart returns the text/html part of the message, if any
+func (m *Message) HTMLPart() (*Part, error) {
+	return m.FindPart("text/html")
+}
+
 func findTypeInParts(contentType string, parts []*Part) *Part {
 	for _, p := range parts {
 		mediaType, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
@@ -79,16 +523,52 @@ func findTypeInParts(contentType string, parts []*Part) *Part {
 	return nil
 }
 
-// Attachments returns the list of attachments on this message
-// XXX: this assumes that the only mimetype supporting attachments is multipart/mixed
-// need to review https://en.wikipedia.org/wiki/MIME#Multipart_messages to ensure that is the case
-func (m *Message) Attachments() ([]*Part, error) {
+// content returns the media type and parts holding the displayable message. For multipart/signed
+// messages that is the signed first part, the signature itself is left out.
+func (m *Message) content() (string, []*Part, error) {
 	mediaType, _, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
 	parts, err := m.Parts()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if mediaType == "multipart/signed" && len(parts) > 0 {
+		signed := parts[0]
+		if mediaType, _, err = mime.ParseMediaType(signed.Header.Get("Content-Type")); err != nil {
+			return "", nil, err
+		}
+		if strings.HasPrefix(mediaType, "multipart/") {
+			parts = signed.Children
+		} else {
+			parts = parts[:1]
+		}
+	}
+	return mediaType, parts, nil
+}
+
+// Signature returns the signature part of a multipart/signed message, like an
+// application/pkcs7-signature for S/MIME
+func (m *Message) Signature() (*Part, bool) {
+	mediaType, _, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/signed" {
+		return nil, false
+	}
+	parts, err := m.Parts()
+	if err != nil || len(parts) < 2 {
+		return nil, false
+	}
+	return parts[1], true
+}
+
+// Attachments returns the list of attachments on this message
+// XXX: this assumes that the only mimetype supporting attachments is multipart/mixed
+// need to review https://en.wikipedia.org/wiki/MIME#Multipart_messages to ensure that is the case
+func (m *Message) Attachments() ([]*Part, error) {
+	mediaType, parts, err := m.content()
 	if err != nil {
 		return nil, err
 	}
@@ -110,15 +590,83 @@ func (m *Message) Attachments() ([]*Part, error) {
 	return attachments, nil
 }
 
-// FindBody finds the first part of the message with the specified Content-Type
+// HasAttachments reports whether the message carries any attachments, by the same rule as
+// Attachments: signed messages are looked into, nested multiparts aren't. The parts are parsed
+// once and cached, so asking before calling Attachments costs nothing extra.
+func (m *Message) HasAttachments() (bool, error) {
+	attachments, err := m.Attachments()
+	return len(attachments) > 0, err
+}
+
+// Flatten walks every part of the message and collects the decoded bodies by media type, like
+// "text/plain". Types that occur more than once list their bodies in message order. Multipart
+// containers are walked into rather than listed.
+func (m *Message) Flatten() (map[string][][]byte, error) {
+	parts, err := m.Parts()
+	if err != nil {
+		return nil, err
+	}
+
+	flat := make(map[string][][]byte)
+	var walk func(parts []*Part)
+	walk = func(parts []*Part) {
+		for _, part := range parts {
+			mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if err != nil {
+				mediaType = "application/octet-stream"
+			}
+			if strings.HasPrefix(mediaType, "multipart/") {
+				walk(part.Children)
+				continue
+			}
+			flat[mediaType] = append(flat[mediaType], part.Body)
+		}
+	}
+	walk(parts)
+
+	return flat, nil
+}
+
+// FindBody finds the first part of the message with the specified Content-Type, transcoded to
+// UTF-8 from the charset it declares. When that charset is unknown the body comes back as it was
+// sent, along with a *CharsetError.
 func (m *Message) FindBody(contentType string) ([]byte, error) {
+	part, err := m.FindPart(contentType)
+	if err != nil {
+		return nil, err
+	}
+	return part.DecodedBody()
+}
 
-	mediaType, _, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+// CharsetError is the warning that a body is in a charset that couldn't be turned into UTF-8,
+// and was left as it was
+type CharsetError struct {
+	Charset string
+	Err     error
+}
+
+func (e *CharsetError) Error() string {
+	return fmt.Sprintf("cannot decode charset %q: %v", e.Charset, e.Err)
+}
+
+// isCharsetError tells a body that is there, just not in UTF-8, apart from one that is missing
+func isCharsetError(err error) bool {
+	var charsetErr *CharsetError
+	return errors.As(err, &charsetErr)
+}
+
+func defaultCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	encoding, err := htmlindex.Get(charset)
 	if err != nil {
 		return nil, err
 	}
+	return encoding.NewDecoder().Reader(input), nil
+}
 
-	parts, err := m.Parts()
+// FindPart is like FindBody, but returns the whole part so its headers, like the charset, can be read
+func (m *Message) FindPart(contentType string) (*Part, error) {
+
+	mediaType, parts, err := m.content()
 	if err != nil {
 		return nil, err
 	}
@@ -127,7 +675,7 @@ func (m *Message) FindBody(contentType string) ([]byte, error) {
 	switch mediaType {
 	case contentType:
 		if len(parts) > 0 {
-			return parts[0].Body, nil
+			return parts[0], nil
 		}
 		return nil, fmt.Errorf("%v found, but no data in body", contentType)
 	case "multipart/alternative":
@@ -147,37 +695,78 @@ func (m *Message) FindBody(contentType string) ([]byte, error) {
 		return nil, fmt.Errorf("No %v content found in multipart/alternative section", contentType)
 	}
 
-	return part.Body, nil
+	return part, nil
 }
 
-func readToPart(header textproto.MIMEHeader, content io.Reader) (*Part, error) {
-	cte := strings.ToLower(header.Get("Content-Transfer-Encoding"))
+// qpSoftBreakCR matches a quoted-printable soft line break ending in bare or doubled up carriage
+// returns. quotedprintable only understands LF and CRLF line endings, so these are made CRLF
+// before decoding.
+var qpSoftBreakCR = regexp.MustCompile("(=[ \t]*)\r+\n?")
 
-	if cte == "quoted-printable" {
-		content = quotedprintable.NewReader(content)
+func readToPart(header textproto.MIMEHeader, content io.Reader, keepRaw bool) (*Part, error) {
+	raw, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, err
 	}
+	return decodePart(header, raw, keepRaw)
+}
 
-	slurp, err := ioutil.ReadAll(content)
+// decodePart makes a part of its raw content, undoing the transfer encoding. Without one the
+// Body is raw itself rather than a copy.
+func decodePart(header textproto.MIMEHeader, raw []byte, keepRaw bool) (*Part, error) {
+	slurp, err := decodeTransfer(header.Get("Content-Transfer-Encoding"), raw)
 	if err != nil {
 		return nil, err
 	}
 
-	if cte == "base64" {
-		dst := make([]byte, base64.StdEncoding.DecodedLen(len(slurp)))
-		decodedLen, err := base64.StdEncoding.Decode(dst, slurp)
+	part := &Part{
+		Header: header,
+		Body:   slurp,
+	}
+	if keepRaw {
+		part.RawBody = raw
+	}
+	return part, nil
+}
+
+// decodeTransfer undoes a Content-Transfer-Encoding. 7bit, 8bit, binary and unknown encodings
+// leave raw as it is.
+func decodeTransfer(cte string, raw []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "quoted-printable":
+		encoded := raw
+		if qpSoftBreakCR.Match(encoded) {
+			encoded = qpSoftBreakCR.ReplaceAll(encoded, []byte("$1\r\n"))
+		}
+		// decoding only ever shrinks the content, so one buffer of its size will do
+		decoded := bytes.NewBuffer(make([]byte, 0, len(encoded)+bytes.MinRead))
+		if _, err := decoded.ReadFrom(quotedprintable.NewReader(bytes.NewReader(encoded))); err != nil {
+			return nil, err
+		}
+		return decoded.Bytes(), nil
+	case "base64":
+		dst := make([]byte, base64.StdEncoding.DecodedLen(len(raw)))
+		decodedLen, err := base64.StdEncoding.Decode(dst, raw)
 		if err != nil {
 			return nil, err
 		}
+		return dst[:decodedLen], nil
+	}
+	return raw, nil
+}
 
-		slurp = dst[:decodedLen]
+// transferReader is decodeTransfer for content read as a stream
+func transferReader(cte string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
 	}
-	return &Part{
-		Header: header,
-		Body:   slurp,
-	}, nil
+	return r
 }
 
-func parseContent(header textproto.MIMEHeader, content io.Reader) ([]*Part, error) {
+func parseContent(header textproto.MIMEHeader, content io.Reader, keepRaw bool) ([]*Part, error) {
 
 	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
 	if err != nil && err.Error() == "mime: no media type" {
@@ -192,14 +781,15 @@ func parseContent(header textproto.MIMEHeader, content io.Reader) ([]*Part, erro
 
 		mr := multipart.NewReader(content, params["boundary"])
 		for {
-			p, err := mr.NextPart()
+			// raw parts, so the transfer encoding is left to readToPart
+			p, err := mr.NextRawPart()
 			if err == io.EOF {
 				break
 			} else if err != nil {
 				return nil, fmt.Errorf("MIME error: %v", err)
 			}
 
-			part, err := readToPart(p.Header, p)
+			part, err := readToPart(p.Header, p, keepRaw)
 
 			// XXX: maybe want to implement a less strict mode that gets what it can out of the message
 			// instead of erroring out on individual sections?
@@ -207,8 +797,8 @@ func parseContent(header textproto.MIMEHeader, content io.Reader) ([]*Part, erro
 			if err != nil {
 				return nil, err
 			}
-			if strings.HasPrefix(partType, "multipart/") {
-				subParts, err := parseContent(p.Header, bytes.NewBuffer(part.Body))
+			if strings.HasPrefix(partType, "multipart/") && len(bytes.TrimSpace(part.Body)) > 0 {
+				subParts, err := parseContent(p.Header, bytes.NewBuffer(part.Body), keepRaw)
 				if err != nil {
 					return nil, err
 				}
@@ -217,7 +807,7 @@ func parseContent(header textproto.MIMEHeader, content io.Reader) ([]*Part, erro
 			parts = append(parts, part)
 		}
 	} else {
-		part, err := readToPart(header, content)
+		part, err := readToPart(header, content, keepRaw)
 		if err != nil {
 			return nil, err
 		}
@@ -227,14 +817,70 @@ func parseContent(header textproto.MIMEHeader, content io.Reader) ([]*Part, erro
 	return parts, nil
 }
 
-// Parts breaks a message body into its mime parts
+// Parts breaks a message body into its mime parts. The parsed parts are cached and shared between
+// calls, they are only parsed again when RawBody is replaced or KeepRawParts is changed.
 func (m *Message) Parts() ([]*Part, error) {
-	parts, err := parseContent(textproto.MIMEHeader(m.Header), bytes.NewBuffer(m.RawBody))
+	if m.partsValid && sameSlice(m.partsOf, m.RawBody) && m.partsRaw == m.KeepRawParts {
+		return m.parts, m.partsErr
+	}
+
+	var parts []*Part
+	var err error
+	header := textproto.MIMEHeader(m.Header)
+	mediaType, _, typeErr := mime.ParseMediaType(header.Get("Content-Type"))
+	isMultipart := typeErr == nil && strings.HasPrefix(mediaType, "multipart/")
+	if typeErr == nil && !isMultipart {
+		// most messages are a single text or HTML part, which is decoded straight from RawBody
+		var part *Part
+		if part, err = decodePart(header, m.RawBody, m.KeepRawParts); err == nil {
+			parts = []*Part{part}
+		}
+	} else if isMultipart && len(bytes.TrimSpace(m.RawBody)) == 0 {
+		// a multipart type declared for an empty body, there just aren't any parts
+		parts = []*Part{}
+	} else {
+		parts, err = parseContent(header, bytes.NewBuffer(m.RawBody), m.KeepRawParts)
+	}
+	if err != nil {
+		parts = nil
+	}
+	m.adoptParts(parts)
+	m.parts, m.partsErr, m.partsOf, m.partsValid = parts, err, m.RawBody, true
+	m.partsRaw = m.KeepRawParts
+
+	return parts, err
+}
+
+// adoptParts points the parts, and all the parts in them, back at the message
+func (m *Message) adoptParts(parts []*Part) {
+	for _, part := range parts {
+		part.message = m
+		m.adoptParts(part.Children)
+	}
+}
+
+// MultipartReader returns a multipart.Reader over the top level parts of a multipart message,
+// for callers who'd rather walk the parts themselves than use Parts
+func (m *Message) MultipartReader() (*multipart.Reader, error) {
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
 	if err != nil {
 		return nil, err
 	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("%v is not a multipart type", mediaType)
+	}
+	if params["boundary"] == "" {
+		return nil, errors.New("multipart message has no boundary")
+	}
+	return multipart.NewReader(bytes.NewReader(m.RawBody), params["boundary"]), nil
+}
 
-	return parts, nil
+// sameSlice reports whether a and b are the same slice of the same backing array
+func sameSlice(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	return len(a) == 0 || &a[0] == &b[0]
 }
 
 // NewMessage creates a Message from a data blob and a recipients list
@@ -269,16 +915,34 @@ func NewMessage(conn *Conn, data []byte, rcpt []*mail.Address, logger *log.Logge
 		return nil, err
 	}
 
+	// the body is what's left after the header block and the blank line ending it
+	headers := data[:len(data)-len(raw)]
+	if bytes.HasSuffix(headers, []byte("\r\n")) {
+		headers = headers[:len(headers)-2]
+	} else if bytes.HasSuffix(headers, []byte("\n")) {
+		headers = headers[:len(headers)-1]
+	}
+
+	var additionalHeaders, bodyType string
+	if conn != nil {
+		additionalHeaders, bodyType = conn.AdditionalHeaders, conn.BodyType
+	}
+
 	return &Message{
-		Conn:    conn,
-		Rcpt:    rcpt,
-		To:      to,
-		From:    from[0],
-		Header:  m.Header,
-		Subject: m.Header.Get("subject"),
-		RawBody: raw,
-		Source:  data,
-		Logger:  logger,
+		Conn:     conn,
+		Rcpt:     rcpt,
+		To:       to,
+		From:     from[0],
+		Header:   m.Header,
+		Subject:  m.Header.Get("subject"),
+		RawBody:  raw,
+		Source:   data,
+		Logger:   logger,
+		BodyType: bodyType,
+
+		RawHeaders: headers,
+
+		additionalHeaders: additionalHeaders,
 	}, nil
 
 }
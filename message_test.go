@@ -1,9 +1,16 @@
 package smtpd_test
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
 	"mime"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"net/mail"
 
@@ -220,6 +227,37 @@ X-MS-Exchange-CrossTenant-userprincipalname: JrcEfSyScdnPlLJ9yltMMOOKid5fu4LRIY9
 X-MS-Exchange-Transport-CrossTenantHeadersStamped: MN2PR18MB3421
 
 `
+
+	signedEmail = `From: Sender <sender@example.com>
+Date: Mon, 16 Jan 2017 16:59:33 -0500
+Subject: Signed Message
+MIME-Version: 1.0
+Content-Type: multipart/signed; protocol="application/pkcs7-signature"; micalg=sha-256;
+ 	 boundary="_=signed=_bbd1e98aa6c34ef59d8d102a0e795027"
+To: recipient1@example.com
+Message-ID: <examplemessage@example.com>
+
+--_=signed=_bbd1e98aa6c34ef59d8d102a0e795027
+Content-Type: multipart/alternative; boundary="_=ALT_=signed=_bbd1e98aa6c34ef59d8d102a0e795027"
+
+--_=ALT_=signed=_bbd1e98aa6c34ef59d8d102a0e795027
+Content-Type: text/plain; charset="UTF-8"
+
+Signed bees
+
+--_=ALT_=signed=_bbd1e98aa6c34ef59d8d102a0e795027
+Content-Type: text/html; charset="UTF-8"
+
+<p>Signed bees</p>
+
+--_=ALT_=signed=_bbd1e98aa6c34ef59d8d102a0e795027--
+--_=signed=_bbd1e98aa6c34ef59d8d102a0e795027
+Content-Type: application/pkcs7-signature; name="smime.p7s"
+Content-Transfer-Encoding: base64
+Content-Disposition: attachment; filename="smime.p7s"
+
+c2lnbmF0dXJl
+--_=signed=_bbd1e98aa6c34ef59d8d102a0e795027--`
 )
 
 func TestPlainHTMLParsing(t *testing.T) {
@@ -345,6 +383,35 @@ func TestEmptyBodyMessageParsingDoesNotCrash(t *testing.T) {
 	}
 }
 
+func TestEmptyBodyWithContentType(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte("From: sender@example.com\r\nContent-Type: text/plain\r\n\r\n"), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+	parts, err := msg.Parts()
+	if err != nil {
+		t.Fatalf("Expected an empty body to parse, got: %v", err)
+	}
+	if len(parts) != 1 || len(parts[0].Body) != 0 {
+		t.Errorf("Expected a single empty part, got: %v parts", len(parts))
+	}
+	if plain, err := msg.Plain(); err != nil || len(plain) != 0 {
+		t.Errorf("Expected an empty text body, got: %q, %v", plain, err)
+	}
+
+	msg, err = smtpd.NewMessage(nil, []byte("From: sender@example.com\r\nContent-Type: multipart/mixed; boundary=\"b\"\r\n\r\n"), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+	parts, err = msg.Parts()
+	if err != nil || parts == nil || len(parts) != 0 {
+		t.Errorf("Expected no parts and no error for an empty multipart body, got: %v, %v", parts, err)
+	}
+	if attachments, err := msg.Attachments(); err != nil || len(attachments) != 0 {
+		t.Errorf("Expected no attachments, got: %v, %v", attachments, err)
+	}
+}
+
 func TestMixedMessageParsing(t *testing.T) {
 
 	msg, err := smtpd.NewMessage(nil, []byte(emailWithAttachment), nil, nil)
@@ -501,3 +568,1195 @@ func TestUTFEncodingInFromName(t *testing.T) {
 		t.Errorf("Wrong from name want: %v, got %v", expectFrom[0].Name, msg.From.Name)
 	}
 }
+
+func TestMessageHeaders(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte(emailWithAttachment), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	headers := msg.Headers()
+	expect := []string{
+		`Content-Type: multipart/mixed; boundary="_=test=_bbd1e98aa6c34ef59d8d102a0e795027"`,
+		"Date: Mon, 16 Jan 2017 16:59:33 -0500",
+		"From: Sender <sender@example.com>",
+		"Message-Id: <examplemessage@example.com>",
+		"Mime-Version: 1.0",
+		"Subject: Multipart Message",
+		`To: recipient1@example.com, "Recipient 2" <recipient2@example.com>`,
+	}
+
+	if len(headers) != len(expect) {
+		t.Fatalf("Wrong number of headers, want: %v, got: %v (%v)", len(expect), len(headers), headers)
+	}
+	for i := range expect {
+		if headers[i] != expect[i] {
+			t.Errorf("Wrong header %v, want: %v, got: %v", i, expect[i], headers[i])
+		}
+	}
+
+	// in the order of the message, headers added since included
+	msg.PreserveHeaderOrder = true
+	msg.AddHeader("X-Spam-Score", "0.1")
+	ordered := []string{
+		"X-Spam-Score: 0.1",
+		"From: Sender <sender@example.com>",
+		"Date: Mon, 16 Jan 2017 16:59:33 -0500",
+		"Subject: Multipart Message",
+		"Mime-Version: 1.0",
+		`Content-Type: multipart/mixed; boundary="_=test=_bbd1e98aa6c34ef59d8d102a0e795027"`,
+		`To: recipient1@example.com, "Recipient 2" <recipient2@example.com>`,
+		"Message-Id: <examplemessage@example.com>",
+	}
+	if headers := msg.Headers(); !reflect.DeepEqual(headers, ordered) {
+		t.Errorf("Wrong headers in message order, want: %q, got: %q", ordered, headers)
+	}
+
+	// a message built without Source takes the order from RawHeaders, or falls back to sorted
+	built := &smtpd.Message{
+		Header:              mail.Header{"Subject": {"Hi"}, "From": {"sender@example.com"}},
+		RawBody:             []byte("a body longer than the missing source"),
+		PreserveHeaderOrder: true,
+	}
+	if headers := built.Headers(); !reflect.DeepEqual(headers, []string{"From: sender@example.com", "Subject: Hi"}) {
+		t.Errorf("Expected the sorted headers without a Source, got: %q", headers)
+	}
+	built.RawHeaders = []byte("Subject: Hi\r\nFrom: sender@example.com")
+	if headers := built.Headers(); !reflect.DeepEqual(headers, []string{"Subject: Hi", "From: sender@example.com"}) {
+		t.Errorf("Expected the headers in RawHeaders order, got: %q", headers)
+	}
+}
+
+func TestPartIsAttachmentIsInline(t *testing.T) {
+	related := `From: Sender <sender@example.com>
+Subject: Logo
+MIME-Version: 1.0
+Content-Type: multipart/related; boundary="rel"
+
+--rel
+Content-Type: text/html; charset="UTF-8"
+
+<img src="cid:logo@example.com">
+--rel
+Content-Type: image/png
+Content-ID: <logo@example.com>
+Content-Transfer-Encoding: base64
+
+iVBORw0KGgo=
+--rel
+Content-Type: image/gif
+Content-Disposition: inline
+
+R0lGODlh
+--rel--
+`
+
+	tests := []struct {
+		email      string
+		index      int
+		attachment bool
+		inline     bool
+	}{
+		{emailWithAttachment, 0, false, false}, // the multipart/alternative text
+		{emailWithAttachment, 1, true, false},  // invite.ics
+		{related, 0, false, false},
+		{related, 1, false, true},
+		{related, 2, false, true},
+	}
+	for _, tt := range tests {
+		msg, err := smtpd.NewMessage(nil, []byte(tt.email), nil, nil)
+		if err != nil {
+			t.Fatal("error creating message", err)
+		}
+		parts, err := msg.Parts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		part := parts[tt.index]
+		if got := part.IsAttachment(); got != tt.attachment {
+			t.Errorf("%v part %v: expected IsAttachment %v, got %v", part.ContentType(), tt.index, tt.attachment, got)
+		}
+		if got := part.IsInline(); got != tt.inline {
+			t.Errorf("%v part %v: expected IsInline %v, got %v", part.ContentType(), tt.index, tt.inline, got)
+		}
+	}
+}
+
+func TestMessageContentHash(t *testing.T) {
+	hash := func(source string) string {
+		msg, err := smtpd.NewMessage(nil, []byte(source), nil, nil)
+		if err != nil {
+			t.Fatal("error creating message", err)
+		}
+		return msg.ContentHash()
+	}
+
+	original := hash(emailWithAttachment)
+	if len(original) != 64 {
+		t.Fatalf("Expected a hex SHA-256, got: %v", original)
+	}
+	if again := hash(emailWithAttachment); again != original {
+		t.Errorf("Expected the same message to hash the same, got: %v and %v", original, again)
+	}
+
+	same := map[string]string{
+		"CRLF line endings": strings.ReplaceAll(emailWithAttachment, "\n", "\r\n"),
+		"another hop":       "Received: from mx.example.net by mx.example.org\n" + emailWithAttachment,
+		"trailing newlines": emailWithAttachment + "\n\n",
+		"refolded header":   strings.Replace(emailWithAttachment, "Content-Type: multipart/mixed;\n \t boundary=", "Content-Type: multipart/mixed; boundary=", 1),
+	}
+	for name, source := range same {
+		if got := hash(source); got != original {
+			t.Errorf("%v: expected %v, got: %v", name, original, got)
+		}
+	}
+
+	different := map[string]string{
+		"body":    strings.Replace(emailWithAttachment, "Sending bees", "Sending wasps", 1),
+		"subject": strings.Replace(emailWithAttachment, "Subject: Multipart Message", "Subject: Multipart", 1),
+	}
+	for name, source := range different {
+		if got := hash(source); got == original {
+			t.Errorf("Expected a different %v to change the hash", name)
+		}
+	}
+}
+
+func TestMessageSnippet(t *testing.T) {
+	reply := `From: Sender <sender@example.com>
+Subject: Re: Bees
+Content-Type: text/plain; charset="UTF-8"
+
+Sounds good,   see you then.
+
+On Mon, 16 Jan 2017 Sender wrote:
+> Sending bees
+> =F0=9F=90=9D
+`
+	htmlReply := `From: Sender <sender@example.com>
+Subject: Re: Bees
+Content-Type: text/html; charset="UTF-8"
+
+<html><head><style>p { color: red }</style></head>
+<body><p>Sounds&nbsp;good</p><blockquote>Sending bees</blockquote></body></html>`
+
+	tests := []struct {
+		email string
+		n     int
+		want  string
+	}{
+		{plainHTMLEmail, 100, "Sending bees 🐝"},
+		{alternativeEmail, 100, "Sending bees 🐝"},
+		{alternativeEmail, 14, "Sending bees 🐝"},
+		{alternativeEmail, 13, "Sending bees"},
+		{alternativeEmail, 7, "Sending"},
+		{reply, 100, "Sounds good, see you then. On Mon, 16 Jan 2017 Sender wrote:"},
+		{htmlReply, 100, "Sounds good"},
+		{emailWithNoBody, 100, ""},
+	}
+	for _, tt := range tests {
+		msg, err := smtpd.NewMessage(nil, []byte(tt.email), nil, nil)
+		if err != nil {
+			t.Fatal("error creating message", err)
+		}
+		if got := msg.Snippet(tt.n); got != tt.want {
+			t.Errorf("Expected snippet %q, got %q", tt.want, got)
+		}
+	}
+}
+
+func TestMessageRawHeaders(t *testing.T) {
+	for _, fixture := range []string{emailWithAttachment, emailWithNoBody, strings.ReplaceAll(alternativeEmail, "\n", "\r\n")} {
+		msg, err := smtpd.NewMessage(nil, []byte(fixture), nil, nil)
+		if err != nil {
+			t.Fatal("error creating message", err)
+		}
+		end := strings.Index(fixture, "\n\n") + 1
+		if crlf := strings.Index(fixture, "\r\n\r\n"); crlf >= 0 {
+			end = crlf + 2
+		}
+		if want := fixture[:end]; string(msg.RawHeaders) != want {
+			t.Errorf("Expected the header block as sent:\n%q\ngot:\n%q", want, msg.RawHeaders)
+		}
+	}
+}
+
+func TestGenerateDSN(t *testing.T) {
+	original, err := smtpd.NewMessage(nil, []byte(emailWithAttachment), []*mail.Address{{Address: "recipient1@example.com"}}, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	dsn, err := smtpd.GenerateDSN(original, "5.1.1", "550 5.1.1 no such user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn.From.Name != "Mail Delivery System" || !strings.HasPrefix(dsn.From.Address, "MAILER-DAEMON@") {
+		t.Errorf("Wrong DSN sender: %v", dsn.From)
+	}
+	if len(dsn.To) != 1 || dsn.To[0].Address != "sender@example.com" {
+		t.Errorf("Expected the DSN to go to the original sender, got: %v", dsn.To)
+	}
+	if got := dsn.Header.Get("In-Reply-To"); got != "<examplemessage@example.com>" {
+		t.Errorf("Expected the DSN to refer to the original, got: %v", got)
+	}
+	if got := dsn.TopLevelType(); got != "multipart/report" {
+		t.Errorf("Expected a multipart/report, got: %v", got)
+	}
+
+	parts, err := dsn.Parts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, part := range parts {
+		types = append(types, part.ContentType())
+	}
+	if want := []string{"text/plain", "message/delivery-status", "text/rfc822-headers"}; !reflect.DeepEqual(types, want) {
+		t.Fatalf("Expected the parts %v, got: %v", want, types)
+	}
+	status := string(parts[1].Body)
+	for _, field := range []string{"Final-Recipient: rfc822; recipient1@example.com", "Action: failed", "Status: 5.1.1", "Diagnostic-Code: smtp; 550 5.1.1 no such user"} {
+		if !strings.Contains(status, field) {
+			t.Errorf("Expected %q in the delivery status, got: %v", field, status)
+		}
+	}
+	if !strings.Contains(string(parts[2].Body), "Message-ID: <examplemessage@example.com>\r\n") {
+		t.Errorf("Expected the original headers, got: %v", string(parts[2].Body))
+	}
+
+	if delay, err := smtpd.GenerateDSN(original, "4.4.7", "timed out"); err != nil {
+		t.Fatal(err)
+	} else if parts, _ := delay.Parts(); !strings.Contains(string(parts[1].Body), "Action: delayed") {
+		t.Errorf("Expected a 4.x.x status to report a delay, got: %v", string(parts[1].Body))
+	}
+	if _, err := smtpd.GenerateDSN(original, "550", "nope"); err == nil {
+		t.Error("Expected a status that isn't an enhanced status code to be refused")
+	}
+}
+
+func TestMessageBodyCharset(t *testing.T) {
+	latin1 := "From: sender@example.com\nContent-Type: text/plain; charset=\"ISO-8859-1\"\n\nCaf\xe9 cr\xe8me\n"
+	msg, err := smtpd.NewMessage(nil, []byte(latin1), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+	if plain, err := msg.Plain(); err != nil || string(plain) != "Café crème\n" {
+		t.Errorf("Expected the body in UTF-8, got: %q, %v", plain, err)
+	}
+
+	unknown := "From: sender@example.com\nContent-Type: text/plain; charset=x-klingon\n\nQapla\xff\n"
+	msg, err = smtpd.NewMessage(nil, []byte(unknown), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+	plain, err := msg.Plain()
+	var charsetErr *smtpd.CharsetError
+	if !errors.As(err, &charsetErr) || charsetErr.Charset != "x-klingon" {
+		t.Errorf("Expected a CharsetError warning, got: %v", err)
+	}
+	if string(plain) != "Qapla\xff\n" {
+		t.Errorf("Expected the body as sent, got: %q", plain)
+	}
+
+	// a CharsetReader of its own can handle it
+	msg.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return strings.NewReader("Qapla'\n"), nil
+	}
+	if plain, err := msg.Plain(); err != nil || string(plain) != "Qapla'\n" {
+		t.Errorf("Expected the CharsetReader to be used, got: %q, %v", plain, err)
+	}
+}
+
+func TestMessagePartsCached(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte(emailWithAttachment), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	first, err := msg.Parts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := msg.Parts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) == 0 || first[0] != second[0] {
+		t.Error("Expected repeated Parts calls to reuse the parsed parts")
+	}
+
+	msg.RawBody = []byte(strings.Replace(string(msg.RawBody), "Sending bees", "Sending wasps", -1))
+	third, err := msg.Parts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third[0] == first[0] {
+		t.Error("Expected replacing RawBody to parse the parts again")
+	}
+	if plain, _ := msg.Plain(); !strings.Contains(string(plain), "Sending wasps") {
+		t.Errorf("Expected the new body to be parsed, got: %v", string(plain))
+	}
+}
+
+func BenchmarkMessageViews(b *testing.B) {
+	msg, err := smtpd.NewMessage(nil, []byte(emailWithAttachment), nil, nil)
+	if err != nil {
+		b.Fatal("error creating message", err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg.Plain()
+		msg.HTML()
+		msg.Attachments()
+	}
+}
+
+func BenchmarkMessageSinglePart(b *testing.B) {
+	msg, err := smtpd.NewMessage(nil, []byte(plainHTMLEmail), nil, nil)
+	if err != nil {
+		b.Fatal("error creating message", err)
+	}
+	// switching between two copies of the body keeps the parts from being cached
+	bodies := [][]byte{msg.RawBody, append([]byte(nil), msg.RawBody...)}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg.RawBody = bodies[i%2]
+		if _, err := msg.HTML(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// withHeaders prepends extra header lines to a fixture
+func withHeaders(fixture string, headers ...string) []byte {
+	return []byte(strings.Join(headers, "\n") + "\n" + fixture)
+}
+
+func TestMessageImportance(t *testing.T) {
+	cases := map[string]string{
+		"":                          smtpd.ImportanceNormal,
+		"Importance: High":          smtpd.ImportanceHigh,
+		"Importance: low":           smtpd.ImportanceLow,
+		"X-Priority: 1":             smtpd.ImportanceHigh,
+		"X-Priority: 2 (High)":      smtpd.ImportanceHigh,
+		"X-Priority: 3 (Normal)":    smtpd.ImportanceNormal,
+		"X-Priority: 5 (Lowest)":    smtpd.ImportanceLow,
+		"X-Priority: something odd": smtpd.ImportanceNormal,
+	}
+
+	for header, want := range cases {
+		data := []byte(plainHTMLEmail)
+		if header != "" {
+			data = withHeaders(plainHTMLEmail, header)
+		}
+		msg, err := smtpd.NewMessage(nil, data, nil, nil)
+		if err != nil {
+			t.Fatal("error creating message", err)
+		}
+		if got := msg.Importance(); got != want {
+			t.Errorf("Wrong importance for %q, want: %v, got: %v", header, want, got)
+		}
+	}
+}
+
+func TestMessageTopLevelType(t *testing.T) {
+	cases := []struct {
+		data      []byte
+		mediaType string
+		multipart bool
+	}{
+		{[]byte(plainHTMLEmail), "text/html", false},
+		{[]byte(alternativeEmail), "multipart/alternative", true},
+		{[]byte(emailWithAttachment), "multipart/mixed", true},
+		{[]byte(strings.Replace(plainHTMLEmail, "Content-Type: text/html\n", "", 1)), "text/plain", false},
+		{[]byte(strings.Replace(plainHTMLEmail, "Content-Type: text/html", "Content-Type: /;;", 1)), "application/octet-stream", false},
+	}
+	for _, c := range cases {
+		msg, err := smtpd.NewMessage(nil, c.data, nil, nil)
+		if err != nil {
+			t.Fatal("error creating message", err)
+		}
+		if got := msg.TopLevelType(); got != c.mediaType {
+			t.Errorf("Wrong type for %q, want: %v, got: %v", msg.Header.Get("Content-Type"), c.mediaType, got)
+		}
+		if got := msg.IsMultipart(); got != c.multipart {
+			t.Errorf("Wrong IsMultipart for %q, want: %v, got: %v", msg.Header.Get("Content-Type"), c.multipart, got)
+		}
+	}
+}
+
+func TestMessageSubjectDecoded(t *testing.T) {
+	raw := "=?UTF-8?Q?Sending_bees_=F0=9F=90=9D?= =?ISO-8859-1?Q?caf=E9?="
+	msg, err := smtpd.NewMessage(nil, []byte(strings.Replace(plainHTMLEmail, "Subject: Multipart Message", "Subject: "+raw, 1)), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+	if msg.Subject != raw {
+		t.Errorf("Expected Subject left as sent, got: %q", msg.Subject)
+	}
+	if got := msg.SubjectDecoded(); got != "Sending bees 🐝café" {
+		t.Errorf("Wrong decoded subject: %q", got)
+	}
+
+	// plain subjects and ones that can't be decoded come back as they are
+	msg.Subject = "=?x-unknown?Q?odd?= subject"
+	if got := msg.SubjectDecoded(); got != msg.Subject {
+		t.Errorf("Expected the raw subject back, got: %q", got)
+	}
+}
+
+func TestMessageDecodeHeader(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, withHeaders(plainHTMLEmail,
+		"X-Mailer: =?UTF-8?B?QmVlTWFpbCDwn5Cd?=",
+		"X-Campaign: =?ISO-8859-1?Q?caf=E9?= launch",
+		"X-Odd: =?x-unknown?Q?odd?="), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	tests := map[string]string{
+		"X-Mailer":   "BeeMail 🐝",
+		"X-Campaign": "café launch",
+		"X-Odd":      "=?x-unknown?Q?odd?=",
+		"Subject":    "Multipart Message",
+		"X-Missing":  "",
+	}
+	for key, want := range tests {
+		if got := msg.DecodeHeader(key); got != want {
+			t.Errorf("Wrong decoded %v, want: %q, got: %q", key, want, got)
+		}
+	}
+}
+
+func TestMessageSender(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, withHeaders(plainHTMLEmail, "Sender: List Bot <bounces@lists.example.com>"), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+	sender, err := msg.Sender()
+	if err != nil {
+		t.Fatalf("Expected the Sender to parse, got: %v", err)
+	}
+	if sender == nil || sender.Address != "bounces@lists.example.com" || sender.Name != "List Bot" {
+		t.Errorf("Wrong sender: %v", sender)
+	}
+	if sender.Address == msg.From.Address {
+		t.Errorf("Expected the Sender apart from the From, both are: %v", sender.Address)
+	}
+
+	msg, err = smtpd.NewMessage(nil, []byte(plainHTMLEmail), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+	if sender, err := msg.Sender(); sender != nil || err != nil {
+		t.Errorf("Expected no sender without the header, got: %v, %v", sender, err)
+	}
+}
+
+func TestMessageThreadingInfo(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte(emailWithNoBody), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+	info := msg.ThreadingInfo()
+	if info.Index == nil {
+		t.Fatal("Expected the Thread-Index to be decoded")
+	}
+	if info.Index.GUID != "2e0891ddc0e09e409fa7a62fc7dedaf7" {
+		t.Errorf("Wrong conversation GUID: %v", info.Index.GUID)
+	}
+	if want := time.Date(2022, 6, 24, 17, 29, 8, 0, time.UTC); info.Index.Started.Truncate(time.Second) != want {
+		t.Errorf("Expected the conversation to start at the Date, %v, got: %v", want, info.Index.Started)
+	}
+	if info.Index.Depth != 0 {
+		t.Errorf("Expected the first message of the conversation, got depth: %v", info.Index.Depth)
+	}
+
+	msg, err = smtpd.NewMessage(nil, withHeaders(plainHTMLEmail,
+		"In-Reply-To: <second@example.com>",
+		"References: <first@example.com>\n <second@example.com>",
+		"Thread-Topic: =?UTF-8?Q?Bees_=F0=9F=90=9D?=",
+		"Thread-Index: AQHYh+/pLgiR3cDgnkCfp6Yvx97a94CAAAHE"), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+	info = msg.ThreadingInfo()
+	if !reflect.DeepEqual(info.InReplyTo, []string{"second@example.com"}) {
+		t.Errorf("Wrong In-Reply-To: %q", info.InReplyTo)
+	}
+	if !reflect.DeepEqual(info.References, []string{"first@example.com", "second@example.com"}) {
+		t.Errorf("Wrong References: %q", info.References)
+	}
+	if info.Topic != "Bees 🐝" {
+		t.Errorf("Wrong topic: %q", info.Topic)
+	}
+	if info.Index == nil || info.Index.Depth != 1 || info.Index.GUID != "2e0891ddc0e09e409fa7a62fc7dedaf7" {
+		t.Errorf("Expected a reply in the same conversation, got: %+v", info.Index)
+	}
+}
+
+func TestMessageContentLanguageAndAutoSubmitted(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte(emailWithNoBody), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+	if langs := msg.ContentLanguage(); len(langs) != 1 || langs[0] != "en-US" {
+		t.Errorf("Wrong content language, got: %v", langs)
+	}
+	if auto := msg.AutoSubmitted(); auto != "no" {
+		t.Errorf("Expected a message without Auto-Submitted to be \"no\", got: %v", auto)
+	}
+
+	msg, err = smtpd.NewMessage(nil, withHeaders(plainHTMLEmail,
+		"Content-Language: en, fr-CA",
+		"Auto-Submitted: Auto-Replied; owner-email=\"owner@example.com\""), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+	if langs := msg.ContentLanguage(); len(langs) != 2 || langs[0] != "en" || langs[1] != "fr-CA" {
+		t.Errorf("Wrong content languages, got: %v", langs)
+	}
+	if auto := msg.AutoSubmitted(); auto != "auto-replied" {
+		t.Errorf("Wrong Auto-Submitted value, want: auto-replied, got: %v", auto)
+	}
+}
+
+func TestMessageHasAttachments(t *testing.T) {
+	signedWithPDF := "From: sender@example.com\r\nSubject: Signed with a PDF\r\n" +
+		"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; boundary=signed\r\n\r\n" +
+		"--signed\r\nContent-Type: multipart/mixed; boundary=mixed\r\n\r\n" +
+		"--mixed\r\nContent-Type: text/plain\r\n\r\nSee attached\r\n" +
+		"--mixed\r\nContent-Type: application/pdf; name=\"report.pdf\"\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERi0=\r\n" +
+		"--mixed--\r\n" +
+		"--signed\r\nContent-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n" +
+		"Content-Disposition: attachment; filename=\"smime.p7s\"\r\n\r\nc2lnbmF0dXJl\r\n" +
+		"--signed--\r\n"
+	cases := map[string]bool{
+		emailWithAttachment: true,
+		plainHTMLEmail:      false,
+		alternativeEmail:    false,
+		// the signature isn't an attachment, what was signed can have some
+		signedEmail:   false,
+		signedWithPDF: true,
+	}
+	for fixture, want := range cases {
+		msg, err := smtpd.NewMessage(nil, []byte(fixture), nil, nil)
+		if err != nil {
+			t.Fatalf("error creating message: %v", err)
+		}
+		got, err := msg.HasAttachments()
+		if err != nil {
+			t.Errorf("Error checking for attachments: %v", err)
+		} else if got != want {
+			t.Errorf("Wrong HasAttachments for %q, want: %v, got: %v", msg.Subject, want, got)
+		}
+		attachments, _ := msg.Attachments()
+		if got != (len(attachments) > 0) {
+			t.Errorf("HasAttachments and Attachments disagree for %q: %v and %v", msg.Subject, got, len(attachments))
+		}
+	}
+}
+
+func TestSignedMessageParsing(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte(signedEmail), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+
+	if plain, err := msg.Plain(); err != nil {
+		t.Error(err)
+	} else if strings.TrimSpace(string(plain)) != "Signed bees" {
+		t.Errorf("Wrong Plaintext content, got: %q", plain)
+	}
+	if html, err := msg.HTML(); err != nil {
+		t.Error(err)
+	} else if strings.TrimSpace(string(html)) != "<p>Signed bees</p>" {
+		t.Errorf("Wrong HTML content, got: %q", html)
+	}
+
+	signature, ok := msg.Signature()
+	if !ok {
+		t.Fatal("Expected a signature part")
+	}
+	if ct := signature.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/pkcs7-signature") {
+		t.Errorf("Wrong signature Content-Type, got: %v", ct)
+	}
+	if string(signature.Body) != "signature" {
+		t.Errorf("Wrong signature body, got: %q", signature.Body)
+	}
+
+	unsigned, err := smtpd.NewMessage(nil, []byte(plainHTMLEmail), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+	if _, ok := unsigned.Signature(); ok {
+		t.Error("Expected no signature on an unsigned message")
+	}
+}
+
+func TestMessageBodyParts(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte(alternativeEmail), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+
+	for _, find := range []func() (*smtpd.Part, error){msg.PlainPart, msg.HTMLPart} {
+		part, err := find()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params["charset"] != "UTF-8" {
+			t.Errorf("Expected the part charset to be UTF-8, got: %q", params["charset"])
+		}
+	}
+
+	html, err := msg.HTMLPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := msg.HTML(); string(body) != string(html.Body) {
+		t.Errorf("Expected HTML to return the HTMLPart body, got: %q", body)
+	}
+
+	// single part messages return the message headers
+	msg, err = smtpd.NewMessage(nil, []byte(plainHTMLEmail), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+	if html, err = msg.HTMLPart(); err != nil {
+		t.Fatal(err)
+	}
+	if ct := html.Header.Get("Content-Type"); ct != "text/html" {
+		t.Errorf("Wrong Content-Type, got: %q", ct)
+	}
+	if _, err := msg.PlainPart(); err == nil {
+		t.Error("Expected no text/plain part")
+	}
+}
+
+func TestQuotedPrintableSoftBreaks(t *testing.T) {
+	header := "From: sender@example.com\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n"
+	bodies := map[string]string{
+		"LF":          "Sending a very lon=\ng line of bees =F0=9F=90=9D\n",
+		"CRLF":        "Sending a very lon=\r\ng line of bees =F0=9F=90=9D\r\n",
+		"CR":          "Sending a very lon=\rg line of bees =F0=9F=90=9D\r",
+		"doubled CR":  "Sending a very lon=\r\r\ng line of bees =F0=9F=90=9D\r\r\n",
+		"padded CRLF": "Sending a very lon=  \r\ng line of bees =F0=9F=90=9D\r\n",
+	}
+	for name, body := range bodies {
+		msg, err := smtpd.NewMessage(nil, []byte(header+body), nil, nil)
+		if err != nil {
+			t.Fatalf("error creating message: %v", err)
+		}
+		plain, err := msg.Plain()
+		if err != nil {
+			t.Errorf("%v: error decoding body: %v", name, err)
+		} else if got := strings.TrimSpace(string(plain)); got != "Sending a very long line of bees 🐝" {
+			t.Errorf("%v: wrong decoded body, got: %q", name, got)
+		}
+	}
+}
+
+func TestMessageSigningDomains(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte(emailWithNoBody), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+
+	if domains := msg.DKIMDomains(); len(domains) != 1 || domains[0] != "forkingsoftware.com" {
+		t.Errorf("Wrong DKIM domains, want: [forkingsoftware.com], got: %v", domains)
+	}
+	if domains := msg.ARCDomains(); len(domains) != 1 || domains[0] != "microsoft.com" {
+		t.Errorf("Wrong ARC domains, want: [microsoft.com], got: %v", domains)
+	}
+
+	msg, err = smtpd.NewMessage(nil, []byte(plainHTMLEmail), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+	if domains := msg.DKIMDomains(); len(domains) != 0 {
+		t.Errorf("Expected no DKIM domains on an unsigned message, got: %v", domains)
+	}
+}
+
+func TestMessageFlatten(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte(alternativeEmail), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+
+	flat, err := msg.Flatten()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flat) != 2 {
+		t.Errorf("Expected text/plain and text/html entries, got: %v", len(flat))
+	}
+	if plain := flat["text/plain"]; len(plain) != 1 || strings.TrimSpace(string(plain[0])) != "Sending bees\n\n🐝" {
+		t.Errorf("Wrong text/plain entry: %q", plain)
+	}
+	if html := flat["text/html"]; len(html) != 1 || !strings.Contains(string(html[0]), "Sending bees<br><br>🐝") {
+		t.Errorf("Wrong text/html entry: %q", html)
+	}
+
+	// nested parts are flattened too
+	msg, err = smtpd.NewMessage(nil, []byte(emailWithAttachment), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+	if flat, err = msg.Flatten(); err != nil {
+		t.Fatal(err)
+	}
+	for _, mediaType := range []string{"text/plain", "text/html", "text/calendar"} {
+		if len(flat[mediaType]) != 1 {
+			t.Errorf("Expected one %v entry, got: %v", mediaType, len(flat[mediaType]))
+		}
+	}
+}
+
+func TestMessageWriteJSON(t *testing.T) {
+	decode := func(raw string) map[string]interface{} {
+		t.Helper()
+		msg, err := smtpd.NewMessage(nil, []byte(raw), nil, nil)
+		if err != nil {
+			t.Fatalf("error creating message: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := msg.WriteJSON(&buf); err != nil {
+			t.Fatalf("error writing JSON: %v", err)
+		}
+		var out map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+			t.Fatalf("WriteJSON wrote invalid JSON: %v\n%s", err, buf.Bytes())
+		}
+		return out
+	}
+
+	out := decode(alternativeEmail)
+	if subject := out["subject"]; subject != "Multipart Message" {
+		t.Errorf("Wrong subject: %v", subject)
+	}
+	if id := out["message_id"]; id != "<examplemessage@example.com>" {
+		t.Errorf("Wrong message_id: %v", id)
+	}
+	if from := out["from"].(map[string]interface{}); from["address"] != "sender@example.com" || from["name"] != "Sender" {
+		t.Errorf("Wrong from: %v", from)
+	}
+	if to := out["to"].([]interface{}); len(to) != 2 || to[1].(map[string]interface{})["name"] != "Recipient 2" {
+		t.Errorf("Wrong to: %v", to)
+	}
+	if date := out["date"]; date != "Mon, 16 Jan 2017 16:59:33 -0500" {
+		t.Errorf("Wrong date: %v", date)
+	}
+	if text, _ := out["text"].(string); !strings.Contains(text, "Sending bees") || !strings.Contains(text, "🐝") {
+		t.Errorf("Wrong text body: %q", text)
+	}
+	if html, _ := out["html"].(string); !strings.Contains(html, "<br><br>🐝") {
+		t.Errorf("Wrong html body: %q", html)
+	}
+	if headers := out["headers"].(map[string]interface{}); headers["Mime-Version"].([]interface{})[0] != "1.0" {
+		t.Errorf("Wrong headers: %v", headers)
+	}
+	if attachments := out["attachments"].([]interface{}); len(attachments) != 0 {
+		t.Errorf("Expected no attachments, got: %v", attachments)
+	}
+
+	out = decode(emailWithAttachment)
+	attachments := out["attachments"].([]interface{})
+	if len(attachments) != 1 {
+		t.Fatalf("Expected 1 attachment, got: %v", attachments)
+	}
+	attachment := attachments[0].(map[string]interface{})
+	if attachment["name"] != "invite.ics" || !strings.HasPrefix(attachment["content_type"].(string), "text/calendar") {
+		t.Errorf("Wrong attachment metadata: %v", attachment)
+	}
+	if size, _ := attachment["size"].(float64); size <= 0 {
+		t.Errorf("Expected the attachment size, got: %v", attachment["size"])
+	}
+	if _, ok := attachment["body"]; ok {
+		t.Error("Expected the attachment contents left out")
+	}
+
+	// latin-1 is turned into UTF-8
+	out = decode("From: sender@example.com\nContent-Type: text/plain; charset=iso-8859-1\n\nCaf\xe9\n")
+	if out["text"] != "Café\n" {
+		t.Errorf("Expected the latin-1 text in UTF-8, got: %q", out["text"])
+	}
+
+	// a charset that can't be decoded can't go in a JSON string as is
+	out = decode("From: sender@example.com\nContent-Type: text/plain; charset=x-unknown\n\nCaf\xe9\n")
+	if _, ok := out["text"]; ok {
+		t.Errorf("Expected no text for a non UTF-8 body, got: %q", out["text"])
+	}
+	if encoded := out["text_base64"]; encoded != base64.StdEncoding.EncodeToString([]byte("Caf\xe9\n")) {
+		t.Errorf("Wrong text_base64: %v", encoded)
+	}
+}
+
+func TestMessageKeepRawParts(t *testing.T) {
+	const encoded = "QkVHSU46VkNBTEVOREFSClZFUlNJT046Mi4wClBST0RJRDotLy9tYWlscHJvdG8vL01haWxQcm90bwpDQUxTQ0FMRTpHUkVHT1JJQU4KQkVHSU46VkVWRU5UCkRUU1RBTVA6MjAxNzAxMTZUMTU0MDAwClVJRDpteWNvb2xldmVudEBtYWlscHJvdG8KCkRUU1RBUlQ7VFpJRD0iQW1lcmljYS9OZXdfWW9yayI6MjAxNzAxMThUMTEwMDAwCkRURU5EO1RaSUQ9IkFtZXJpY2EvTmV3X1lvcmsiOjIwMTcwMTE4VDEyMDAwMApTVU1NQVJZOlNlbmQgYW4gZW1haWwKTE9DQVRJT046VGVzdApFTkQ6VkVWRU5UCkVORDpWQ0FMRU5EQVI="
+
+	msg, err := smtpd.NewMessage(nil, []byte(emailWithAttachment), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+
+	attachments, err := msg.Attachments()
+	if err != nil || len(attachments) != 1 {
+		t.Fatalf("Expected 1 attachment, got: %v %v", len(attachments), err)
+	}
+	if attachments[0].RawBody != nil {
+		t.Error("Expected no RawBody unless KeepRawParts is set")
+	}
+
+	msg.KeepRawParts = true
+	if attachments, err = msg.Attachments(); err != nil || len(attachments) != 1 {
+		t.Fatalf("Expected 1 attachment, got: %v %v", len(attachments), err)
+	}
+	ics := attachments[0]
+	if got := strings.TrimSpace(string(ics.RawBody)); got != encoded {
+		t.Errorf("Expected RawBody to be the base64 text, got: %q", got)
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(encoded)
+	if !bytes.Equal(ics.Body, decoded) {
+		t.Errorf("Expected Body to be the decoded bytes, got: %q", ics.Body)
+	}
+}
+
+func TestMessageListHeaders(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte(`From: someone@example.com
+To: golang-nuts@googlegroups.com
+Subject: Re: generics
+List-Id: "Go Nuts" <golang-nuts.googlegroups.com>
+List-Post: <mailto:golang-nuts@googlegroups.com>
+List-Help: <https://support.google.com/a/users/answer/9308783>,
+ <mailto:golang-nuts+help@googlegroups.com>
+List-Archive: <https://groups.google.com/group/golang-nuts> (the web archive)
+
+Hello
+`), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+
+	description, id, ok := msg.ListID()
+	if !ok || description != "Go Nuts" || id != "golang-nuts.googlegroups.com" {
+		t.Errorf("Wrong List-Id: %q %q %v", description, id, ok)
+	}
+	if post := msg.ListPost(); !reflect.DeepEqual(post, []string{"mailto:golang-nuts@googlegroups.com"}) {
+		t.Errorf("Wrong List-Post: %v", post)
+	}
+	if help := msg.ListHelp(); !reflect.DeepEqual(help, []string{"https://support.google.com/a/users/answer/9308783", "mailto:golang-nuts+help@googlegroups.com"}) {
+		t.Errorf("Wrong List-Help: %v", help)
+	}
+	if archive := msg.ListArchive(); !reflect.DeepEqual(archive, []string{"https://groups.google.com/group/golang-nuts"}) {
+		t.Errorf("Wrong List-Archive: %v", archive)
+	}
+
+	plain, _ := smtpd.NewMessage(nil, []byte("From: someone@example.com\nList-Post: NO\n\nHello\n"), nil, nil)
+	if _, _, ok := plain.ListID(); ok {
+		t.Error("Expected no List-Id")
+	}
+	if post := plain.ListPost(); len(post) != 0 {
+		t.Errorf("Expected no List-Post URLs, got: %v", post)
+	}
+}
+
+type memoryBlobStore map[string][]byte
+
+func (m memoryBlobStore) Put(key string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m[key] = data
+	return nil
+}
+
+func TestMessageStoreAttachments(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte(emailWithAttachment), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+
+	store := memoryBlobStore{}
+	refs, err := msg.StoreAttachments(store)
+	if err != nil || len(refs) != 1 {
+		t.Fatalf("Expected 1 attachment reference, got: %v %v", refs, err)
+	}
+	ref := refs[0]
+	if ref.Name != "invite.ics" || ref.ContentType != "text/calendar" {
+		t.Errorf("Wrong attachment reference: %+v", ref)
+	}
+	stored, ok := store[ref.Key]
+	if !ok || len(store) != 1 {
+		t.Fatalf("Expected the attachment stored under %v, got keys: %v", ref.Key, len(store))
+	}
+	if !bytes.HasPrefix(stored, []byte("BEGIN:VCALENDAR")) || len(stored) != ref.Size {
+		t.Errorf("Wrong stored contents (%v bytes): %q", ref.Size, stored)
+	}
+
+	// the same attachment gets the same key
+	again, _ := msg.StoreAttachments(store)
+	if len(again) != 1 || again[0].Key != ref.Key || len(store) != 1 {
+		t.Errorf("Expected the same key again, got: %+v", again)
+	}
+
+	// the text body of multipart/mixed isn't an attachment, one nested deeper is
+	mixed := "From: sender@example.com\r\nContent-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\nContent-Type: text/plain\r\n\r\nSee attached\r\n" +
+		"--outer\r\nContent-Type: multipart/related; boundary=inner\r\n\r\n" +
+		"--inner\r\nContent-Type: text/html\r\n\r\n<img src=\"cid:logo\">\r\n" +
+		"--inner\r\nContent-Type: image/png\r\nContent-Transfer-Encoding: base64\r\n" +
+		"Content-Disposition: attachment; filename=\"logo.png\"\r\n\r\naGVsbG8g\r\nd29ybGQ=\r\n" +
+		"--inner--\r\n--outer--\r\n"
+	msg, err = smtpd.NewMessage(nil, []byte(mixed), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+	store = memoryBlobStore{}
+	refs, err = msg.StoreAttachments(store)
+	if err != nil || len(refs) != 1 || len(store) != 1 {
+		t.Fatalf("Expected only the nested attachment stored, got: %+v %v", refs, err)
+	}
+	if refs[0].Name != "logo.png" || refs[0].Size != 11 || string(store[refs[0].Key]) != "hello world" {
+		t.Errorf("Wrong attachment reference: %+v %q", refs[0], store[refs[0].Key])
+	}
+}
+
+func TestPartDecodedBody(t *testing.T) {
+	tests := []struct {
+		cte, charset, raw, want string
+	}{
+		{"base64", "utf-8", "Q2Fmw6kgY3LDqG1l\r\n", "Café crème"},
+		{"quoted-printable", "utf-8", "Caf=C3=A9 cr=C3=A8me, a long line that=\r\n goes on\r\n", "Café crème, a long line that goes on\r\n"},
+		{"", "utf-8", "Plain text\r\n", "Plain text\r\n"},
+		{"8bit", "utf-8", "Café\r\n", "Café\r\n"},
+		// transcoded to UTF-8 from the part's charset
+		{"quoted-printable", "iso-8859-1", "Caf=E9 cr=E8me\r\n", "Café crème\r\n"},
+		{"base64", "windows-1252", "k0NhZumU\r\n", "“Café”"},
+	}
+	for _, test := range tests {
+		raw := "From: sender@example.com\r\nContent-Type: text/plain; charset=" + test.charset + "\r\n"
+		if test.cte != "" {
+			raw += "Content-Transfer-Encoding: " + test.cte + "\r\n"
+		}
+		msg, err := smtpd.NewMessage(nil, []byte(raw+"\r\n"+test.raw), nil, nil)
+		if err != nil {
+			t.Fatalf("error creating message: %v", err)
+		}
+		msg.KeepRawParts = true
+		parts, err := msg.Parts()
+		if err != nil || len(parts) != 1 {
+			t.Fatalf("Expected 1 part, got: %v %v", len(parts), err)
+		}
+		if body, err := parts[0].DecodedBody(); err != nil || string(body) != test.want {
+			t.Errorf("%q: wrong decoded body %q (%v)", test.cte, body, err)
+		}
+
+		// a part made up of the raw content alone is decoded when asked
+		part := &smtpd.Part{Header: parts[0].Header, RawBody: parts[0].RawBody}
+		if body, err := part.DecodedBody(); err != nil || string(body) != test.want {
+			t.Errorf("%q: wrong decoded body from RawBody %q (%v)", test.cte, body, err)
+		}
+	}
+
+	// the message's CharsetReader is used for its parts
+	msg, _ := smtpd.NewMessage(nil, []byte("From: sender@example.com\r\nContent-Type: text/plain; charset=x-shout\r\n\r\nhello"), nil, nil)
+	msg.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		body, err := io.ReadAll(input)
+		return strings.NewReader(strings.ToUpper(string(body))), err
+	}
+	part, err := msg.PlainPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := part.DecodedBody(); err != nil || string(body) != "HELLO" {
+		t.Errorf("Expected the CharsetReader applied, got: %q (%v)", body, err)
+	}
+
+	broken := &smtpd.Part{Header: map[string][]string{"Content-Transfer-Encoding": {"base64"}}, RawBody: []byte("not base64!")}
+	if _, err := broken.DecodedBody(); err == nil {
+		t.Error("Expected an error for broken base64")
+	}
+}
+
+func TestMessageEqual(t *testing.T) {
+	parse := func(raw string) *smtpd.Message {
+		t.Helper()
+		msg, err := smtpd.NewMessage(nil, []byte(raw), nil, nil)
+		if err != nil {
+			t.Fatalf("error creating message: %v", err)
+		}
+		return msg
+	}
+
+	msg := parse(emailWithAttachment)
+	if equal, diffs := msg.Equal(msg); !equal || len(diffs) != 0 {
+		t.Errorf("Expected a message to equal itself, got: %v", diffs)
+	}
+	if equal, diffs := msg.Equal(parse(emailWithAttachment)); !equal {
+		t.Errorf("Expected the same source to give equal messages, got: %v", diffs)
+	}
+
+	mutated := strings.Replace(emailWithAttachment, "Subject: Multipart Message", "Subject: Changed", 1)
+	mutated = strings.Replace(mutated, "Sending bees", "Sending wasps", 1)
+	equal, diffs := msg.Equal(parse(mutated))
+	if equal {
+		t.Fatal("Expected a mutated copy to differ")
+	}
+	want := []string{"Header Subject:", "Subject:", "Plain:"}
+	for _, prefix := range want {
+		found := false
+		for _, diff := range diffs {
+			found = found || strings.HasPrefix(diff, prefix)
+		}
+		if !found {
+			t.Errorf("Expected a %q difference, got: %v", prefix, diffs)
+		}
+	}
+	if len(diffs) != len(want) {
+		t.Errorf("Expected %v differences, got: %v", len(want), diffs)
+	}
+}
+
+func TestMessageBytes(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte(emailWithAttachment), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+	if string(msg.Bytes()) != emailWithAttachment {
+		t.Error("Expected Bytes to be the message as received")
+	}
+
+	again, err := smtpd.NewMessage(nil, msg.Bytes(), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message from Bytes: %v", err)
+	}
+	if equal, diffs := msg.Equal(again); !equal {
+		t.Errorf("Expected Bytes to round-trip, got: %v", diffs)
+	}
+
+	// headers left by hooks come first
+	conn := &smtpd.Conn{}
+	conn.AddInfoHeader("X-Hook", "checked")
+	msg, err = smtpd.NewMessage(conn, []byte(strings.ReplaceAll(alternativeEmail, "\n", "\r\n")), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+	if !strings.HasPrefix(string(msg.Bytes()), "X-Hook: checked\r\nFrom: Sender") {
+		t.Errorf("Expected the hook header in front with matching line endings, got: %q", msg.Bytes()[:40])
+	}
+	again, err = smtpd.NewMessage(nil, msg.Bytes(), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message from Bytes: %v", err)
+	}
+	if got := again.Header.Get("X-Hook"); got != "checked" {
+		t.Errorf("Expected the hook header after the round trip, got: %q", got)
+	}
+	if plain, _ := again.Plain(); !strings.Contains(string(plain), "Sending bees") {
+		t.Errorf("Expected the body after the round trip, got: %q", plain)
+	}
+}
+
+func TestMessageMultipartReader(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte(emailWithAttachment), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+
+	mr, err := msg.MultipartReader()
+	if err != nil {
+		t.Fatalf("Expected a multipart reader: %v", err)
+	}
+	var types []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Error reading part: %v", err)
+		}
+		mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		types = append(types, mediaType)
+	}
+	if strings.Join(types, ",") != "multipart/alternative,text/calendar" {
+		t.Errorf("Wrong top level parts: %v", types)
+	}
+
+	msg, err = smtpd.NewMessage(nil, []byte(plainHTMLEmail), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+	if _, err := msg.MultipartReader(); err == nil {
+		t.Error("Expected an error for a message that isn't multipart")
+	}
+}
+
+func TestMessageIsAutoSubmitted(t *testing.T) {
+	cases := map[string]bool{
+		"Auto-Submitted: auto-replied": true,
+		"Auto-Submitted: no":           false,
+		"Precedence: bulk":             true,
+		"Precedence: List":             true,
+		"Precedence: first-class":      false,
+	}
+	for header, want := range cases {
+		msg, err := smtpd.NewMessage(nil, withHeaders(plainHTMLEmail, header), nil, nil)
+		if err != nil {
+			t.Fatal("error creating message", err)
+		}
+		if got := msg.IsAutoSubmitted(); got != want {
+			t.Errorf("Expected IsAutoSubmitted %v with %q, got: %v", want, header, got)
+		}
+	}
+
+	msg, err := smtpd.NewMessage(nil, []byte(plainHTMLEmail), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+	if msg.IsAutoSubmitted() {
+		t.Error("Expected a message without either header not to be auto submitted")
+	}
+}
+
+func TestMessageCalendarInvites(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte(emailWithAttachment), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+
+	invites, err := msg.CalendarInvites()
+	if err != nil || len(invites) != 1 {
+		t.Fatalf("Expected 1 calendar invite, got: %v %v", len(invites), err)
+	}
+	events := invites[0].CalendarEvents()
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got: %v", events)
+	}
+	want := smtpd.CalendarEvent{
+		UID:      "mycoolevent@mailproto",
+		Summary:  "Send an email",
+		Location: "Test",
+		Start:    "20170118T110000",
+		End:      "20170118T120000",
+	}
+	if events[0] != want {
+		t.Errorf("Wrong event, want: %+v, got: %+v", want, events[0])
+	}
+
+	msg, err = smtpd.NewMessage(nil, []byte(alternativeEmail), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+	if invites, err := msg.CalendarInvites(); err != nil || len(invites) != 0 {
+		t.Errorf("Expected no invites, got: %v %v", len(invites), err)
+	}
+}
@@ -3,6 +3,7 @@ package smtpd_test
 import (
 	"fmt"
 	"github.com/mailsac/smtpd"
+	"sync"
 	"testing"
 )
 
@@ -23,4 +24,29 @@ func Test_MessageID(t *testing.T) {
 			o[id] = true
 		}
 	})
+
+	t.Run("NewMessageID does not collide across goroutines", func(t *testing.T) {
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+		o := make(map[string]bool)
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ids := make([]string, 50000)
+				for i := range ids {
+					ids[i] = smtpd.NewMessageID()
+				}
+				lock.Lock()
+				defer lock.Unlock()
+				for _, id := range ids {
+					if o[id] {
+						t.Errorf("Got duplicate unique id %s", id)
+					}
+					o[id] = true
+				}
+			}()
+		}
+		wg.Wait()
+	})
 }
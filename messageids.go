@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,6 +17,10 @@ var charIndexes = len(_charset) - 1
 var _counter = 0
 var charmux sync.Mutex
 
+// _sequence is bumped for every ID so IDs from this process never repeat, even when the random
+// source does
+var _sequence uint64
+
 // when crypto source is exhausted, fallback to PRNG, which must have a unique seed
 func InitPseudoRandomNumberGeneratorFallback() {
 	rand.Seed(time.Now().UnixNano())
@@ -23,11 +28,11 @@ func InitPseudoRandomNumberGeneratorFallback() {
 
 func getCounter() string {
 	charmux.Lock()
+	defer charmux.Unlock()
 	_counter++
 	if _counter > charIndexes {
 		_counter = 0
 	}
-	charmux.Unlock()
 	return string(_charset[_counter])
 }
 
@@ -57,5 +62,12 @@ func NewMessageID() string {
 	// allow underscore as only special char, otherwise replace with a pseudo-rand char
 	randString = strings.Replace(randString, "-", getCounter(), -1)
 	randString = strings.Replace(randString, "/", getCounter(), -1)
-	return dateEntropy + getCounter() + randString + getCounter()
+	return dateEntropy + getCounter() + randString + getCounter() + sequencePart()
+}
+
+// sequencePart encodes the next sequence number followed by a char giving its length, which
+// keeps the suffix unambiguous however long the rest of the ID is
+func sequencePart() string {
+	seq := strconv.FormatUint(atomic.AddUint64(&_sequence, 1), 36)
+	return seq + string(_charset[len(seq)])
 }
@@ -0,0 +1,102 @@
+package smtpd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/mail"
+	"unicode/utf8"
+)
+
+type jsonAddress struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+}
+
+type jsonAttachment struct {
+	Name        string `json:"name,omitempty"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+type jsonMessage struct {
+	MessageID   string              `json:"message_id,omitempty"`
+	From        *jsonAddress        `json:"from,omitempty"`
+	To          []jsonAddress       `json:"to"`
+	Cc          []jsonAddress       `json:"cc"`
+	Rcpt        []jsonAddress       `json:"rcpt"`
+	Subject     string              `json:"subject"`
+	Date        string              `json:"date,omitempty"`
+	Headers     map[string][]string `json:"headers"`
+	Text        string              `json:"text,omitempty"`
+	TextBase64  string              `json:"text_base64,omitempty"`
+	HTML        string              `json:"html,omitempty"`
+	HTMLBase64  string              `json:"html_base64,omitempty"`
+	Attachments []jsonAttachment    `json:"attachments"`
+	Truncated   bool                `json:"truncated,omitempty"`
+}
+
+// WriteJSON writes the message as a single JSON object, for feeding search indexes and queues.
+// It holds the addresses, subject, date, Message-ID and headers, the decoded text and HTML
+// bodies, and the name, type and size of each attachment (but not their contents).
+//
+// message_id is the Message-ID header, or the id the server gave the message when there is
+// none. Bodies that aren't valid UTF-8 come out base64 encoded as text_base64 or html_base64
+// instead, as they were sent, so nothing is lost to replacement characters.
+func (m *Message) WriteJSON(w io.Writer) error {
+	out := jsonMessage{
+		MessageID:   m.Header.Get("Message-ID"),
+		To:          jsonAddresses(m.To),
+		Rcpt:        jsonAddresses(m.Rcpt),
+		Subject:     m.SubjectDecoded(),
+		Date:        m.Header.Get("Date"),
+		Headers:     m.Header,
+		Attachments: []jsonAttachment{},
+		Truncated:   m.Truncated,
+	}
+	if out.MessageID == "" {
+		out.MessageID = m.MessageID
+	}
+	if m.From != nil {
+		out.From = &jsonAddress{Name: m.From.Name, Address: m.From.Address}
+	}
+	cc, _ := m.Header.AddressList("Cc")
+	out.Cc = jsonAddresses(cc)
+
+	if plain, err := m.Plain(); err == nil || isCharsetError(err) {
+		out.Text, out.TextBase64 = jsonBody(plain)
+	}
+	if html, err := m.HTML(); err == nil || isCharsetError(err) {
+		out.HTML, out.HTMLBase64 = jsonBody(html)
+	}
+
+	attachments, err := m.Attachments()
+	if err != nil {
+		return err
+	}
+	for _, part := range attachments {
+		out.Attachments = append(out.Attachments, jsonAttachment{
+			Name:        part.FileName(),
+			ContentType: part.Header.Get("Content-Type"),
+			Size:        len(part.Body),
+		})
+	}
+
+	return json.NewEncoder(w).Encode(out)
+}
+
+func jsonAddresses(addresses []*mail.Address) []jsonAddress {
+	list := make([]jsonAddress, 0, len(addresses))
+	for _, address := range addresses {
+		list = append(list, jsonAddress{Name: address.Name, Address: address.Address})
+	}
+	return list
+}
+
+// jsonBody returns body as a string when it is valid UTF-8, otherwise base64 encoded
+func jsonBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return "", base64.StdEncoding.EncodeToString(body)
+}
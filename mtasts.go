@@ -0,0 +1,243 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MTA-STS policy modes, see https://tools.ietf.org/html/rfc8461#section-3.2
+const (
+	MTASTSModeEnforce = "enforce"
+	MTASTSModeTesting = "testing"
+	MTASTSModeNone    = "none"
+)
+
+// maxMTASTSPolicySize caps the policy body, which the RFC suggests should be no more than 64k
+const maxMTASTSPolicySize = 64 * 1024
+
+// HTTPClient is the part of *http.Client needed to fetch MTA-STS policies, so it can be swapped out
+type HTTPClient interface {
+	Get(url string) (*http.Response, error)
+}
+
+// MTASTSPolicy is a parsed mta-sts.txt policy file
+type MTASTSPolicy struct {
+	Version string
+	Mode    string
+	MX      []string
+	MaxAge  time.Duration
+}
+
+// MatchesMX reports whether host is one of the policy's allowed MX hosts. A pattern like
+// "*.example.com" matches exactly one extra leftmost label.
+func (p *MTASTSPolicy) MatchesMX(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, mx := range p.MX {
+		mx = strings.ToLower(mx)
+		if mx == host {
+			return true
+		}
+		if strings.HasPrefix(mx, "*.") {
+			if i := strings.Index(host, "."); i > 0 && host[i+1:] == mx[2:] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TLSPolicy maps the policy onto the TLSPolicy Relay understands: only an enforced policy
+// requires TLS, a testing policy still delivers when TLS isn't available.
+func (p *MTASTSPolicy) TLSPolicy() TLSPolicy {
+	if p.Mode == MTASTSModeEnforce {
+		return TLSPolicyRequire
+	}
+	return TLSPolicyOpportunistic
+}
+
+// DefaultMTASTSTimeout limits fetching a policy when Server.MTASTSClient isn't set
+const DefaultMTASTSTimeout = time.Second * 30
+
+// defaultMTASTSClient doesn't follow redirects, which policy fetches must not, see
+// https://tools.ietf.org/html/rfc8461#section-3.3
+var defaultMTASTSClient = &http.Client{
+	Timeout: DefaultMTASTSTimeout,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// FetchMTASTS retrieves the MTA-STS policy published by domain over HTTPS. It always fetches,
+// Server.MTASTSPolicy is the cached lookup Relay uses.
+func FetchMTASTS(domain string, client HTTPClient) (*MTASTSPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	res, err := client.Get("https://mta-sts." + domain + "/.well-known/mta-sts.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("MTA-STS policy fetch for %v returned HTTP %v", domain, res.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxMTASTSPolicySize))
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := parseMTASTSPolicy(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MTA-STS policy for %v: %v", domain, err)
+	}
+	return policy, nil
+}
+
+type mtastsCacheEntry struct {
+	id      string
+	policy  *MTASTSPolicy
+	expires time.Time
+}
+
+// MTASTSPolicy looks up the MTA-STS policy of domain: the _mta-sts TXT record says whether there
+// is one and which, the policy itself is fetched with MTASTSClient. Policies are cached for their
+// max_age and only fetched again before that when the TXT record's id changes. It returns nil
+// and no error when the domain publishes no policy.
+func (s *Server) MTASTSPolicy(domain string) (*MTASTSPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	id, txtErr := s.mtastsID(domain)
+
+	s.mtastsLock.Lock()
+	entry, cached := s.mtastsPolicies[domain]
+	s.mtastsLock.Unlock()
+	cached = cached && time.Now().Before(entry.expires)
+
+	// a cached policy outlives a TXT record that went missing, see
+	// https://tools.ietf.org/html/rfc8461#section-5.1
+	if cached && (txtErr != nil || id == "" || id == entry.id) {
+		return entry.policy, nil
+	}
+	if txtErr != nil || id == "" {
+		return nil, txtErr
+	}
+
+	client := s.MTASTSClient
+	if client == nil {
+		client = defaultMTASTSClient
+	}
+	policy, err := FetchMTASTS(domain, client)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	s.mtastsLock.Lock()
+	defer s.mtastsLock.Unlock()
+	if s.mtastsPolicies == nil {
+		s.mtastsPolicies = make(map[string]mtastsCacheEntry)
+	}
+	for cachedDomain, cachedEntry := range s.mtastsPolicies {
+		if now.After(cachedEntry.expires) {
+			delete(s.mtastsPolicies, cachedDomain)
+		}
+	}
+	s.mtastsPolicies[domain] = mtastsCacheEntry{id, policy, now.Add(policy.MaxAge)}
+	return policy, nil
+}
+
+// mtastsID is the id of the domain's _mta-sts TXT record, like "v=STSv1; id=20160831085700Z",
+// empty when there is none
+func (s *Server) mtastsID(domain string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.dnsTimeout())
+	defer cancel()
+
+	records, err := s.resolver().LookupTXT(ctx, "_mta-sts."+domain)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	id := ""
+	for _, record := range records {
+		fields := strings.Split(record, ";")
+		if strings.TrimSpace(fields[0]) != "v=STSv1" {
+			continue
+		}
+		if id != "" {
+			// more than one record, which the RFC says means no policy
+			return "", nil
+		}
+		for _, field := range fields[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(field), "=", 2); len(kv) == 2 && kv[0] == "id" {
+				id = kv[1]
+			}
+		}
+	}
+	return id, nil
+}
+
+// parseMTASTSPolicy reads the key/value lines of a policy, see https://tools.ietf.org/html/rfc8461#section-3.2
+func parseMTASTSPolicy(body []byte) (*MTASTSPolicy, error) {
+	policy := &MTASTSPolicy{}
+	hasMaxAge := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "version":
+			policy.Version = value
+		case "mode":
+			policy.Mode = value
+		case "mx":
+			policy.MX = append(policy.MX, value)
+		case "max_age":
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad max_age %q", value)
+			}
+			policy.MaxAge = time.Duration(seconds) * time.Second
+			hasMaxAge = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if policy.Version != "STSv1" {
+		return nil, fmt.Errorf("unsupported version %q", policy.Version)
+	}
+	switch policy.Mode {
+	case MTASTSModeEnforce, MTASTSModeTesting:
+		if len(policy.MX) == 0 {
+			return nil, fmt.Errorf("no mx patterns in %v policy", policy.Mode)
+		}
+	case MTASTSModeNone:
+	default:
+		return nil, fmt.Errorf("unknown mode %q", policy.Mode)
+	}
+	if !hasMaxAge {
+		return nil, fmt.Errorf("missing max_age")
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,134 @@
+package smtpd
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeHTTPClient struct {
+	body     string
+	requests []string
+}
+
+func (f *fakeHTTPClient) Get(url string) (*http.Response, error) {
+	f.requests = append(f.requests, url)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(f.body)),
+	}, nil
+}
+
+func TestFetchMTASTS(t *testing.T) {
+	client := &fakeHTTPClient{body: "version: STSv1\r\n" +
+		"mode: enforce\r\n" +
+		"mx: mail.example.net\r\n" +
+		"mx: *.backup.example.net\r\n" +
+		"max_age: 86400\r\n"}
+
+	policy, err := FetchMTASTS("example.net", client)
+	if err != nil {
+		t.Fatalf("Error fetching policy: %v", err)
+	}
+
+	if len(client.requests) != 1 || client.requests[0] != "https://mta-sts.example.net/.well-known/mta-sts.txt" {
+		t.Errorf("Wrong policy requests: %v", client.requests)
+	}
+	if policy.Mode != MTASTSModeEnforce {
+		t.Errorf("Wrong mode, want: %v, got: %v", MTASTSModeEnforce, policy.Mode)
+	}
+	if policy.TLSPolicy() != TLSPolicyRequire {
+		t.Errorf("Expected an enforced policy to require TLS")
+	}
+	if policy.MaxAge != 24*time.Hour {
+		t.Errorf("Wrong max_age, want: %v, got: %v", 24*time.Hour, policy.MaxAge)
+	}
+
+	mx := map[string]bool{
+		"mail.example.net":         true,
+		"MAIL.example.net.":        true,
+		"mx1.backup.example.net":   true,
+		"a.mx1.backup.example.net": false,
+		"backup.example.net":       false,
+		"mail.example.com":         false,
+	}
+	for host, want := range mx {
+		if got := policy.MatchesMX(host); got != want {
+			t.Errorf("Wrong MX match for %v, want: %v, got: %v", host, want, got)
+		}
+	}
+}
+
+const enforcePolicy = "version: STSv1\nmode: enforce\nmx: mail.example.net\nmax_age: 86400\n"
+
+func TestServerMTASTSPolicy(t *testing.T) {
+	resolver := &fakeResolver{txt: map[string][]string{"_mta-sts.example.net": {"v=STSv1; id=20240101"}}}
+	client := &fakeHTTPClient{body: enforcePolicy}
+	server := NewServer(nil)
+	server.Resolver = resolver
+	server.MTASTSClient = client
+	server.MTASTS = true
+
+	if policy := server.TLSPolicyFor("example.net"); policy != TLSPolicyRequire {
+		t.Errorf("Expected the enforced policy to require TLS, got: %v", policy)
+	}
+	// cached while the id stays the same
+	server.TLSPolicyFor("Example.NET.")
+	if len(client.requests) != 1 {
+		t.Errorf("Expected the cached policy to be reused, got %v requests", len(client.requests))
+	}
+	// a new id means a new policy
+	resolver.txt["_mta-sts.example.net"] = []string{"v=STSv1; id=20240202"}
+	server.TLSPolicyFor("example.net")
+	if len(client.requests) != 2 {
+		t.Errorf("Expected the policy fetched again for a new id, got %v requests", len(client.requests))
+	}
+
+	// the cache belongs to the server
+	other := NewServer(nil)
+	other.Resolver = resolver
+	other.MTASTSClient = client
+	other.MTASTS = true
+	other.TLSPolicyFor("example.net")
+	if len(client.requests) != 3 {
+		t.Errorf("Expected another server to fetch its own policy, got %v requests", len(client.requests))
+	}
+
+	// no TXT record, no policy
+	if policy := server.TLSPolicyFor("plain.example.org"); policy != TLSPolicyOpportunistic {
+		t.Errorf("Expected a domain without a policy to be opportunistic, got: %v", policy)
+	}
+	if len(client.requests) != 3 {
+		t.Errorf("Expected no fetch without a TXT record, got %v requests", len(client.requests))
+	}
+
+	// a listed domain doesn't look at MTA-STS
+	server.OutboundTLSPolicy = map[string]TLSPolicy{"example.net": TLSPolicyNone}
+	if policy := server.TLSPolicyFor("example.net"); policy != TLSPolicyNone {
+		t.Errorf("Expected OutboundTLSPolicy to win, got: %v", policy)
+	}
+}
+
+func TestRelayMTASTSMX(t *testing.T) {
+	server := NewServer(nil)
+	server.Resolver = &fakeResolver{txt: map[string][]string{"_mta-sts.example.net": {"v=STSv1; id=1"}}}
+	server.MTASTSClient = &fakeHTTPClient{body: enforcePolicy}
+	server.MTASTS = true
+
+	msg, err := NewMessage(nil, []byte("From: sender@example.org\r\nTo: someone@example.net\r\n\r\nHi\r\n"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Relay(msg, "mx.elsewhere.example.com:25"); err != ErrRelayMXNotAllowed {
+		t.Errorf("Expected relaying to a host outside the policy to be refused, got: %v", err)
+	}
+}
+
+func TestFetchMTASTSInvalid(t *testing.T) {
+	client := &fakeHTTPClient{body: "version: STSv1\nmode: enforce\nmax_age: 600\n"}
+	if _, err := FetchMTASTS("invalid.example.net", client); err == nil {
+		t.Error("Expected an enforce policy without mx patterns to be rejected")
+	}
+}
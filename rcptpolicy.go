@@ -0,0 +1,29 @@
+package smtpd
+
+// Decision is what a Server.OpenRelayRecipientPolicy makes of a recipient
+type Decision int
+
+const (
+	// DecisionAccept takes the recipient
+	DecisionAccept Decision = iota
+	// DecisionReject turns the recipient away, authenticated or not
+	DecisionReject
+	// DecisionRequireAuth takes the recipient from authenticated clients only
+	DecisionRequireAuth
+)
+
+// recipientAllowed replies to a RCPT that the OpenRelayRecipientPolicy doesn't accept, and
+// reports whether the recipient may be added
+func (s *Server) recipientAllowed(conn *Conn, decision Decision) bool {
+	switch decision {
+	case DecisionReject:
+		s.reject(conn, PhaseRcpt, 550, s.response(ResponseRelayDenied, "5.7.1 relaying denied"))
+		return false
+	case DecisionRequireAuth:
+		if conn.User == nil {
+			s.reject(conn, PhaseRcpt, 530, s.response(ResponseAuthRequired, "5.7.0 authentication required"))
+			return false
+		}
+	}
+	return true
+}
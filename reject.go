@@ -0,0 +1,60 @@
+package smtpd
+
+// Phase is the point in the SMTP session where a message was turned away, see
+// Server.OnMessageRejected
+type Phase int
+
+const (
+	// PhaseConnect is before the greeting, like a client from a denied network
+	PhaseConnect Phase = iota
+	// PhaseMail is the MAIL command, the sender
+	PhaseMail
+	// PhaseRcpt is the RCPT command, a recipient
+	PhaseRcpt
+	// PhaseData is accepting and reading the message data, like the quota or size limit
+	PhaseData
+	// PhaseContent is the checks on the message itself, like required headers or body filters
+	PhaseContent
+	// PhaseHandler is the Handler or Store returning an error
+	PhaseHandler
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseConnect:
+		return "connect"
+	case PhaseMail:
+		return "mail"
+	case PhaseRcpt:
+		return "rcpt"
+	case PhaseData:
+		return "data"
+	case PhaseContent:
+		return "content"
+	case PhaseHandler:
+		return "handler"
+	}
+	return "unknown"
+}
+
+// reject lets OnMessageRejected know about a refusal, then sends it to the client
+func (s *Server) reject(conn *Conn, phase Phase, code int, reason string) {
+	if s.OnMessageRejected != nil {
+		s.OnMessageRejected(conn, phase, code, reason)
+	}
+	conn.WriteSMTP(code, reason)
+}
+
+// rejectError rejects with the code and text of an SMTPError, other errors get a 554 with the
+// fallback text
+func (s *Server) rejectError(conn *Conn, phase Phase, err error, fallback string) {
+	if err == ErrMessageSizeExceeded {
+		s.reject(conn, phase, ErrMessageSizeExceeded.Code, s.response(ResponseSizeExceeded, err.Error()))
+		return
+	}
+	if serr, ok := err.(SMTPError); ok {
+		s.reject(conn, phase, serr.Code, serr.Error())
+		return
+	}
+	s.reject(conn, phase, 554, fallback)
+}
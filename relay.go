@@ -0,0 +1,150 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// TLSPolicy controls whether mail relayed to a domain has to travel over an encrypted connection
+type TLSPolicy int
+
+const (
+	// TLSPolicyNone never attempts STARTTLS
+	TLSPolicyNone TLSPolicy = iota
+	// TLSPolicyOpportunistic upgrades to TLS when the upstream offers STARTTLS, without checking
+	// its certificate, which is the default for domains without a policy
+	TLSPolicyOpportunistic
+	// TLSPolicyRequire defers delivery unless the upstream offers STARTTLS with a certificate
+	// that verifies
+	TLSPolicyRequire
+)
+
+// TLSPolicyFor looks up the OutboundTLSPolicy for a recipient domain. Keys may be exact domains
+// or wildcards like "*.gov", which match any subdomain. Domains that aren't listed get the TLS
+// policy of their MTA-STS policy when MTASTS is set.
+func (s *Server) TLSPolicyFor(domain string) TLSPolicy {
+	policy, _ := s.outboundPolicy(domain)
+	return policy
+}
+
+// outboundPolicy is the TLSPolicy for a recipient domain, along with the MTA-STS policy it came
+// from, if it did
+func (s *Server) outboundPolicy(domain string) (TLSPolicy, *MTASTSPolicy) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if policy, ok := s.OutboundTLSPolicy[domain]; ok {
+		return policy, nil
+	}
+	for parent := domain; strings.Contains(parent, "."); {
+		parent = parent[strings.Index(parent, ".")+1:]
+		if policy, ok := s.OutboundTLSPolicy["*."+parent]; ok {
+			return policy, nil
+		}
+	}
+	if s.MTASTS {
+		if sts, err := s.MTASTSPolicy(domain); err != nil {
+			s.Logger.Println("MTA-STS policy lookup failed for", domain, err)
+		} else if sts != nil {
+			return sts.TLSPolicy(), sts
+		}
+	}
+	return TLSPolicyOpportunistic, nil
+}
+
+// Relay passes the message along to the SMTP server at addr, for forwarding setups. The strictest
+// TLS policy of all the recipient domains applies to the whole delivery. When TLS is required but
+// not offered, ErrRelayTLSRequired is returned so it can be handed back to the client as a deferral.
+func (s *Server) Relay(m *Message, addr string) error {
+	from := m.From
+	if m.Conn != nil && m.Conn.FromAddr != nil {
+		from = m.Conn.FromAddr
+	}
+	rcpt := m.Rcpt
+	if len(rcpt) == 0 {
+		rcpt = m.To
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	policy := TLSPolicyNone
+	for _, to := range rcpt {
+		domain := to.Address[strings.LastIndex(to.Address, "@")+1:]
+		p, sts := s.outboundPolicy(domain)
+		if p > policy {
+			policy = p
+		}
+		// an enforced MTA-STS policy names the only hosts the domain's mail may go to
+		if sts != nil && sts.Mode == MTASTSModeEnforce && !sts.MatchesMX(host) {
+			return ErrRelayMXNotAllowed
+		}
+	}
+
+	c, err := s.relayClient(addr, host, policy)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range rcpt {
+		if err := c.Rcpt(to.Address); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	// the DATA writer dot-stuffs the source again, so lines starting with a period arrive intact
+	if _, err := m.WriteTo(w); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// relayClient connects to the upstream at addr and greets it, upgrading to TLS as the policy
+// asks. Only TLSPolicyRequire verifies the certificate: opportunistic TLS is about keeping the
+// mail from being read on the way, and an upstream with a self-signed certificate is common
+// enough that turning it away would leave the mail undelivered rather than sent in the clear.
+// When the handshake fails altogether the opportunistic delivery starts over in plaintext.
+func (s *Server) relayClient(addr, host string, policy TLSPolicy) (*smtp.Client, error) {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Hello(s.ServerName); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if policy == TLSPolicyNone {
+		return c, nil
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		if policy == TLSPolicyRequire {
+			c.Close()
+			return nil, ErrRelayTLSRequired
+		}
+		return c, nil
+	}
+	config := &tls.Config{ServerName: host, InsecureSkipVerify: policy != TLSPolicyRequire}
+	if err := c.StartTLS(config); err != nil {
+		c.Close()
+		if policy == TLSPolicyRequire {
+			return nil, err
+		}
+		return s.relayClient(addr, host, TLSPolicyNone)
+	}
+	return c, nil
+}
@@ -0,0 +1,186 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"net/mail"
+	"testing"
+)
+
+const relayedMessage = `From: sender@example.org
+To: recipient@agency.gov
+Content-Type: text/plain
+
+This is the relayed body`
+
+func TestTLSPolicyFor(t *testing.T) {
+	server := NewServer(nil)
+	server.OutboundTLSPolicy = map[string]TLSPolicy{
+		"*.gov":       TLSPolicyRequire,
+		"example.com": TLSPolicyNone,
+	}
+
+	cases := map[string]TLSPolicy{
+		"agency.gov":           TLSPolicyRequire,
+		"mail.agency.gov":      TLSPolicyRequire,
+		"gov":                  TLSPolicyOpportunistic,
+		"EXAMPLE.com":          TLSPolicyNone,
+		"mail.example.com":     TLSPolicyOpportunistic,
+		"unlisted.example":     TLSPolicyOpportunistic,
+		"trailing.agency.gov.": TLSPolicyRequire,
+	}
+	for domain, want := range cases {
+		if got := server.TLSPolicyFor(domain); got != want {
+			t.Errorf("Wrong policy for %v, want: %v, got: %v", domain, want, got)
+		}
+	}
+}
+
+func TestRelayRequireTLSDefers(t *testing.T) {
+	// the upstream has no TLSConfig so it won't offer STARTTLS
+	upstreamRecorder := &MessageRecorder{}
+	upstream := NewServer(upstreamRecorder.Record)
+	go upstream.ListenAndServe("localhost:0")
+	defer upstream.Close()
+
+	WaitUntilAlive(upstream)
+
+	rcpt := []*mail.Address{{Address: "recipient@agency.gov"}}
+	msg, err := NewMessage(nil, []byte(relayedMessage), rcpt, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+
+	server := NewServer(nil)
+	server.OutboundTLSPolicy = map[string]TLSPolicy{"*.gov": TLSPolicyRequire}
+
+	if err := server.Relay(msg, upstream.Address()); err != ErrRelayTLSRequired {
+		t.Errorf("Expected delivery to be deferred with ErrRelayTLSRequired, got: %v", err)
+	}
+	if len(upstreamRecorder.Messages) != 0 {
+		t.Errorf("Expected nothing delivered upstream, got: %v messages", len(upstreamRecorder.Messages))
+	}
+
+	// without a policy the same delivery goes through in plaintext
+	server.OutboundTLSPolicy = nil
+	if err := server.Relay(msg, upstream.Address()); err != nil {
+		t.Fatalf("Expected opportunistic delivery to succeed, got: %v", err)
+	}
+	if len(upstreamRecorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message delivered upstream, got: %v", len(upstreamRecorder.Messages))
+	}
+}
+
+func TestRelayDotStuffing(t *testing.T) {
+	upstreamRecorder := &MessageRecorder{}
+	upstream := NewServer(upstreamRecorder.Record)
+	go upstream.ListenAndServe("localhost:0")
+	defer upstream.Close()
+
+	WaitUntilAlive(upstream)
+
+	body := "first line\r\n.leading period\r\n..two periods\r\n.\r\nlast line"
+	data := "From: sender@example.org\r\nTo: recipient@example.com\r\nContent-Type: text/plain\r\n\r\n" + body
+	rcpt := []*mail.Address{{Address: "recipient@example.com"}}
+	msg, err := NewMessage(nil, []byte(data), rcpt, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+
+	server := NewServer(nil)
+	if err := server.Relay(msg, upstream.Address()); err != nil {
+		t.Fatalf("Relay failed: %v", err)
+	}
+	if len(upstreamRecorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message delivered upstream, got: %v", len(upstreamRecorder.Messages))
+	}
+	if got := string(upstreamRecorder.Messages[0].RawBody); got != body {
+		t.Errorf("Body changed in transit, want: %q, got: %q", body, got)
+	}
+}
+
+func TestRelayAdditionalHeaders(t *testing.T) {
+	upstreamRecorder := &MessageRecorder{}
+	upstream := NewServer(upstreamRecorder.Record)
+	go upstream.ListenAndServe("localhost:0")
+	defer upstream.Close()
+
+	WaitUntilAlive(upstream)
+
+	// the trace a hook added on the way in goes along with the message
+	conn := &Conn{}
+	conn.AddInfoHeader("Received", "from client.example.com by mx.example.org")
+	data := "From: sender@example.org\r\nTo: recipient@example.com\r\n\r\nHello"
+	rcpt := []*mail.Address{{Address: "recipient@example.com"}}
+	msg, err := NewMessage(conn, []byte(data), rcpt, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+
+	server := NewServer(nil)
+	if err := server.Relay(msg, upstream.Address()); err != nil {
+		t.Fatalf("Relay failed: %v", err)
+	}
+	if len(upstreamRecorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message delivered upstream, got: %v", len(upstreamRecorder.Messages))
+	}
+	relayed := upstreamRecorder.Messages[0]
+	if got := relayed.Header.Get("Received"); got != "from client.example.com by mx.example.org" {
+		t.Errorf("Expected the Received header relayed, got: %q", got)
+	}
+	if got := string(relayed.RawBody); got != "Hello" {
+		t.Errorf("Body changed in transit, got: %q", got)
+	}
+}
+
+func TestRelayUntrustedCertificate(t *testing.T) {
+	// the upstream's certificate is self-signed, so it can't be verified
+	upstreamRecorder := &MessageRecorder{}
+	upstream := NewServer(upstreamRecorder.Record)
+	upstream.TLSConfig = TestingTLSConfig()
+	go upstream.ListenAndServe("localhost:0")
+	defer upstream.Close()
+
+	WaitUntilAlive(upstream)
+
+	rcpt := []*mail.Address{{Address: "recipient@agency.gov"}}
+	msg, err := NewMessage(nil, []byte(relayedMessage), rcpt, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+
+	// a required policy wants a certificate it can trust
+	server := NewServer(nil)
+	server.OutboundTLSPolicy = map[string]TLSPolicy{"*.gov": TLSPolicyRequire}
+	if err := server.Relay(msg, upstream.Address()); err == nil {
+		t.Error("Expected a required policy to refuse the untrusted certificate")
+	}
+	if len(upstreamRecorder.Messages) != 0 {
+		t.Fatalf("Expected nothing delivered upstream, got: %v messages", len(upstreamRecorder.Messages))
+	}
+
+	// an opportunistic one encrypts all the same
+	server.OutboundTLSPolicy = nil
+	if err := server.Relay(msg, upstream.Address()); err != nil {
+		t.Fatalf("Expected opportunistic delivery to succeed, got: %v", err)
+	}
+	if len(upstreamRecorder.Messages) != 1 || !upstreamRecorder.Messages[0].Conn.IsTLS {
+		t.Fatalf("Expected 1 message delivered upstream over TLS, got: %v", len(upstreamRecorder.Messages))
+	}
+
+	// and falls back to plaintext when the handshake fails outright
+	legacyRecorder := &MessageRecorder{}
+	legacy := NewServer(legacyRecorder.Record)
+	legacy.TLSConfig = TestingTLSConfig().Clone()
+	legacy.TLSConfig.MaxVersion = tls.VersionTLS10
+	go legacy.ListenAndServe("localhost:0")
+	defer legacy.Close()
+
+	WaitUntilAlive(legacy)
+
+	if err := server.Relay(msg, legacy.Address()); err != nil {
+		t.Fatalf("Expected delivery in plaintext after the failed handshake, got: %v", err)
+	}
+	if len(legacyRecorder.Messages) != 1 || legacyRecorder.Messages[0].Conn.IsTLS {
+		t.Fatalf("Expected 1 message delivered in plaintext, got: %v", len(legacyRecorder.Messages))
+	}
+}
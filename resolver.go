@@ -0,0 +1,84 @@
+package smtpd
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// DefaultReverseDNSTimeout is how long a client's PTR lookup may take when
+// Server.ReverseDNSTimeout isn't set
+const DefaultReverseDNSTimeout = time.Second * 5
+
+// Resolver is the part of *net.Resolver the server uses for DNS, so it can be swapped out
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+func (s *Server) resolver() Resolver {
+	if s.Resolver != nil {
+		return s.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// RemoteHostname is the name ClientIP points back to, its PTR record, without the trailing dot.
+// It is looked up the first time it's asked for and kept for the rest of the connection. It is
+// empty when the address has no name, the lookup fails or times out, or Server.DisableReverseDNS
+// is set.
+func (c *Conn) RemoteHostname() string {
+	c.remoteHostnameOnce.Do(func() {
+		s := c.server
+		ip := c.ClientIP()
+		if s == nil || s.DisableReverseDNS || ip == nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Context(), s.dnsTimeout())
+		defer cancel()
+
+		names, err := s.resolver().LookupAddr(ctx, ip.String())
+		if err != nil || len(names) == 0 {
+			if err != nil && s.Verbose {
+				s.Logger.Println(c.ID, "Reverse DNS lookup failed for", ip, err)
+			}
+			return
+		}
+		c.remoteHostname = strings.ToLower(strings.TrimSuffix(names[0], "."))
+	})
+	return c.remoteHostname
+}
+
+func (s *Server) dnsTimeout() time.Duration {
+	if s.ReverseDNSTimeout > 0 {
+		return s.ReverseDNSTimeout
+	}
+	return DefaultReverseDNSTimeout
+}
+
+// senderDomainResolves reports whether the domain of from has an MX record, or failing that an
+// address record mail could be delivered to instead, see https://tools.ietf.org/html/rfc5321#section-5.1.
+// The null sender (MAIL FROM:<>) has no domain and is let through.
+func (s *Server) senderDomainResolves(conn *Conn, from *mail.Address) bool {
+	at := strings.LastIndex(from.Address, "@")
+	if at < 0 {
+		return true
+	}
+	domain := from.Address[at+1:]
+
+	ctx, cancel := context.WithTimeout(conn.Context(), s.dnsTimeout())
+	defer cancel()
+
+	if mx, err := s.resolver().LookupMX(ctx, domain); err == nil && len(mx) > 0 {
+		return true
+	}
+	addrs, err := s.resolver().LookupHost(ctx, domain)
+	if err != nil && s.Verbose {
+		s.Logger.Println(conn.ID, "Sender domain lookup failed for", domain, err)
+	}
+	return err == nil && len(addrs) > 0
+}
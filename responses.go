@@ -0,0 +1,29 @@
+package smtpd
+
+// ResponseKey names one of the standard rejections whose text can be replaced through
+// Server.Responses. The reply code stays the same, only the text after it changes.
+type ResponseKey int
+
+const (
+	// ResponseSizeExceeded is the 552 for a message over MaxSize, "message size too large"
+	ResponseSizeExceeded ResponseKey = iota
+	// ResponseAuthRequired is the 530 for a command that needs an authenticated client,
+	// "Authentication required"
+	ResponseAuthRequired
+	// ResponseTooManyRecipients is the 452 for a RCPT past MaxRecipients, "4.5.3 too many recipients"
+	ResponseTooManyRecipients
+	// ResponseRelayDenied is the 550 for a recipient the OpenRelayRecipientPolicy turned away,
+	// "5.7.1 relaying denied"
+	ResponseRelayDenied
+	// ResponseAccessDenied is the 554 for a client outside the AllowedNetworks or in the
+	// DeniedNetworks, "5.7.1 access denied"
+	ResponseAccessDenied
+)
+
+// response is the text for a standard rejection, from Responses when it has one
+func (s *Server) response(key ResponseKey, fallback string) string {
+	if text, ok := s.Responses[key]; ok && text != "" {
+		return text
+	}
+	return fallback
+}
@@ -1,30 +1,45 @@
 package smtpd
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/mail"
+	"net/smtp"
+	"net/textproto"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 // MessageHandler functions handle application of business logic to the inbound message
 type MessageHandler func(m *Message) error
 
+// MessageStore keeps messages for a storage-centric server, see Server.Store
+type MessageStore interface {
+	Store(m *Message) (id string, err error)
+}
+
 type RcptHandler func(addresses []*mail.Address, conn *Conn, messageID string) (err error)
 
-// Default values
+// Default values. The read timeouts are the ones RFC 5321 asks servers to give clients, see
+// https://tools.ietf.org/html/rfc5321#section-4.5.3.2
 const (
-	DefaultReadTimeout        = time.Second * 10
+	DefaultReadTimeout        = time.Minute * 5
+	DefaultDataTimeout        = time.Minute * 10
 	DefaultWriteTimeout       = time.Second * 10
 	DefaultMessageSizeMax     = 131072
 	DefaultSessionCommandsMax = 100
+	DefaultEarlyTalkerWait    = time.Millisecond * 500
+	DefaultHeaderLinesMax     = 1000
 )
 
 // Server is an RFC2821/5321 compatible SMTP server
@@ -35,9 +50,14 @@ type Server struct {
 	ServerName string
 
 	// MaxSize of incoming message objects, zero for no cap otherwise
-	// larger messages are thrown away
+	// larger messages are thrown away. A client that goes on sending well past it (4 times
+	// MaxSize, at least 1MB) gets a 552 and is disconnected.
 	MaxSize int64
 
+	// TruncateOnMaxSize keeps messages over MaxSize instead of rejecting them. The body is cut off
+	// at MaxSize, the message is delivered with Truncated set and an "X-Truncated: true" header.
+	TruncateOnMaxSize bool
+
 	// MaxConn limits the number of concurrent connections being handled
 	MaxConn int
 
@@ -51,20 +71,89 @@ type Server struct {
 
 	OnRcpt RcptHandler
 
+	// OnMessageRejected is called whenever a message, or the client sending it, is turned away,
+	// with the phase it happened in and the reply the client got. Handy for logging and metrics
+	// in one place.
+	OnMessageRejected func(conn *Conn, phase Phase, code int, reason string)
+
+	// OpenRelayRecipientPolicy decides on each RCPT whether the recipient is taken, turned away
+	// or only taken from authenticated clients. It keeps the server from being an open relay
+	// while still accepting inbound mail, for instance by accepting local domains and requiring
+	// AUTH for anything else or past a few recipients (see conn.ToAddr). With Auth set, MAIL, RCPT
+	// and DATA have to be in PreAuthVerbsAllowed for unauthenticated clients to get this far.
+	OpenRelayRecipientPolicy func(conn *Conn, to *mail.Address) Decision
+
 	// Handler is the handoff function for messages
 	Handler MessageHandler
 
+	// TransformMessage is called with each message that passed the server's checks, before the
+	// Handler, to add headers like a spam score or authentication results. Headers added with
+	// Message.AddHeader end up in the Source too, so whatever stores the message keeps them.
+	// Returning an error rejects the message with it.
+	TransformMessage func(*Message) error
+
+	// EnhancedStatusCodes advertises ENHANCEDSTATUSCODES and has the reply accepting a message
+	// carry the queue id and its size, "250 2.0.0 Ok: queued as <id> (<n> bytes)", see
+	// https://tools.ietf.org/html/rfc2034
+	EnhancedStatusCodes bool
+
+	// Store, when set, takes each message after the Handler (if any) accepted it. The id it
+	// returns is given to the client in the reply, "250 2.0.0 Ok: queued as <id>".
+	Store MessageStore
+
 	// Auth is an authentication-handling extension
 	Auth Extension
 
+	// AllowReauth lets an authenticated client AUTH again, to switch identities. The previous
+	// identity is dropped before the new attempt, so a failed one leaves the client
+	// unauthenticated. Off by default, a second AUTH then gets a 503.
+	AllowReauth bool
+
+	// AllowPlaintextAuth offers and accepts the PLAIN and LOGIN mechanisms before STARTTLS, which
+	// sends credentials in the clear. Off by default, AUTH PLAIN/LOGIN then get a 538 until TLS is up.
+	AllowPlaintextAuth bool
+
+	// Responses replaces the text of standard rejections, like the 552 for a message that is too
+	// large, to localize or brand them. Keys that aren't set keep the default text.
+	Responses map[ResponseKey]string
+
+	// MaxRecipients caps the recipients of a single transaction, further RCPTs get a 452, zero
+	// for no cap
+	MaxRecipients int
+
+	// DeduplicateRecipients accepts a RCPT for an address the transaction already has without
+	// adding it again, so the message lists it once. Domains are compared ignoring case, local
+	// parts exactly.
+	DeduplicateRecipients bool
+
+	// RejectAllOnFirstBadRcpt ends the transaction at the first rejected RCPT, the rejection
+	// standing for the whole message and later RCPTs getting a 503 until a new MAIL. By default
+	// only that recipient is refused and the others still go through.
+	RejectAllOnFirstBadRcpt bool
+
 	// Extensions is a map of server-specific extensions & overrides, by verb
 	Extensions map[string]Extension
 
+	// Commands handles each verb the client may send, keyed by upper case verb. It starts out
+	// with the built-in verbs, add to it for proprietary commands or replace entries to change
+	// how a verb behaves. Extensions take precedence and are the way to also advertise a verb
+	// in the EHLO reply.
+	Commands map[string]CommandHandler
+
 	// Disabled features
 	Disabled map[string]bool
 
-	// Server meta
-	listener *net.Listener
+	// Server meta. listener is set once serving, Address and Close may read it from any goroutine.
+	listenerLock sync.Mutex
+	listener     net.Listener
+
+	// MTA-STS policies by domain, see MTASTSPolicy
+	mtastsLock     sync.Mutex
+	mtastsPolicies map[string]mtastsCacheEntry
+
+	// the extension lines of the EHLO reply, built on first use for clients before and after TLS
+	ehloLock  sync.Mutex
+	ehloLines [2][]string
 
 	// help message to display in response to a HELP request
 	Help string
@@ -75,10 +164,22 @@ type Server struct {
 
 	Verbose bool
 
-	// Timeout handlers
+	// Timeout handlers. ReadTimeout is how long to wait for the next command, NewServer starts
+	// them out at DefaultReadTimeout and DefaultWriteTimeout.
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 
+	// MaxWriteTime caps the time spent sending replies over the whole of a connection.
+	// WriteTimeout only limits each write, so a client reading a byte at a time could stall the
+	// server a little under it for every reply, over and over. Once the total goes past
+	// MaxWriteTime the connection is dropped. Zero for no cap.
+	MaxWriteTime time.Duration
+
+	// DataTimeout is how long the client may go without sending anything while transferring a
+	// message. It restarts whenever data arrives, so a slow but steady upload isn't cut off.
+	// NewServer sets DefaultDataTimeout, zero uses ReadTimeout.
+	DataTimeout time.Duration
+
 	// Ready is a channel that will receive a single `true` when the server has started
 	Ready chan bool
 
@@ -86,6 +187,100 @@ type Server struct {
 
 	// DiscardBody will read all message body text and discard it
 	DiscardBody bool
+
+	// HandlerTimeout is the longest the Handler may take before the client is told
+	// to try again later, zero for no limit. The Message's Context is cancelled then. The
+	// session goes on with the next transaction while the Handler winds down, so from then on
+	// it must not touch the Message's Conn.
+	HandlerTimeout time.Duration
+
+	// OutboundTLSPolicy sets per recipient domain TLS requirements for Relay, see TLSPolicyFor
+	OutboundTLSPolicy map[string]TLSPolicy
+
+	// MTASTS makes Relay honour the MTA-STS policies recipient domains publish, see
+	// https://tools.ietf.org/html/rfc8461, for the domains OutboundTLSPolicy doesn't list. An
+	// enforced policy requires TLS and an upstream that is one of its MX hosts. Policies are
+	// fetched with MTASTSClient, or an http.Client that doesn't follow redirects when nil.
+	MTASTS       bool
+	MTASTSClient HTTPClient
+
+	// WireTap, when set, sees every chunk of bytes read from or written to a client socket.
+	// Credentials sent with AUTH are replaced with [REDACTED].
+	// It is called from each connection's goroutine, so it must be safe for concurrent use.
+	WireTap func(conn *Conn, dir Direction, b []byte)
+
+	// RequireHeaders lists headers, like Date and From, that every message must carry
+	RequireHeaders []string
+
+	// LoopDetectionHeader names the header, Delivered-To by default, that marks a message as
+	// delivered to a recipient before. A message carrying it for one of its own recipients, or
+	// with more than MaxReceivedHops Received headers (when not zero), is rejected as a loop.
+	LoopDetectionHeader string
+	MaxReceivedHops     int
+
+	// MaxHeaderLines caps the lines in the header block of a message, the continuation lines of
+	// folded headers included. Messages over it get a 552 5.3.4, zero for no cap.
+	MaxHeaderLines int
+
+	// MaxBDATChunks caps the BDAT chunks a message can be sent in, so a client can't keep a
+	// transaction going with a flood of tiny ones. Over it the transaction gets a 552 5.3.4. Zero
+	// leaves it to MaxCommands, which caps the whole session.
+	MaxBDATChunks int
+
+	// RequireMinimalHeaders rejects DATA whose header block has none of From, Date, Subject or
+	// Content-Type, which weeds out scanners sending junk before the message is parsed
+	RequireMinimalHeaders bool
+
+	// BlockedAttachmentExtensions, like ".exe" or ".js", and BlockedAttachmentTypes, like
+	// "application/x-msdownload", turn away messages with such attachments with a 550 5.7.1. With
+	// StripBlockedAttachments the attachments are taken out of the message instead, their names
+	// listed in X-Attachment-Stripped headers.
+	BlockedAttachmentExtensions []string
+	BlockedAttachmentTypes      []string
+	StripBlockedAttachments     bool
+
+	// BodyFilters are checked in order against the decoded text and HTML bodies of each message,
+	// to reject it or tag it with a header
+	BodyFilters []BodyFilter
+
+	// PostDataDelay pauses before the final reply to DATA, which trips up spam bots that pipeline
+	// the whole transaction without waiting for replies
+	PostDataDelay time.Duration
+
+	// RejectEarlyTalkers drops clients that start talking before they've been greeted, which
+	// legitimate clients never do. The greeting is held back for EarlyTalkerWait to catch them.
+	RejectEarlyTalkers bool
+	EarlyTalkerWait    time.Duration
+
+	// CheckQuota is asked whether the client may store pendingBytes more, first with the SIZE
+	// declared on MAIL (when there is one) before accepting DATA, then with the actual size of
+	// the message once it's been read. Returning ErrMailboxFull defers the message.
+	CheckQuota func(conn *Conn, pendingBytes int64) error
+
+	// AllowedNetworks, when not empty, is the only set of client networks that are served.
+	// Clients in DeniedNetworks are always turned away.
+	AllowedNetworks []*net.IPNet
+	DeniedNetworks  []*net.IPNet
+
+	// MaxConcurrentHandlers caps how many connections are being handled at once, zero for no cap.
+	// Clients connecting beyond that are told to come back later with a 421.
+	MaxConcurrentHandlers int
+
+	// Resolver does the DNS lookups, like the client's PTR for Conn.RemoteHostname. Nil uses
+	// net.DefaultResolver.
+	Resolver Resolver
+	// DisableReverseDNS skips the PTR lookup of clients, Conn.RemoteHostname stays empty
+	DisableReverseDNS bool
+	// ReverseDNSTimeout limits the PTR lookup, DefaultReverseDNSTimeout when zero. It limits the
+	// lookups of RequireResolvableSenderDomain too.
+	ReverseDNSTimeout time.Duration
+	// RequireResolvableSenderDomain turns away MAIL FROM addresses whose domain has neither an MX
+	// nor an address record with a 450, a common sign of forged senders
+	RequireResolvableSenderDomain bool
+
+	// ConnState is called whenever a connection changes state, see the ConnState constants for
+	// the transitions. Like the other hooks it is called from the connection's goroutine.
+	ConnState func(conn *Conn, state ConnState)
 }
 
 // NewServer creates a server with the default settings
@@ -100,7 +295,7 @@ func NewServerWithLogger(handler func(*Message) error, logger *log.Logger) *Serv
 	if err != nil {
 		name = "localhost"
 	}
-	return &Server{
+	s := &Server{
 		Name:                name,
 		ServerName:          name,
 		MaxSize:             DefaultMessageSizeMax,
@@ -111,14 +306,40 @@ func NewServerWithLogger(handler func(*Message) error, logger *log.Logger) *Serv
 		Logger:              logger,
 		ReadTimeout:         DefaultReadTimeout,
 		WriteTimeout:        DefaultWriteTimeout,
+		DataTimeout:         DefaultDataTimeout,
 		Ready:               make(chan bool, 1),
 		PreAuthVerbsAllowed: []string{"AUTH", "EHLO", "HELO", "NOOP", "RSET", "QUIT", "STARTTLS"},
+		LoopDetectionHeader: "Delivered-To",
+		MaxHeaderLines:      DefaultHeaderLinesMax,
 	}
+	s.Commands = s.builtinCommands()
+	return s
 }
 
 // Close the server connection
 func (s *Server) Close() error {
-	return (*s.listener).Close()
+	listener := s.currentListener()
+	if listener == nil {
+		return nil
+	}
+	return listener.Close()
+}
+
+// setListener makes listener the one the server serves on, ErrAlreadyRunning when there is one
+func (s *Server) setListener(listener net.Listener) error {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	if s.listener != nil {
+		return ErrAlreadyRunning
+	}
+	s.listener = listener
+	return nil
+}
+
+func (s *Server) currentListener() net.Listener {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	return s.listener
 }
 
 // Greeting is a humanized response to EHLO to precede the list of available commands
@@ -133,6 +354,7 @@ func (s *Server) Extend(verb string, extension Extension) error {
 	}
 
 	s.Extensions[verb] = extension
+	s.resetEHLO()
 	return nil
 }
 
@@ -141,6 +363,7 @@ func (s *Server) Disable(verbs ...string) {
 	for _, verb := range verbs {
 		s.Disabled[strings.ToUpper(verb)] = true
 	}
+	s.resetEHLO()
 }
 
 // Enable server capabilities that have previously been disabled
@@ -148,6 +371,7 @@ func (s *Server) Enable(verbs ...string) {
 	for _, verb := range verbs {
 		s.Disabled[strings.ToUpper(verb)] = false
 	}
+	s.resetEHLO()
 }
 
 // UseTLS tries to enable TLS on the server (can also just explicitly set the TLSConfig)
@@ -182,7 +406,7 @@ func (s *Server) SetHelp(message string) error {
 // ListenAndServe starts listening for SMTP commands at the supplied TCP address
 func (s *Server) ListenAndServe(addr string) error {
 
-	if s.listener != nil {
+	if s.currentListener() != nil {
 		return ErrAlreadyRunning
 	}
 
@@ -197,11 +421,24 @@ func (s *Server) ListenAndServe(addr string) error {
 		s.Logger.Printf("Cannot listen on %v (%v)", addr, err)
 		return err
 	}
+	// set before Ready, so Address has it once the server is up
+	if err := s.setListener(listener); err != nil {
+		listener.Close()
+		return err
+	}
 	s.Ready <- true
 
+	return s.serve(listener)
+}
+
+// serve accepts connections on listener until it fails, handling each in its own goroutine
+func (s *Server) serve(listener net.Listener) error {
 	var clientID int64 = 1
 
-	s.listener = &listener
+	var handlerSlots chan struct{}
+	if s.MaxConcurrentHandlers > 0 {
+		handlerSlots = make(chan struct{}, s.MaxConcurrentHandlers)
+	}
 
 	// @TODO maintain a fixed-size connection pool, throw immediate 554s otherwise
 	// see http://www.greenend.org.uk/rjk/tech/smtpreplies.html
@@ -222,61 +459,503 @@ func (s *Server) ListenAndServe(addr string) error {
 			continue
 		}
 
-		c := &Conn{
-			ID:   NewMessageID(),
-			Conn: conn,
-			// TODO: implement ListenAndServeSSL for :465 servers
-			IsTLS:        false,
-			Errors:       []error{},
-			MaxSize:      s.MaxSize,
-			ReadTimeout:  s.ReadTimeout,
-			WriteTimeout: s.WriteTimeout,
-
-			Logger:      s.Logger,
-			server:      s,
-			DiscardBody: s.DiscardBody,
-		}
+		c := s.newConn(conn)
 
-		c.SetReadDeadline(time.Now().Add(s.ReadTimeout))
-		c.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+		if handlerSlots == nil {
+			go s.HandleSMTP(c)
+			clientID++
+			continue
+		}
 
-		go s.HandleSMTP(c)
+		select {
+		case handlerSlots <- struct{}{}:
+			go func() {
+				defer func() { <-handlerSlots }()
+				s.HandleSMTP(c)
+			}()
+		default:
+			s.Logger.Println(c.ID, "Too many concurrent connections, turning away", c.RemoteAddr())
+			go func() {
+				s.reject(c, PhaseConnect, 421, "4.3.2 too busy, try again later")
+				c.Close()
+			}()
+		}
 		clientID++
 
 	}
 }
 
+// newConn wraps a freshly accepted client connection
+func (s *Server) newConn(conn net.Conn) *Conn {
+	c := &Conn{
+		ID:   NewMessageID(),
+		Conn: conn,
+		// TODO: implement ListenAndServeSSL for :465 servers
+		IsTLS:        false,
+		Errors:       []error{},
+		MaxSize:      s.MaxSize,
+		ReadTimeout:  s.ReadTimeout,
+		WriteTimeout: s.WriteTimeout,
+		MaxWriteTime: s.MaxWriteTime,
+		DataTimeout:  s.DataTimeout,
+
+		MaxHeaderLines: s.MaxHeaderLines,
+
+		Logger:      s.Logger,
+		server:      s,
+		DiscardBody: s.DiscardBody,
+
+		TruncateOnMaxSize: s.TruncateOnMaxSize,
+	}
+
+	c.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	c.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	c.setState(StateNew)
+	return c
+}
+
 // Address retrieves the address of the server
 func (s *Server) Address() string {
-	if s.listener != nil {
-		return (*s.listener).Addr().String()
+	if listener := s.currentListener(); listener != nil {
+		return listener.Addr().String()
 	}
 	return ""
 }
 
-func (s *Server) handleMessage(m *Message) error {
-	return s.Handler(m)
+// SendTestMessage sends data to the running server in a whole SMTP session, MAIL, RCPT, DATA and
+// QUIT, for integration tests. A reply the server refuses with comes back as an SMTPError with
+// its code, like a 550 for a rejected recipient. STARTTLS and AUTH aren't done.
+func (s *Server) SendTestMessage(from string, to []string, data []byte) error {
+	c, err := smtp.Dial(s.Address())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Mail(from); err != nil {
+		return smtpReplyError(err)
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return smtpReplyError(err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return smtpReplyError(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return smtpReplyError(err)
+	}
+	return smtpReplyError(c.Quit())
+}
+
+// smtpReplyError makes an SMTPError of a reply net/smtp turned into an error
+func smtpReplyError(err error) error {
+	if reply, ok := err.(*textproto.Error); ok {
+		return SMTPError{reply.Code, errors.New(reply.Msg)}
+	}
+	return err
+}
+
+func (s *Server) handleMessage(m *Message) (string, error) {
+	if s.HandlerTimeout <= 0 {
+		return s.deliver(m)
+	}
+
+	// the handler keeps running in the background after a timeout, but the client is
+	// not kept waiting on it. Cancelling the context tells the handler to give up.
+	ctx, cancel := context.WithCancel(m.Context())
+	defer cancel()
+	m.ctx = ctx
+
+	type delivered struct {
+		id  string
+		err error
+	}
+	done := make(chan delivered, 1)
+	go func() {
+		id, err := s.deliver(m)
+		done <- delivered{id, err}
+	}()
+
+	select {
+	case d := <-done:
+		return d.id, d.err
+	case <-time.After(s.HandlerTimeout):
+		s.Logger.Println(m.Conn.ID, "Handler timed out after", s.HandlerTimeout)
+		return "", ErrHandlerTimeout
+	}
+}
+
+// deliver passes the message to the Handler and then the Store, whichever are set, returning
+// the queue id from the Store
+func (s *Server) deliver(m *Message) (string, error) {
+	if s.Handler != nil {
+		if err := s.Handler(m); err != nil {
+			return "", err
+		}
+	}
+	if s.Store != nil {
+		return s.Store.Store(m)
+	}
+	return "", nil
+}
+
+// peerAllowed checks the client IP against DeniedNetworks and AllowedNetworks
+func (s *Server) peerAllowed(conn *Conn) bool {
+	if len(s.AllowedNetworks) == 0 && len(s.DeniedNetworks) == 0 {
+		return true
+	}
+	ip := conn.ClientIP()
+	if ip == nil {
+		return len(s.AllowedNetworks) == 0
+	}
+	if ipInNetworks(ip, s.DeniedNetworks) {
+		return false
+	}
+	return len(s.AllowedNetworks) == 0 || ipInNetworks(ip, s.AllowedNetworks)
+}
+
+// ipInNetworks reports whether ip is in any of the networks. IPv4-mapped IPv6 addresses
+// (::ffff:192.0.2.1) match IPv4 networks, and IPv4 addresses match networks written in the
+// IPv4-mapped form (::ffff:192.0.2.0/120): net.IPNet.Contains takes the 4 byte form of both.
+func ipInNetworks(ip net.IP, networks []*net.IPNet) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkQuota consults CheckQuota, if set, about storing pendingBytes more for the client.
+// Errors that don't carry their own SMTP code become ErrMailboxFull.
+func (s *Server) checkQuota(conn *Conn, pendingBytes int64) error {
+	if s.CheckQuota == nil || pendingBytes <= 0 {
+		return nil
+	}
+	err := s.CheckQuota(conn, pendingBytes)
+	if err == nil {
+		return nil
+	}
+	s.Logger.Println(conn.ID, "Quota check failed for", pendingBytes, "bytes:", err)
+	if _, ok := err.(SMTPError); ok {
+		return err
+	}
+	return ErrMailboxFull
+}
+
+// checkRequiredHeaders makes sure the message has all of the RequireHeaders
+func (s *Server) checkRequiredHeaders(m *Message) error {
+	for _, name := range s.RequireHeaders {
+		if _, ok := m.Header[textproto.CanonicalMIMEHeaderKey(name)]; !ok {
+			return NewError(550, fmt.Sprintf("5.6.0 message missing required header %v", name))
+		}
+	}
+	return nil
+}
+
+// checkLoop turns away messages that already carry a LoopDetectionHeader for one of their
+// recipients, or that went through more than MaxReceivedHops servers
+func (s *Server) checkLoop(m *Message) error {
+	if s.LoopDetectionHeader != "" {
+		for _, value := range m.Header[textproto.CanonicalMIMEHeaderKey(s.LoopDetectionHeader)] {
+			delivered := strings.Trim(strings.TrimSpace(value), "<>")
+			for _, rcpt := range m.Rcpt {
+				if strings.EqualFold(delivered, rcpt.Address) {
+					return ErrRoutingLoop
+				}
+			}
+		}
+	}
+	if s.MaxReceivedHops > 0 && len(m.Header["Received"]) > s.MaxReceivedHops {
+		return ErrRoutingLoop
+	}
+	return nil
+}
+
+// ehloExtensions returns the extension lines of the EHLO reply, ready to be written. They only
+// depend on the server settings and whether the client is on TLS, so they are built once for
+// each and reused. Extend, Disable and Enable start over, other settings changed after the
+// first EHLO aren't picked up.
+func (s *Server) ehloExtensions(conn *Conn) []string {
+	variant := 0
+	if conn.IsTLS {
+		variant = 1
+	}
+
+	s.ehloLock.Lock()
+	defer s.ehloLock.Unlock()
+	if s.ehloLines[variant] != nil {
+		return s.ehloLines[variant]
+	}
+
+	lines := []string{fmt.Sprintf("250-SIZE %v", s.MaxSize)}
+	if !s.Disabled["BDAT"] {
+		lines = append(lines, "250-CHUNKING", "250-BINARYMIME")
+	}
+	if s.EnhancedStatusCodes {
+		lines = append(lines, "250-ENHANCEDSTATUSCODES")
+	}
+	if !conn.IsTLS && s.TLSConfig != nil {
+		lines = append(lines, "250-STARTTLS")
+	}
+	if s.Auth != nil {
+		if mechanisms := s.authMechanisms(conn); mechanisms != "" {
+			lines = append(lines, fmt.Sprintf("250-AUTH %v", mechanisms))
+		}
+	}
+	verbs := make([]string, 0, len(s.Extensions))
+	for verb := range s.Extensions {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+	for _, verb := range verbs {
+		lines = append(lines, fmt.Sprintf("250-%v %v", verb, s.Extensions[verb].EHLO()))
+	}
+
+	s.ehloLines[variant] = lines
+	return lines
+}
+
+func (s *Server) resetEHLO() {
+	s.ehloLock.Lock()
+	s.ehloLines = [2][]string{}
+	s.ehloLock.Unlock()
+}
+
+// authMechanisms lists the AUTH mechanisms to advertise, leaving out the ones that would send
+// credentials in the clear unless that's allowed
+func (s *Server) authMechanisms(conn *Conn) string {
+	mechanisms := strings.Fields(s.Auth.EHLO())
+	if conn.plaintextAuthAllowed() {
+		return strings.Join(mechanisms, " ")
+	}
+	var offered []string
+	for _, mechanism := range mechanisms {
+		if !isPlaintextMechanism(mechanism) {
+			offered = append(offered, mechanism)
+		}
+	}
+	return strings.Join(offered, " ")
+}
+
+// isPlaintextMechanism reports whether the AUTH arguments ask for PLAIN or LOGIN
+func isPlaintextMechanism(args string) bool {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return false
+	}
+	mechanism := strings.ToUpper(fields[0])
+	return mechanism == "PLAIN" || mechanism == "LOGIN"
+}
+
+// readyForData runs the checks due before message data is accepted, that some recipient was
+// accepted, the OnRcpt hook and the quota for the declared SIZE, replying to the client when one
+// of them fails
+func (s *Server) readyForData(conn *Conn, messageID string) bool {
+	if len(conn.ToAddr) == 0 {
+		// no RCPT was given, or every one of them was refused
+		s.reject(conn, PhaseData, 554, "5.5.1 no valid recipients")
+		return false
+	}
+	if s.OnRcpt != nil {
+		err := s.OnRcpt(conn.ToAddr, conn, messageID)
+		if conn.wasAborted() {
+			return false
+		}
+		if err != nil {
+			s.rejectError(conn, PhaseRcpt, err, fmt.Sprintf("DATA Error: %v", err))
+			return false
+		}
+	}
+
+	if err := s.checkQuota(conn, conn.DeclaredSize); err != nil {
+		s.rejectError(conn, PhaseData, err, err.Error())
+		return false
+	}
+	return true
+}
+
+// acceptMessage turns the message data of a transaction, sent with DATA or BDAT, into a
+// Message and hands it to the handler, replying to the client either way
+func (s *Server) acceptMessage(conn *Conn, messageID, data string) {
+	if s.RequireMinimalHeaders && !hasMinimalHeaders(data) {
+		conn.EndTX()
+		s.Logger.Println(conn.ID, "Rejected msg: not a valid message")
+		s.reject(conn, PhaseContent, 550, "5.6.0 not a valid message")
+		return
+	}
+
+	// handle this later
+	message, err := NewMessage(conn, []byte(data), conn.ToAddr, s.Logger)
+
+	closeTransErr := conn.EndTX()
+	if closeTransErr != nil {
+		e := fmt.Sprintf("Error closing conn tx: %s", err.Error())
+		s.Logger.Println(conn.ID, e)
+		s.rejectError(conn, PhaseData, err, e)
+		return
+	}
+	if err != nil {
+		e := fmt.Sprintf("Error create msg: %s", err.Error())
+		s.Logger.Println(conn.ID, e)
+		s.rejectError(conn, PhaseContent, err, e)
+		return
+	}
+
+	if conn.truncated {
+		message.Truncated = true
+		message.AddHeader("X-Truncated", "true")
+	}
+
+	if err := s.checkQuota(conn, int64(len(data))); err != nil {
+		s.rejectError(conn, PhaseData, err, err.Error())
+		return
+	}
+
+	if err := s.checkRequiredHeaders(message); err != nil {
+		s.Logger.Println(conn.ID, "Rejected msg:", err)
+		s.rejectError(conn, PhaseContent, err, err.Error())
+		return
+	}
+
+	if err := s.checkLoop(message); err != nil {
+		s.Logger.Println(conn.ID, "Rejected msg:", err)
+		s.rejectError(conn, PhaseContent, err, err.Error())
+		return
+	}
+
+	if err := s.applyBodyFilters(message); err != nil {
+		s.Logger.Println(conn.ID, "Rejected msg by body filter:", err)
+		s.rejectError(conn, PhaseContent, err, err.Error())
+		return
+	}
+
+	if err := s.checkAttachments(message); err != nil {
+		s.Logger.Println(conn.ID, "Rejected msg with blocked attachment")
+		s.rejectError(conn, PhaseContent, err, err.Error())
+		return
+	}
+
+	message.MessageID = messageID
+	if s.TransformMessage != nil {
+		if err := s.TransformMessage(message); err != nil {
+			s.Logger.Println(conn.ID, "Rejected msg by TransformMessage:", err)
+			s.rejectError(conn, PhaseContent, err, err.Error())
+			return
+		}
+	}
+
+	queueID, err := s.handleMessage(message)
+	if err != nil {
+		e := fmt.Sprintf("Error handling msg: %s", err.Error())
+		s.Logger.Println(conn.ID, e)
+		s.rejectError(conn, PhaseHandler, err, e)
+		return
+	}
+
+	if s.PostDataDelay > 0 {
+		time.Sleep(s.PostDataDelay)
+	}
+	if message.AcceptReply != "" {
+		conn.WriteSMTP(250, message.AcceptReply)
+		return
+	}
+	if s.EnhancedStatusCodes {
+		if queueID == "" {
+			queueID = message.MessageID
+		}
+		conn.WriteSMTP(250, fmt.Sprintf("2.0.0 Ok: queued as %v (%v bytes)", queueID, len(data)))
+		return
+	}
+	if queueID != "" {
+		conn.WriteSMTP(250, fmt.Sprintf("2.0.0 Ok: queued as %v", queueID))
+		return
+	}
+	conn.WriteSMTP(250, fmt.Sprintf("OK : queued as %v", message.MessageID))
+}
+
+// hasMinimalHeaders reports whether the header block of data has at least one of the headers
+// any real message carries
+func hasMinimalHeaders(data string) bool {
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			break
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			continue
+		}
+		switch textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:i])) {
+		case "From", "Date", "Subject", "Content-Type":
+			return true
+		}
+	}
+	return false
 }
 
 // HandleSMTP handles a single SMTP request
 func (s *Server) HandleSMTP(conn *Conn) error {
 	defer conn.Close()
+
+	if !s.peerAllowed(conn) {
+		s.Logger.Println(conn.ID, "Client network not allowed", conn.ClientIP())
+		s.reject(conn, PhaseConnect, 554, s.response(ResponseAccessDenied, "5.7.1 access denied"))
+		return nil
+	}
+
+	if s.RejectEarlyTalkers {
+		wait := s.EarlyTalkerWait
+		if wait <= 0 {
+			wait = DefaultEarlyTalkerWait
+		}
+		if conn.talksWithin(wait) {
+			s.Logger.Println(conn.ID, "Client sent data before the greeting", conn.RemoteAddr())
+			s.reject(conn, PhaseConnect, 554, "5.5.0 SMTP protocol violation")
+			return nil
+		}
+	}
+
+	if s.Verbose {
+		s.Logger.Println(conn.ID, "Connection from", conn.ClientIP(), conn.RemoteHostname())
+	}
+
 	conn.WriteSMTP(220, fmt.Sprintf("%v %v", s.Name, time.Now().Format(time.RFC1123Z)))
 
+	commands := s.Commands
+	if commands == nil {
+		commands = s.builtinCommands()
+	}
+
 ReadLoop:
 	for i := 0; i < s.MaxCommands; i++ {
 
 		var verb, args string
 		var err error
 
+		conn.setState(StateIdle)
 		if verb, args, err = conn.ReadSMTP(); err != nil {
 			if err == io.EOF {
 				// client closed the connection already
 				break ReadLoop
 			}
-			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-				s.Logger.Println(conn.ID, "Client timed out", neterr)
-				// too slow, timeout
+			if conn.writeStalled {
+				s.Logger.Println(conn.ID, "Client too slow reading replies, dropped after", conn.writeTime)
+				break ReadLoop
+			}
+			if err == ErrReadTimeout {
+				s.Logger.Println(conn.ID, "Client timed out")
+				// too slow, let the client know why before hanging up
+				conn.WriteSMTP(ErrReadTimeout.Code, ErrReadTimeout.Error())
 				break ReadLoop
 			}
 			if err.Error() == io.ErrNoProgress.Error() {
@@ -288,8 +967,11 @@ ReadLoop:
 			return err
 		}
 
+		conn.setState(StateActive)
+		conn.aborted = false
+
 		if s.Verbose {
-			s.Logger.Printf("%v CLIENT: %v %v", conn.ID, verb, args)
+			s.Logger.Printf("%v CLIENT: %v %v", conn.ID, verb, redactArgs(verb, args))
 		}
 
 		// Always check for disabled features first
@@ -316,7 +998,7 @@ ReadLoop:
 				continue
 			default:
 				// conn.WriteSMTP(250, fmt.Sprintf("AUTH %v", s.Auth.EHLO()))
-				conn.WriteSMTP(530, "Authentication required")
+				conn.WriteSMTP(530, s.response(ResponseAuthRequired, "Authentication required"))
 				continue
 			}
 		}
@@ -330,232 +1012,21 @@ ReadLoop:
 			continue
 		}
 
-		switch verb {
-		// https://tools.ietf.org/html/rfc2821#section-4.1.1.1
-		case "HELO":
-			conn.WriteSMTP(250, fmt.Sprintf("%v Hello", s.ServerName))
-		case "EHLO":
-			// see: https://tools.ietf.org/html/rfc2821#section-4.1.4
-			conn.Reset()
-
-			conn.WriteEHLO(fmt.Sprintf("%v %v", s.ServerName, s.Greeting(conn)))
-			conn.WriteEHLO(fmt.Sprintf("SIZE %v", s.MaxSize))
-			if !conn.IsTLS && s.TLSConfig != nil {
-				conn.WriteEHLO("STARTTLS")
-			}
-			if conn.User == nil && s.Auth != nil {
-				conn.WriteEHLO(fmt.Sprintf("AUTH %v", s.Auth.EHLO()))
-			}
-			for verb, extension := range s.Extensions {
-				conn.WriteEHLO(fmt.Sprintf("%v %v", verb, extension.EHLO()))
-			}
-			conn.WriteSMTP(250, "HELP")
-		case "NAME":
-			conn.ClientHostname = strings.ToLower(args)
-		// The MAIL command starts off a new mail transaction
-		// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.2
-		// This doesn't implement the RFC4594 addition of an AUTH param to the MAIL command
-		// see: http://tools.ietf.org/html/rfc4954#section-3 for details
-		case "MAIL":
-			// clear to/from but must not clear auth
-			conn.ResetBuffers()
-			if from, err := s.GetAddressArg("FROM", args); err == nil {
-				if conn.User == nil || conn.User.IsUser(from.Address) {
-					if err := conn.StartTX(from); err == nil {
-						conn.WriteSMTP(250, "Accepted")
-					} else {
-						conn.WriteSMTP(501, err.Error())
-					}
-				} else {
-					conn.WriteSMTP(501, fmt.Sprintf("Cannot send mail as %v", from))
-				}
-			} else {
-				conn.WriteSMTP(501, err.Error())
-			}
-		// https://tools.ietf.org/html/rfc2821#section-4.1.1.3
-		case "RCPT":
-			if to, err := s.GetAddressArg("TO", args); err == nil {
-				conn.ToAddr = append(conn.ToAddr, to)
-				conn.WriteSMTP(250, "Accepted")
-			} else {
-				conn.WriteSMTP(501, err.Error())
-			}
-		// https://tools.ietf.org/html/rfc2821#section-4.1.1.4
-		case "DATA":
-			passedRCPT := true
-			messageID := NewMessageID()
-
-			if len(conn.ToAddr) > 0 && s.OnRcpt != nil {
-				err := s.OnRcpt(conn.ToAddr, conn, messageID)
-				if err != nil {
-					passedRCPT = false
-					if serr, ok := err.(SMTPError); ok {
-						conn.WriteSMTP(serr.Code, serr.Error())
-					} else {
-						conn.WriteSMTP(554, fmt.Sprintf("DATA Error: %v", err))
-					}
-				}
-			}
-
-			if passedRCPT {
-				conn.WriteSMTP(354, "Enter message, ending with \".\" on a line by itself")
-				data, err := conn.ReadData()
-				if err != nil {
-					e := fmt.Sprintf("Error DATA read: %s", err.Error())
-					s.Logger.Println(conn.ID, e)
-					if serr, ok := err.(SMTPError); ok {
-						conn.WriteSMTP(serr.Code, serr.Error())
-					} else {
-						conn.WriteSMTP(554, e)
-					}
-					continue
-				}
-				// handle this later
-				message, err := NewMessage(conn, []byte(data), conn.ToAddr, s.Logger)
-
-				closeTransErr := conn.EndTX()
-				if closeTransErr != nil {
-					e := fmt.Sprintf("Error closing conn tx: %s", err.Error())
-					s.Logger.Println(conn.ID, e)
-					if serr, ok := err.(SMTPError); ok {
-						conn.WriteSMTP(serr.Code, serr.Error())
-					} else {
-						conn.WriteSMTP(554, e)
-					}
-					continue
-				}
-				if err != nil {
-					e := fmt.Sprintf("Error create msg: %s", err.Error())
-					s.Logger.Println(conn.ID, e)
-					if serr, ok := err.(SMTPError); ok {
-						conn.WriteSMTP(serr.Code, serr.Error())
-					} else {
-						conn.WriteSMTP(554, e)
-					}
-					continue
-				}
-
-				message.MessageID = messageID
-				err = s.handleMessage(message)
-				if err != nil {
-					e := fmt.Sprintf("Error handling msg: %s", err.Error())
-					s.Logger.Println(conn.ID, e)
-					if serr, ok := err.(SMTPError); ok {
-						conn.WriteSMTP(serr.Code, serr.Error())
-					} else {
-						conn.WriteSMTP(554, e)
-					}
-					continue
-				}
-
-				conn.WriteSMTP(250, fmt.Sprintf("OK : queued as %v", message.MessageID))
-			}
-		// Reset the connection
-		// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.5
-		case "RSET":
-			conn.Reset()
-			conn.WriteOK()
-
-		// Since this is a commonly abused SPAM aid, it's better to just
-		// default to 252 (apparent validity / could not verify). If this is not a concern, then
-		// the full `params` value will be the address to verify, respond with `conn.WriteOK()`
-		// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.6
-		case "VRFY":
-			conn.WriteSMTP(252, "But it was worth a shot, right?")
-
-		// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.7
-		case "EXPN":
-			conn.WriteSMTP(252, "Maybe, maybe not")
-
-		// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.8
-		case "HELP":
-			msg := fmt.Sprintf("contact the owner of %v for more information", s.ServerName)
-			if s.Help != "" {
-				msg = s.Help
-			}
-			conn.WriteSMTP(214, msg)
-
-		// NOOP doesn't do anything. Big surprise
-		// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.9
-		case "NOOP":
-			conn.WriteOK()
-
-		// Say goodbye and close the connection
-		// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.10
-		case "QUIT":
-			conn.WriteSMTP(221, "Bye")
-			break ReadLoop
-
-		// https://tools.ietf.org/html/rfc2487
-		case "STARTTLS":
-
-			if s.TLSConfig == nil {
-				conn.WriteSMTP(454, "TLS is not available on this server")
-				continue
-			}
-
-			conn.WriteSMTP(220, "Ready to start TLS")
-
-			// upgrade to TLS
-			tlsConn := tls.Server(conn, s.TLSConfig)
-			if tlsConn == nil {
-				s.Logger.Println(conn.ID, "Error during TLS upgrade")
-				break ReadLoop
-			}
-
-			tlsConn.SetDeadline(time.Now().Add(s.WriteTimeout))
-			if err := tlsConn.Handshake(); err == nil {
-				newID := NewMessageID()
-				if conn.server.Verbose {
-					s.Logger.Printf("Upgraded TLS. Changed pre-TLS connection ID from %v to %v", conn.ID, newID)
-				}
-				conn = &Conn{
-					ID:                newID,
-					Conn:              tlsConn,
-					IsTLS:             true,
-					User:              conn.User,
-					Errors:            conn.Errors,
-					MaxSize:           conn.MaxSize,
-					ReadTimeout:       s.ReadTimeout,
-					WriteTimeout:      s.WriteTimeout,
-					AdditionalHeaders: conn.AdditionalHeaders,
-					ForwardedForIP:    conn.ForwardedForIP,
-
-					Logger: s.Logger,
-					server: s,
-				}
-			} else {
-				s.Logger.Println(conn.ID, "Could not TLS handshake: ", err)
-				break ReadLoop
-			}
-
-		// AUTH uses the configured authentication handler to perform an SMTP-AUTH
-		// as defined by the ESMTP AUTH extension
-		// see: http://tools.ietf.org/html/rfc4954
-		case "AUTH":
-			if conn.User != nil {
-				conn.WriteSMTP(503, "You are already authenticated")
-			} else if s.Auth != nil {
-				if err := s.Auth.Handle(conn, args); err != nil {
-					if serr, ok := err.(SMTPError); ok {
-						conn.WriteSMTP(serr.Code, serr.Error())
-					} else {
-						conn.WriteSMTP(500, "Authentication failed")
-					}
-				} else {
-					conn.WriteSMTP(235, "Authentication succeeded")
-				}
-			} else {
-				conn.WriteSMTP(502, "Command not implemented")
-			}
-		default:
+		handler, ok := commands[verb]
+		if !ok {
 			conn.WriteSMTP(500, "Syntax error, command unrecognised")
 			conn.Errors = append(conn.Errors, fmt.Errorf("bad input: %v %v", verb, args))
 			if len(conn.Errors) > 3 {
 				conn.WriteSMTP(500, "Too many unrecognized commands")
 				break ReadLoop
 			}
-
+			continue
+		}
+		if err := handler(conn, args); err != nil {
+			if err != ErrCloseSession {
+				s.Logger.Println(conn.ID, "Closing session after", verb, err)
+			}
+			break ReadLoop
 		}
 	}
 
@@ -565,24 +1036,65 @@ ReadLoop:
 
 var pathRegex = regexp.MustCompile(`<([^@>]+@[^@>]+)>`)
 
-// GetAddressArg extracts the address value from a supplied SMTP argument
-// for handling MAIL FROM:address@example.com and RCPT TO:address@example.com
-// XXX: don't like this, feels like a hack
+// GetAddressArg extracts the address value from a supplied SMTP argument. The argument name is
+// matched case-insensitively and the address may come with or without angle brackets, so
+// "TO:<a@b>", "to: <a@b>" and "TO:a@b" are all understood.
 func (s *Server) GetAddressArg(argName string, args string) (*mail.Address, error) {
 	argSplit := strings.SplitN(args, ":", 2)
-	if len(argSplit) == 2 && strings.ToUpper(argSplit[0]) == argName {
+	if len(argSplit) == 2 && strings.EqualFold(strings.TrimSpace(argSplit[0]), argName) {
+		value := strings.TrimSpace(argSplit[1])
 
-		path := pathRegex.FindString(argSplit[1])
-		if path == "" {
-			return nil, fmt.Errorf("couldnt find valid FROM path in %v", argSplit[1])
+		path := pathRegex.FindString(value)
+		if fields := strings.Fields(value); path == "" && len(fields) > 0 && strings.Contains(fields[0], "@") {
+			// a bare address, possibly followed by parameters
+			path = fields[0]
+		}
+		if path != "" {
+			if err := ValidateEnvelopeAddress(path); err != nil {
+				return nil, err
+			}
+			return mail.ParseAddress(path)
 		}
 
-		return mail.ParseAddress(path)
+		return nil, fmt.Errorf("couldnt find valid %v path in %v", argName, argSplit[1])
 	}
 
 	return nil, fmt.Errorf("Bad arguments")
 }
 
+// bodyTypeSupported reports whether a BODY given with MAIL can be taken, see
+// https://tools.ietf.org/html/rfc6152 and https://tools.ietf.org/html/rfc3030#section-3
+func (s *Server) bodyTypeSupported(bodyType string) bool {
+	switch bodyType {
+	case "", "7BIT", "8BITMIME":
+		return true
+	case "BINARYMIME":
+		return !s.Disabled["BDAT"]
+	}
+	return false
+}
+
+// mailParams extracts the ESMTP parameters following the path in a MAIL or RCPT argument,
+// like SIZE=1024, keyed by upper case name. Parameters without a value map to "".
+func mailParams(args string) map[string]string {
+	params := make(map[string]string)
+	rest := args
+	if i := strings.LastIndex(args, ">"); i >= 0 {
+		rest = args[i+1:]
+	} else if fields := strings.Fields(args); len(fields) > 0 {
+		rest = strings.Join(fields[1:], " ")
+	}
+	for _, param := range strings.Fields(rest) {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = kv[1]
+		} else {
+			params[strings.ToUpper(kv[0])] = ""
+		}
+	}
+	return params
+}
+
 func stringInList(s string, allowed []string) bool {
 	for _, a := range allowed {
 		if a == s {
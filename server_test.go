@@ -1,9 +1,20 @@
 package smtpd
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
+	"io"
+	"log"
 	"math/rand"
+	"net"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -37,50 +48,17 @@ func TestSMTPServer(t *testing.T) {
 
 	WaitUntilAlive(server)
 
-	// Connect to the remote SMTP server.
-	c, err := smtp.Dial(server.Address())
-	if err != nil {
-		t.Errorf("Should be able to dial localhost: %v", err)
-	}
-
-	// Set the sender and recipient first
-	if err := c.Mail("sender@example.org"); err != nil {
-		t.Errorf("Should be able to set a sender: %v", err)
-	}
-	if err := c.Rcpt("recipient@example.net"); err != nil {
-		t.Errorf("Should be able to set a RCPT: %v", err)
-	}
-
-	if err := c.Rcpt("bcc@example.net"); err != nil {
-		t.Errorf("Should be able to set a second RCPT: %v", err)
-	}
-
-	// Send the email body.
-	wc, err := c.Data()
-	if err != nil {
-		t.Errorf("Error creating the data body: %v", err)
-	}
-
 	var emailBody = "This is the email body"
 
-	_, err = fmt.Fprintf(wc, `From: sender@example.org
+	err := server.SendTestMessage("sender@example.org", []string{"recipient@example.net", "bcc@example.net"}, []byte(fmt.Sprintf(`From: sender@example.org
 To: recipient@example.net
 Content-Type: text/html
 
-%s`, emailBody)
+%s`, emailBody)))
 	if err != nil {
-		t.Errorf("Error writing email: %v", err)
-	}
-
-	if err := wc.Close(); err != nil {
 		t.Error(err)
 	}
 
-	// Send the QUIT command and close the connection.
-	if err := c.Quit(); err != nil {
-		t.Errorf("Server wouldn't accept QUIT: %v", err)
-	}
-
 	if len(recorder.Messages) != 1 {
 		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
 	}
@@ -105,10 +83,11 @@ Content-Type: text/html
 }
 
 func TestSMTPServerLargeMessage(t *testing.T) {
-	// sends message that is over the allowed length. Expects "connection reset by peer" from server
+	// sends message that is over the allowed length. Expects the whole message to be read and
+	// a 552 reply, with the session still usable afterwards
 	bodySizeKB := 500
 	bodySize := bodySizeKB * 1024
-	emailBody := "This is the email body" + RandStringBytes(bodySize) + "\n.\n"
+	emailBody := "This is the email body" + RandStringBytes(bodySize) + "\n"
 	recorder := &MessageRecorder{}
 	server := NewServer(recorder.Record)
 	server.Verbose = true
@@ -121,7 +100,7 @@ func TestSMTPServerLargeMessage(t *testing.T) {
 	// Connect to the remote SMTP server.
 	c, err := smtp.Dial(server.Address())
 	if err != nil {
-		t.Errorf("Should be able to dial localhost: %v", err)
+		t.Fatalf("Should be able to dial localhost: %v", err)
 	}
 
 	// Set the sender and recipient first
@@ -135,30 +114,244 @@ func TestSMTPServerLargeMessage(t *testing.T) {
 	// Send the email body.
 	wc, err := c.Data()
 	if err != nil {
-		t.Errorf("Error creating the data body: %v", err)
+		t.Fatalf("Error creating the data body: %v", err)
 	}
-	// write until overloading
-	var written int
-	for err == nil {
-		written, err = fmt.Fprintf(wc, `From: sender@example.org
+	_, err = fmt.Fprintf(wc, `From: sender@example.org
 To: recipient@example.net
 Content-Type: text/html
 
 %v`, emailBody)
-		t.Log("written bytes", written)
+	if err != nil {
+		t.Fatalf("Expected the whole message to be read, got: %v", err)
+	}
+	err = wc.Close()
+	if perr, ok := err.(*textproto.Error); !ok || perr.Code != 552 {
+		t.Fatalf("Expected a 552 for the large message, got: %v", err)
+	}
+
+	if err := c.Reset(); err != nil {
+		t.Errorf("Expected the session to carry on after the 552: %v", err)
+	}
+	if len(recorder.Messages) != 0 {
+		t.Errorf("Expected nothing delivered, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerDrainOnReject(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.MaxSize = 1024
+	server.BodyFilters = []BodyFilter{{Pattern: regexp.MustCompile("forbidden")}}
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	body := strings.Repeat("0123456789\r\n", 2000)
+
+	// too large, the rest of the message isn't taken for commands
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	expectReply(t, c, 552, "From: sender@example.org\r\n\r\n%v.", body)
+	expectReply(t, c, 250, "NOOP")
+
+	// the same in a BDAT chunk, after which the transaction is over
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 552, "BDAT %v\r\n%v", len(body)+2, body)
+	expectReply(t, c, 503, "BDAT 6 LAST\r\nbody")
+
+	// rejected for its content
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	expectReply(t, c, 550, "From: sender@example.org\r\nContent-Type: text/plain\r\n\r\nforbidden\r\n%v.", body[:480])
+	expectReply(t, c, 250, "NOOP")
+
+	if len(recorder.Messages) != 0 {
+		t.Errorf("Expected nothing delivered, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerDrainLimit(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.MaxSize = 1024
+	flood := strings.Repeat("0123456789\r\n", 200000)
+
+	t.Run("DATA", func(t *testing.T) {
+		c, _ := pipeSession(server)
+		defer c.Close()
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("Expected greeting: %v", err)
+		}
+		expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+		expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+		expectReply(t, c, 354, "DATA")
+
+		// a message that never ends is read so far, then the client is cut off
+		go func() {
+			c.W.WriteString("From: sender@example.org\r\n\r\n")
+			c.W.WriteString(flood)
+			c.W.Flush()
+		}()
+		if _, msg, err := c.ReadResponse(552); err != nil || msg != ErrMessageSizeOverrun.Error() {
+			t.Errorf("Expected a 552 for the flood, got: %v %v", msg, err)
+		}
+		if _, err := c.ReadLine(); err == nil {
+			t.Error("Expected the connection to be closed")
+		}
+	})
+
+	t.Run("BDAT", func(t *testing.T) {
+		c, _ := pipeSession(server)
+		defer c.Close()
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("Expected greeting: %v", err)
+		}
+		expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+		expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+
+		// a chunk too large to read off is turned away before any of it is sent
+		if msg := expectReply(t, c, 552, "BDAT %v LAST", 50*len(flood)); msg != ErrMessageSizeOverrun.Error() {
+			t.Errorf("Expected a 552 for the chunk, got: %v", msg)
+		}
+		if _, err := c.ReadLine(); err == nil {
+			t.Error("Expected the connection to be closed")
+		}
+	})
+
+	if len(recorder.Messages) != 0 {
+		t.Errorf("Expected nothing delivered, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerResponses(t *testing.T) {
+	server := NewServer((&MessageRecorder{}).Record)
+	server.MaxSize = 1024
+	server.MaxRecipients = 1
+	server.Responses = map[ResponseKey]string{
+		ResponseSizeExceeded: "5.3.4 Nachricht zu groß",
+	}
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	// not overridden, so the default text
+	if msg := expectReply(t, c, 452, "RCPT TO:<another@example.net>"); msg != "4.5.3 too many recipients" {
+		t.Errorf("Expected the default too many recipients reply, got: %v", msg)
 	}
+	expectReply(t, c, 354, "DATA")
 
-	var expected1 = "broken pipe"
-	var expected2 = "connection reset by peer"
-	var actual string
+	go c.PrintfLine("From: sender@example.org\r\n\r\n%v\r\n.", strings.Repeat("0123456789\r\n", 20000))
+	_, msg, err := c.ReadResponse(552)
 	if err != nil {
-		actual = err.Error()
+		t.Fatalf("Expected a 552 for the large message: %v", err)
 	}
-	if !strings.Contains(actual, expected1) && !strings.Contains(actual, expected2) {
-		t.Errorf(
-			"Error actual = %v, and Expected error to contain either: 1) '%v' OR 2) '%v'.",
-			actual, expected1, expected2,
-		)
+	if msg != "5.3.4 Nachricht zu groß" {
+		t.Errorf("Expected the custom size exceeded reply, got: %v", msg)
+	}
+}
+
+func TestSMTPServerMaxHeaderLines(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.MaxHeaderLines = 5
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+
+	var headers []string
+	for i := 0; i < 10; i++ {
+		headers = append(headers, fmt.Sprintf("X-Header-%v: %v", i, i))
+	}
+	message := "From: sender@example.org\r\n" + strings.Join(headers, "\r\n") + "\r\n\r\nbody"
+
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	if msg := expectReply(t, c, 552, "%v\r\n.", message); msg != "5.3.4 too many header lines" {
+		t.Errorf("Expected too many header lines, got: %v", msg)
+	}
+
+	// the same over BDAT
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 552, "BDAT %v LAST\r\n%v", len(message)+2, message)
+
+	// a message within the limit still goes through, with lots of lines in the body
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	expectReply(t, c, 250, "From: sender@example.org\r\nSubject: Fine\r\n\r\n%v\r\n.", strings.Join(headers, "\r\n"))
+	if len(recorder.Messages) != 1 {
+		t.Errorf("Expected only the last message delivered, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerTruncateOnMaxSize(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.MaxSize = 1024
+	server.TruncateOnMaxSize = true
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	err := server.SendTestMessage("sender@example.org", []string{"recipient@example.net"}, []byte(fmt.Sprintf(`From: sender@example.org
+To: recipient@example.net
+Content-Type: text/plain
+
+%v`, strings.Repeat("0123456789\n", 1000))))
+	if err != nil {
+		t.Fatalf("Expected the truncated message to be accepted and the session to carry on: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+	msg := recorder.Messages[0]
+	if !msg.Truncated {
+		t.Error("Expected the message to be flagged as truncated")
+	}
+	if got := msg.Header.Get("X-Truncated"); got != "true" {
+		t.Errorf("Expected an X-Truncated header, got: %q", got)
+	}
+	if !strings.HasPrefix(string(msg.Source), "X-Truncated: true\r\n") {
+		t.Errorf("Expected the header at the top of the source, got: %q", msg.Source[:40])
+	}
+	if len(msg.RawBody) >= int(server.MaxSize) {
+		t.Errorf("Expected the body to be cut below MaxSize, got %v bytes", len(msg.RawBody))
+	}
+}
+
+func TestNewServerTimeoutDefaults(t *testing.T) {
+	server := NewServer(nil)
+	if server.ReadTimeout != DefaultReadTimeout || server.ReadTimeout == 0 {
+		t.Errorf("Expected the command timeout to default to %v, got: %v", DefaultReadTimeout, server.ReadTimeout)
+	}
+	if server.DataTimeout != DefaultDataTimeout || server.DataTimeout == 0 {
+		t.Errorf("Expected the data timeout to default to %v, got: %v", DefaultDataTimeout, server.DataTimeout)
+	}
+	if server.WriteTimeout != DefaultWriteTimeout || server.WriteTimeout == 0 {
+		t.Errorf("Expected the write timeout to default to %v, got: %v", DefaultWriteTimeout, server.WriteTimeout)
+	}
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	conn := server.newConn(serverSide)
+	if conn.dataTimeout() != DefaultDataTimeout {
+		t.Errorf("Expected connections to wait %v for message data, got: %v", DefaultDataTimeout, conn.dataTimeout())
 	}
 }
 
@@ -192,6 +385,77 @@ func TestSMTPServerTimeout(t *testing.T) {
 
 }
 
+func TestSMTPServerIdleTimeoutReply(t *testing.T) {
+	server := NewServer(nil)
+	server.ReadTimeout = time.Millisecond * 50
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+
+	// say nothing, the server should explain itself before hanging up
+	code, msg, err := c.ReadResponse(421)
+	if code != 421 || !strings.HasPrefix(msg, "4.4.2") {
+		t.Errorf("Expected 421 4.4.2 on an idle timeout, got: %v %v %v", code, msg, err)
+	}
+	if _, err := c.ReadLine(); err != io.EOF {
+		t.Errorf("Expected the connection closed after the 421, got: %v", err)
+	}
+}
+
+func TestSMTPServerDataTimeout(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.DataTimeout = time.Millisecond * 200
+
+	startData := func() *textproto.Conn {
+		c, _ := pipeSession(server)
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("Expected greeting: %v", err)
+		}
+		expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+		expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+		expectReply(t, c, 354, "DATA")
+		return c
+	}
+
+	t.Run("slow but steady", func(t *testing.T) {
+		c := startData()
+		defer c.Close()
+
+		if err := c.PrintfLine("From: sender@example.org\r\nContent-Type: text/plain\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		// takes well over the DataTimeout in total, but never pauses for that long
+		for i := 0; i < 6; i++ {
+			time.Sleep(server.DataTimeout / 2)
+			if err := c.PrintfLine("line %v", i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expectReply(t, c, 250, ".")
+	})
+
+	t.Run("stalled", func(t *testing.T) {
+		c := startData()
+		defer c.Close()
+
+		if err := c.PrintfLine("From: sender@example.org"); err != nil {
+			t.Fatal(err)
+		}
+		code, _, err := c.ReadResponse(421)
+		if code != 421 {
+			t.Errorf("Expected a stalled transfer to get 421, got: %v %v", code, err)
+		}
+	})
+
+	if len(recorder.Messages) != 1 {
+		t.Errorf("Expected only the steady message delivered, got: %v", len(recorder.Messages))
+	}
+}
+
 func TestSMTPServerNoTLS(t *testing.T) {
 
 	recorder := &MessageRecorder{}
@@ -215,6 +479,82 @@ func TestSMTPServerNoTLS(t *testing.T) {
 
 }
 
+func TestSMTPServerSTARTTLSInjection(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.TLSConfig = TestingTLSConfig()
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := net.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer conn.Close()
+
+	c := textproto.NewConn(conn)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, c, 250, "EHLO client.example.com")
+
+	// a man in the middle appends a command to the plaintext STARTTLS
+	if _, err := conn.Write([]byte("STARTTLS\r\nMAIL FROM:<attacker@example.com>\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected STARTTLS to be accepted: %v", err)
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: server.Name, InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("Should be able to negotiate TLS: %v", err)
+	}
+	c = textproto.NewConn(tlsConn)
+
+	expectReply(t, c, 250, "EHLO client.example.com")
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.com>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	expectReply(t, c, 250, "From: sender@example.com\r\nSubject: Hi\r\n\r\nHello\r\n.")
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+	if from := recorder.Messages[0].From.Address; from != "sender@example.com" {
+		t.Errorf("Expected the injected MAIL to be ignored, got sender: %v", from)
+	}
+}
+
+func TestSMTPServerCustomCommand(t *testing.T) {
+	server := NewServer((&MessageRecorder{}).Record)
+	var got string
+	server.Commands["XMYTHING"] = func(conn *Conn, args string) error {
+		got = args
+		conn.WriteSMTP(250, "2.0.0 did my thing")
+		return nil
+	}
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+
+	if msg := expectReply(t, c, 250, "XMYTHING with args"); msg != "2.0.0 did my thing" {
+		t.Errorf("Expected the custom reply, got: %v", msg)
+	}
+	if got != "with args" {
+		t.Errorf("Expected the handler to get the arguments, got: %q", got)
+	}
+	// the built-in verbs are still there
+	expectReply(t, c, 250, "NOOP")
+	expectReply(t, c, 500, "XOTHERTHING")
+}
+
 func TestSMTPServerNoAuthCustomVerb(t *testing.T) {
 
 	fakeAuthHandler := func(email, apiKey string) (acct AuthUser, passed bool) {
@@ -279,46 +619,16 @@ func TestServer_DiscardMessageBody(t *testing.T) {
 
 	WaitUntilAlive(server)
 
-	// Connect to the SMTP server
-	c, err := smtp.Dial(server.Address())
-	if err != nil {
-		t.Fatalf("Should be able to dial localhost: %v", err)
-	}
-
-	// Set the sender and recipient
-	if err := c.Mail("sender@example.org"); err != nil {
-		t.Fatalf("Should be able to set a sender: %v", err)
-	}
-	if err := c.Rcpt("recipient@example.net"); err != nil {
-		t.Fatalf("Should be able to set a RCPT: %v", err)
-	}
-
-	// Start the data command
-	wc, err := c.Data()
-	if err != nil {
-		t.Fatalf("Error creating the data body: %v", err)
-	}
-
 	// Write headers followed by the body (this should be discarded)
 	// Ensure well-formed headers
 	emailBody := "This is the email body that should be discarded"
-	_, err = fmt.Fprintf(wc, `From: sender@example.org
+	err := server.SendTestMessage("sender@example.org", []string{"recipient@example.net"}, []byte(fmt.Sprintf(`From: sender@example.org
 To: recipient@example.net
 Subject: Test email
 
-%v`, emailBody)
+%v`, emailBody)))
 	if err != nil {
-		t.Fatalf("Error writing email body: %v", err)
-	}
-
-	// Ensure the writer is closed to signal end of data
-	if err := wc.Close(); err != nil {
-		t.Fatalf("Error closing writer: %v", err)
-	}
-
-	// Send the QUIT command and close the connection
-	if err := c.Quit(); err != nil {
-		t.Fatalf("Server wouldn't accept QUIT: %v", err)
+		t.Fatalf("Error sending the message: %v", err)
 	}
 
 	// Verify that headers were recorded but no message body
@@ -343,3 +653,1367 @@ Subject: Test email
 		t.Errorf("Expected recipient header to be recipient@example.net, got: %v", recorder.Messages[0].To[0].Address)
 	}
 }
+
+func TestSMTPServerHandlerTimeout(t *testing.T) {
+	cancelled := make(chan error, 1)
+	server := NewServer(func(msg *Message) error {
+		select {
+		case <-msg.Context().Done():
+			cancelled <- msg.Context().Err()
+		case <-time.After(time.Millisecond * 500):
+			cancelled <- nil
+		}
+		return nil
+	})
+	server.HandlerTimeout = time.Millisecond * 50
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	err := server.SendTestMessage("sender@example.org", []string{"recipient@example.net"}, []byte(`From: sender@example.org
+To: recipient@example.net
+Content-Type: text/plain
+
+slow delivery`))
+	if serr, ok := err.(SMTPError); !ok || serr.Code != 451 {
+		t.Errorf("Expected the slow handler to time out with a 451, got: %v", err)
+	}
+	if err := <-cancelled; err != context.Canceled {
+		t.Errorf("Expected the handler's context cancelled, got: %v", err)
+	}
+}
+
+func TestSMTPServerBinarySafeAttachment(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	attachment := "line one\r\nline two\r\n.starts with a dot\r\n\xff\xfe end"
+	err := server.SendTestMessage("sender@example.org", []string{"recipient@example.net"}, []byte(fmt.Sprintf("From: sender@example.org\r\n"+
+		"To: recipient@example.net\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: multipart/mixed; boundary=\"boundary\"\r\n"+
+		"\r\n"+
+		"--boundary\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		"See attached\r\n"+
+		"--boundary\r\n"+
+		"Content-Type: application/octet-stream\r\n"+
+		"Content-Transfer-Encoding: 8bit\r\n"+
+		"Content-Disposition: attachment; filename=\"crlf.bin\"\r\n"+
+		"\r\n"+
+		"%s\r\n"+
+		"--boundary--\r\n", attachment)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+
+	attachments, err := recorder.Messages[0].Attachments()
+	if err != nil {
+		t.Fatalf("Error getting attachments: %v", err)
+	}
+	if len(attachments) != 2 {
+		t.Fatalf("Expected 2 parts in multipart/mixed, got: %v", len(attachments))
+	}
+	if string(attachments[1].Body) != attachment {
+		t.Errorf("Attachment was altered in transit, want: %q, got: %q", attachment, string(attachments[1].Body))
+	}
+}
+
+func TestSMTPServerRequireHeaders(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.RequireHeaders = []string{"Date", "From"}
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	send := func(body string) error {
+		return server.SendTestMessage("sender@example.org", []string{"recipient@example.net"}, []byte(body))
+	}
+
+	err := send(`From: sender@example.org
+To: recipient@example.net
+Content-Type: text/plain
+
+No date here`)
+	if serr, ok := err.(SMTPError); !ok || serr.Code != 550 {
+		t.Errorf("Expected a message without Date to get 550, got: %v", err)
+	}
+
+	err = send(`From: sender@example.org
+To: recipient@example.net
+Date: Mon, 16 Jan 2017 16:59:33 -0500
+Content-Type: text/plain
+
+Dated`)
+	if err != nil {
+		t.Errorf("Expected a message with Date and From to be accepted, got: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Errorf("Expected 1 message delivered, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerRequireMinimalHeaders(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.RequireMinimalHeaders = true
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	send := func(body string) error {
+		return server.SendTestMessage("sender@example.org", []string{"recipient@example.net"}, []byte(body))
+	}
+
+	err := send("GET / HTTP/1.1\r\nHost: mail.example.net\r\n\r\n")
+	if serr, ok := err.(SMTPError); !ok || serr.Code != 550 {
+		t.Errorf("Expected junk DATA to get 550, got: %v", err)
+	}
+
+	err = send(`from: sender@example.org
+To: recipient@example.net
+
+Just enough headers`)
+	if err != nil {
+		t.Errorf("Expected a message with a From header to be accepted, got: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Errorf("Expected 1 message delivered, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerPostDataDelay(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.PostDataDelay = time.Millisecond * 200
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	start := time.Now()
+	err := server.SendTestMessage("sender@example.org", []string{"recipient@example.net"}, []byte(`From: sender@example.org
+To: recipient@example.net
+Content-Type: text/plain
+
+Patience`))
+	if err != nil {
+		t.Fatalf("Expected the message to be accepted: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < server.PostDataDelay {
+		t.Errorf("Expected the session to take at least %v, took: %v", server.PostDataDelay, elapsed)
+	}
+}
+
+func TestSMTPServerRejectEarlyTalkers(t *testing.T) {
+	server := NewServer((&MessageRecorder{}).Record)
+	server.RejectEarlyTalkers = true
+	server.EarlyTalkerWait = time.Millisecond * 100
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	t.Run("talking before the greeting is rejected", func(t *testing.T) {
+		conn, err := net.Dial("tcp", server.Address())
+		if err != nil {
+			t.Fatalf("Should be able to dial localhost: %v", err)
+		}
+		c := textproto.NewConn(conn)
+		defer c.Close()
+
+		if err := c.PrintfLine("EHLO impatient.example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if code, _, err := c.ReadResponse(220); code != 554 {
+			t.Errorf("Expected the early talker to get 554, got: %v %v", code, err)
+		}
+	})
+
+	t.Run("waiting for the greeting is fine", func(t *testing.T) {
+		c, err := smtp.Dial(server.Address())
+		if err != nil {
+			t.Fatalf("Should be able to dial localhost: %v", err)
+		}
+		defer c.Close()
+
+		if err := c.Hello("patient.example.com"); err != nil {
+			t.Errorf("Expected a patient client to be served, got: %v", err)
+		}
+	})
+}
+
+func TestSMTPServerLegacyVerbs(t *testing.T) {
+	server := NewServer((&MessageRecorder{}).Record)
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+
+	// more than enough to trip the unrecognized command disconnect if they counted
+	for _, verb := range []string{"SEND", "SOML", "SAML", "TURN", "SEND", "TURN"} {
+		if err := c.PrintfLine("%v FROM:<sender@example.org>", verb); err != nil {
+			t.Fatal(err)
+		}
+		if code, _, err := c.ReadResponse(502); code != 502 {
+			t.Errorf("Expected %v to get 502, got: %v %v", verb, code, err)
+		}
+	}
+
+	if err := c.PrintfLine("NOOP"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Errorf("Expected the connection to still be usable: %v", err)
+	}
+}
+
+// dialText opens a raw protocol connection to the server and reads the greeting
+func dialText(t *testing.T, server *Server) *textproto.Conn {
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	return c
+}
+
+// expectReply sends a command line and checks the reply code
+func expectReply(t *testing.T, c *textproto.Conn, code int, format string, args ...interface{}) string {
+	t.Helper()
+	if err := c.PrintfLine(format, args...); err != nil {
+		t.Fatal(err)
+	}
+	got, msg, err := c.ReadResponse(code)
+	if got != code {
+		t.Errorf("Expected %v to get %v, got: %v %v", fmt.Sprintf(format, args...), code, got, err)
+	}
+	return msg
+}
+
+func TestSMTPServerCheckQuota(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	var checked []int64
+	server.CheckQuota = func(conn *Conn, pendingBytes int64) error {
+		checked = append(checked, pendingBytes)
+		if pendingBytes > 100 {
+			return ErrMailboxFull
+		}
+		return nil
+	}
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c := dialText(t, server)
+	defer c.Close()
+
+	// the declared size is already over quota
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org> SIZE=5000")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 452, "DATA")
+
+	// no size declared, so the message is only checked once it's been read
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	expectReply(t, c, 452, "From: sender@example.org\r\nTo: recipient@example.net\r\n\r\n%v\r\n.", strings.Repeat("x", 200))
+
+	if len(recorder.Messages) != 0 {
+		t.Errorf("Expected no messages delivered over quota, got: %v", len(recorder.Messages))
+	}
+	if len(checked) != 2 || checked[0] != 5000 {
+		t.Errorf("Expected the declared size and then the actual size to be checked, got: %v", checked)
+	}
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func TestSMTPServerNetworkLists(t *testing.T) {
+	cases := []struct {
+		name    string
+		allowed []*net.IPNet
+		denied  []*net.IPNet
+		ip      string
+		want    bool
+	}{
+		{"no lists", nil, nil, "203.0.113.9", true},
+		{"IPv4 allowed", mustParseCIDRs("192.0.2.0/24"), nil, "192.0.2.10", true},
+		{"IPv4 not allowed", mustParseCIDRs("192.0.2.0/24"), nil, "198.51.100.10", false},
+		{"IPv4-mapped IPv6 allowed", mustParseCIDRs("192.0.2.0/24"), nil, "::ffff:192.0.2.10", true},
+		{"IPv4 in an IPv4-mapped network", mustParseCIDRs("::ffff:192.0.2.0/120"), nil, "192.0.2.10", true},
+		{"IPv4 outside an IPv4-mapped network", mustParseCIDRs("::ffff:192.0.2.0/120"), nil, "198.51.100.10", false},
+		{"IPv4-mapped IPv6 in an IPv4-mapped network", mustParseCIDRs("::ffff:192.0.2.0/120"), nil, "::ffff:192.0.2.10", true},
+		{"IPv4 denied by an IPv4-mapped network", nil, mustParseCIDRs("::ffff:198.51.100.0/120"), "198.51.100.10", false},
+		{"IPv6 allowed", mustParseCIDRs("2001:db8::/32"), nil, "2001:db8:1::25", true},
+		{"IPv6 not allowed", mustParseCIDRs("2001:db8::/32"), nil, "2001:db9::25", false},
+		{"IPv4 denied", nil, mustParseCIDRs("198.51.100.0/24"), "198.51.100.10", false},
+		{"IPv4-mapped IPv6 denied", nil, mustParseCIDRs("198.51.100.0/24"), "::ffff:198.51.100.10", false},
+		{"IPv6 denied", nil, mustParseCIDRs("2001:db8:bad::/48"), "2001:db8:bad::1", false},
+		{"IPv6 not denied", nil, mustParseCIDRs("2001:db8:bad::/48"), "2001:db8:good::1", true},
+		{"denied wins over allowed", mustParseCIDRs("10.0.0.0/8"), mustParseCIDRs("10.1.0.0/16"), "10.1.2.3", false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer(nil)
+			server.AllowedNetworks = tc.allowed
+			server.DeniedNetworks = tc.denied
+			conn := &Conn{Conn: &remoteAddrConn{remote: &net.TCPAddr{IP: net.ParseIP(tc.ip), Port: 2525}}}
+			if got := server.peerAllowed(conn); got != tc.want {
+				t.Errorf("Wrong decision for %v, want: %v, got: %v", tc.ip, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestSMTPServerDeniedNetworkRejected(t *testing.T) {
+	server := NewServer(nil)
+	server.DeniedNetworks = mustParseCIDRs("2001:db8::/32")
+
+	serverSide, clientSide := net.Pipe()
+	remote := &net.TCPAddr{IP: net.ParseIP("2001:db8::25"), Port: 2525}
+	go server.HandleSMTP(server.newConn(&remoteAddrConn{Conn: serverSide, remote: remote}))
+
+	c := textproto.NewConn(clientSide)
+	defer c.Close()
+	if code, msg, _ := c.ReadResponse(220); code != 554 {
+		t.Errorf("Expected a denied client to get 554 instead of a greeting, got: %v %v", code, msg)
+	}
+}
+
+func TestSMTPServerMaxConcurrentHandlers(t *testing.T) {
+	server := NewServer((&MessageRecorder{}).Record)
+	server.MaxConcurrentHandlers = 2
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	first := dialText(t, server)
+	second := dialText(t, server)
+	defer second.Close()
+
+	third, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	if code, msg, _ := third.ReadResponse(220); code != 421 {
+		t.Errorf("Expected a connection over the limit to get 421, got: %v %v", code, msg)
+	}
+	third.Close()
+
+	// once a handler finishes its slot is free again
+	expectReply(t, first, 221, "QUIT")
+	first.Close()
+
+	for attempt := 0; ; attempt++ {
+		c, err := textproto.Dial("tcp", server.Address())
+		if err != nil {
+			t.Fatalf("Should be able to dial localhost: %v", err)
+		}
+		code, _, _ := c.ReadResponse(220)
+		c.Close()
+		if code == 220 {
+			break
+		}
+		if attempt > 20 {
+			t.Fatalf("Expected a freed handler slot to be reused, still getting: %v", code)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestSMTPServerAddressArgs(t *testing.T) {
+	server := NewServer(nil)
+
+	valid := []string{"TO:<a@b>", "TO: <a@b>", "TO:a@b", "to:<a@b>", "TO : <a@b> NOTIFY=NEVER", "TO:a@b NOTIFY=NEVER"}
+	for _, args := range valid {
+		addr, err := server.GetAddressArg("TO", args)
+		if err != nil {
+			t.Errorf("Expected %q to parse, got: %v", args, err)
+		} else if addr.Address != "a@b" {
+			t.Errorf("Wrong address from %q, got: %v", args, addr.Address)
+		}
+	}
+
+	invalid := []string{"TO:", "TO: <>", "TO:nobody", "FROM:<a@b>", "<a@b>"}
+	for _, args := range invalid {
+		if addr, err := server.GetAddressArg("TO", args); err == nil {
+			t.Errorf("Expected %q to be rejected, got: %v", args, addr)
+		}
+	}
+
+	client, _ := pipeSession(server)
+	defer client.Close()
+
+	if _, _, err := client.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, client, 250, "MAIL FROM: sender@example.org")
+	for _, args := range valid[:3] {
+		expectReply(t, client, 250, "RCPT %v", args)
+	}
+}
+
+func TestSMTPServerMessageRcpt(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := smtp.Dial(server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	// two transactions on the same connection, each message keeps its own recipients
+	transactions := [][]string{
+		{"recipient@example.net", "bcc@example.net", "other-bcc@example.net"},
+		{"second@example.net"},
+	}
+	for _, rcpt := range transactions {
+		if err := c.Mail("sender@example.org"); err != nil {
+			t.Fatalf("Should be able to set a sender: %v", err)
+		}
+		for _, to := range rcpt {
+			if err := c.Rcpt(to); err != nil {
+				t.Fatalf("Should be able to set RCPT %v: %v", to, err)
+			}
+		}
+		wc, err := c.Data()
+		if err != nil {
+			t.Fatalf("Error creating the data body: %v", err)
+		}
+		if _, err := fmt.Fprintf(wc, "From: sender@example.org\nTo: %v\nContent-Type: text/plain\n\nHi", rcpt[0]); err != nil {
+			t.Fatalf("Error writing email: %v", err)
+		}
+		if err := wc.Close(); err != nil {
+			t.Fatalf("Expected the message to be accepted: %v", err)
+		}
+	}
+
+	if len(recorder.Messages) != len(transactions) {
+		t.Fatalf("Expected %v messages, got: %v", len(transactions), len(recorder.Messages))
+	}
+	for i, rcpt := range transactions {
+		msg := recorder.Messages[i]
+		if len(msg.Rcpt) != len(rcpt) {
+			t.Errorf("Message %v: expected %v recipients, got: %v", i, len(rcpt), msg.Rcpt)
+			continue
+		}
+		for j, to := range rcpt {
+			if msg.Rcpt[j].Address != to {
+				t.Errorf("Message %v: wrong recipient %v, want: %v, got: %v", i, j, to, msg.Rcpt[j].Address)
+			}
+		}
+		if bcc := msg.BCC(); len(bcc) != len(rcpt)-1 {
+			t.Errorf("Message %v: expected %v BCC, got: %v", i, len(rcpt)-1, bcc)
+		}
+	}
+}
+
+func TestSMTPServerBDAT(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	if msg := expectReply(t, c, 250, "EHLO client.example.com"); !strings.Contains(msg, "CHUNKING") {
+		t.Errorf("Expected CHUNKING to be advertised, got: %v", msg)
+	}
+
+	message := "From: sender@example.org\r\nTo: recipient@example.net\r\nSubject: Chunks\r\n" +
+		"Content-Type: text/plain\r\n\r\nFirst line\r\n.starts with a dot\r\n..two dots\r\nLast line\r\n"
+
+	// the same message sent with DATA, dot-stuffed, and with BDAT in two chunks
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	stuffed := strings.ReplaceAll(message, "\r\n.", "\r\n..")
+	if _, err := fmt.Fprintf(c.W, "%v.\r\n", stuffed); err != nil {
+		t.Fatal(err)
+	}
+	c.W.Flush()
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Expected the DATA message to be accepted: %v", err)
+	}
+
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	half := len(message) / 2
+	for i, chunk := range []string{message[:half], message[half:]} {
+		last := ""
+		if i == 1 {
+			last = " LAST"
+		}
+		if _, err := fmt.Fprintf(c.W, "BDAT %v%v\r\n%v", len(chunk), last, chunk); err != nil {
+			t.Fatal(err)
+		}
+		c.W.Flush()
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("Expected BDAT chunk %v to be accepted: %v", i, err)
+		}
+	}
+
+	// a chunk outside a transaction is still read, so the session carries on
+	if _, err := fmt.Fprintf(c.W, "BDAT 5 LAST\r\nHello"); err != nil {
+		t.Fatal(err)
+	}
+	c.W.Flush()
+	if code, _, _ := c.ReadResponse(503); code != 503 {
+		t.Errorf("Expected BDAT without MAIL to get 503, got: %v", code)
+	}
+	expectReply(t, c, 250, "NOOP")
+
+	if len(recorder.Messages) != 2 {
+		t.Fatalf("Expected 2 messages, got: %v", len(recorder.Messages))
+	}
+	viaData, viaBDAT := recorder.Messages[0], recorder.Messages[1]
+	if !bytes.Equal(viaData.RawBody, viaBDAT.RawBody) {
+		t.Errorf("Expected the same RawBody, got:\n%q\n%q", viaData.RawBody, viaBDAT.RawBody)
+	}
+	if !reflect.DeepEqual(viaData.Header, viaBDAT.Header) {
+		t.Errorf("Expected the same headers, got:\n%v\n%v", viaData.Header, viaBDAT.Header)
+	}
+	plainData, err := viaData.Plain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainBDAT, err := viaBDAT.Plain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plainData, plainBDAT) {
+		t.Errorf("Expected the same body, got:\n%q\n%q", plainData, plainBDAT)
+	}
+	if !bytes.Contains(plainBDAT, []byte("\r\n.starts with a dot\r\n..two dots\r\n")) {
+		t.Errorf("Expected the dots kept as sent, got: %q", plainBDAT)
+	}
+}
+
+func TestSMTPServerBDATLimits(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.MaxSize = 1000
+	server.MaxBDATChunks = 2
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+
+	// the declared size alone is too much, the 552 comes before any of the chunk is sent
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	if msg := expectReply(t, c, 552, "BDAT 50000"); msg != ErrMessageSizeExceeded.Error() {
+		t.Errorf("Expected the chunk to be refused for its size, got: %v", msg)
+	}
+	if _, err := c.W.Write(bytes.Repeat([]byte("x"), 50000)); err != nil {
+		t.Fatal(err)
+	}
+	c.W.Flush()
+	expectReply(t, c, 503, "BDAT 6 LAST\r\nbody")
+
+	// a flood of small chunks
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 250, "BDAT 28\r\nFrom: sender@example.org\r\n")
+	expectReply(t, c, 250, "BDAT 4\r\n\r\n")
+	if msg := expectReply(t, c, 552, "BDAT 6 LAST\r\nbody"); msg != ErrTooManyChunks.Error() {
+		t.Errorf("Expected the third chunk to be refused, got: %v", msg)
+	}
+	expectReply(t, c, 250, "NOOP")
+
+	if len(recorder.Messages) != 0 {
+		t.Errorf("Expected no message to be handed over, got: %v", len(recorder.Messages))
+	}
+
+	// chunks are counted when the body is discarded too
+	server.DiscardBody = true
+	d, _ := pipeSession(server)
+	defer d.Close()
+	if _, _, err := d.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, d, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, d, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, d, 250, "BDAT 28\r\nFrom: sender@example.org\r\n")
+	expectReply(t, d, 250, "BDAT 4\r\n\r\n")
+	if msg := expectReply(t, d, 552, "BDAT 6 LAST\r\nbody"); msg != ErrTooManyChunks.Error() {
+		t.Errorf("Expected the third chunk to be refused with DiscardBody, got: %v", msg)
+	}
+	if len(recorder.Messages) != 0 {
+		t.Errorf("Expected no message to be handed over, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerBDATNearMaxSize(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.MaxSize = 1000
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+
+	// a chunk just under MaxSize, the commands around it don't count towards the message
+	body := "From: sender@example.org\r\n\r\n" + strings.Repeat("x", 949)
+	for i := 0; i < 2; i++ {
+		expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+		expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+		if err := c.PrintfLine("BDAT %v LAST", len(body)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.W.WriteString(body); err != nil {
+			t.Fatal(err)
+		}
+		c.W.Flush()
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("Expected message %v accepted: %v", i+1, err)
+		}
+	}
+
+	if len(recorder.Messages) != 2 {
+		t.Errorf("Expected both messages handed over, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerDATANearMaxSize(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.MaxSize = 1000
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, c, 250, "EHLO client.example.com")
+
+	// a message just under MaxSize, the commands before it don't count towards the message
+	body := "From: sender@example.org\r\n\r\n" + strings.Repeat("x", 949)
+	for i := 0; i < 2; i++ {
+		expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+		expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+		expectReply(t, c, 354, "DATA")
+		expectReply(t, c, 250, "%s\r\n.", body)
+	}
+
+	if len(recorder.Messages) != 2 {
+		t.Fatalf("Expected both messages handed over, got: %v", len(recorder.Messages))
+	}
+	for _, msg := range recorder.Messages {
+		if len(msg.RawBody) != 949 {
+			t.Errorf("Expected the whole body kept, got %v bytes", len(msg.RawBody))
+		}
+	}
+}
+
+func TestSMTPServerOpenRelayRecipientPolicy(t *testing.T) {
+	server := NewServer((&MessageRecorder{}).Record)
+	serverAuth := NewAuth()
+	serverAuth.Extend("PLAIN", &AuthPlain{
+		Auth: func(username, password string) (AuthUser, bool) {
+			return &TestUser{username, password}, password == "password"
+		},
+	})
+	server.Auth = serverAuth
+	server.AllowPlaintextAuth = true
+	server.PreAuthVerbsAllowed = append(server.PreAuthVerbsAllowed, "MAIL", "RCPT", "DATA")
+	server.OpenRelayRecipientPolicy = func(conn *Conn, to *mail.Address) Decision {
+		switch {
+		case strings.HasSuffix(to.Address, "@blocked.example.com"):
+			return DecisionReject
+		case strings.HasSuffix(to.Address, "@example.net") && len(conn.ToAddr) < 2:
+			return DecisionAccept
+		}
+		return DecisionRequireAuth
+	}
+
+	start := func(t *testing.T, authenticate bool) *textproto.Conn {
+		c, _ := pipeSession(server)
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("Expected greeting: %v", err)
+		}
+		if authenticate {
+			creds := base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00password"))
+			expectReply(t, c, 235, "AUTH PLAIN %v", creds)
+		}
+		expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+		return c
+	}
+
+	t.Run("local accepted", func(t *testing.T) {
+		c := start(t, false)
+		defer c.Close()
+		expectReply(t, c, 250, "RCPT TO:<one@example.net>")
+		expectReply(t, c, 250, "RCPT TO:<two@example.net>")
+		// past the unauthenticated allowance
+		expectReply(t, c, 530, "RCPT TO:<three@example.net>")
+	})
+
+	t.Run("external rejected without auth", func(t *testing.T) {
+		c := start(t, false)
+		defer c.Close()
+		if msg := expectReply(t, c, 530, "RCPT TO:<someone@elsewhere.example.org>"); !strings.HasPrefix(msg, "5.7.0") {
+			t.Errorf("Expected an authentication required reply, got: %v", msg)
+		}
+		expectReply(t, c, 550, "RCPT TO:<someone@blocked.example.com>")
+	})
+
+	t.Run("external accepted with auth", func(t *testing.T) {
+		c := start(t, true)
+		defer c.Close()
+		expectReply(t, c, 250, "RCPT TO:<someone@elsewhere.example.org>")
+		expectReply(t, c, 550, "RCPT TO:<someone@blocked.example.com>")
+	})
+}
+
+func TestSMTPServerBINARYMIME(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	if msg := expectReply(t, c, 250, "EHLO client.example.com"); !strings.Contains(msg, "BINARYMIME") {
+		t.Errorf("Expected BINARYMIME to be advertised, got: %v", msg)
+	}
+	expectReply(t, c, 555, "MAIL FROM:<sender@example.org> BODY=UNKNOWN")
+
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org> BODY=BINARYMIME")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	if msg := expectReply(t, c, 503, "DATA"); !strings.HasPrefix(msg, "5.5.1") {
+		t.Errorf("Expected DATA to be refused for BINARYMIME, got: %v", msg)
+	}
+
+	message := "From: sender@example.org\r\nContent-Type: application/octet-stream\r\n\r\n\x00\x01\xff binary\r\n"
+	if _, err := fmt.Fprintf(c.W, "BDAT %v LAST\r\n%v", len(message), message); err != nil {
+		t.Fatal(err)
+	}
+	c.W.Flush()
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Expected BDAT to be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+	if got := recorder.Messages[0].BodyType; got != "BINARYMIME" {
+		t.Errorf("Expected the body type recorded on the message, got: %q", got)
+	}
+
+	// without CHUNKING there is no BINARYMIME
+	server.Disable("BDAT")
+	expectReply(t, c, 555, "MAIL FROM:<sender@example.org> BODY=BINARYMIME")
+}
+
+func TestSMTPServerEnhancedStatusCodes(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.EnhancedStatusCodes = true
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	if msg := expectReply(t, c, 250, "EHLO client.example.com"); !strings.Contains(msg, "\nENHANCEDSTATUSCODES\n") {
+		t.Errorf("Expected ENHANCEDSTATUSCODES to be advertised, got: %v", msg)
+	}
+
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	msg := expectReply(t, c, 250, "From: sender@example.org\r\nSubject: Sizes\r\n\r\nCounted\r\n.")
+
+	var id string
+	var size int
+	if _, err := fmt.Sscanf(msg, "2.0.0 Ok: queued as %s (%d bytes)", &id, &size); err != nil {
+		t.Fatalf("Expected the queue id and size in the reply, got: %v (%v)", msg, err)
+	}
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+	if id != recorder.Messages[0].MessageID {
+		t.Errorf("Expected the message id %v, got: %v", recorder.Messages[0].MessageID, id)
+	}
+	if size != len(recorder.Messages[0].Source) {
+		t.Errorf("Expected %v bytes, got: %v", len(recorder.Messages[0].Source), size)
+	}
+}
+
+func TestSMTPServerTransformMessage(t *testing.T) {
+	var score string
+	var stored []byte
+	server := NewServer(func(m *Message) error {
+		score = m.Header.Get("X-Spam-Score")
+		stored = m.Bytes()
+		return nil
+	})
+	server.TransformMessage = func(m *Message) error {
+		if strings.Contains(m.Subject, "lottery") {
+			return Reject("looks like spam")
+		}
+		m.AddHeader("X-Spam-Score", "0.3")
+		return nil
+	}
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	expectReply(t, c, 250, "From: sender@example.org\r\nSubject: Hi\r\n\r\nHello\r\n.")
+
+	if score != "0.3" {
+		t.Errorf("Expected the handler to see the added header, got: %q", score)
+	}
+	if !bytes.HasPrefix(stored, []byte("X-Spam-Score: 0.3\r\nFrom: sender@example.org\r\n")) {
+		t.Errorf("Expected the header in the stored message, got: %q", stored)
+	}
+
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	if msg := expectReply(t, c, 550, "From: sender@example.org\r\nSubject: You won the lottery\r\n\r\nHello\r\n."); msg != "5.7.1 looks like spam" {
+		t.Errorf("Expected the transform's rejection, got: %v", msg)
+	}
+}
+
+type queueStore struct {
+	stored []*Message
+}
+
+func (q *queueStore) Store(m *Message) (string, error) {
+	q.stored = append(q.stored, m)
+	return fmt.Sprintf("Q%03d", len(q.stored)), nil
+}
+
+func TestSMTPServerStore(t *testing.T) {
+	recorder := &MessageRecorder{}
+	store := &queueStore{}
+	server := NewServer(recorder.Record)
+	server.Store = store
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	if msg := expectReply(t, c, 250, "From: sender@example.org\r\n\r\nStored\r\n."); msg != "2.0.0 Ok: queued as Q001" {
+		t.Errorf("Expected the queue id in the reply, got: %v", msg)
+	}
+
+	if len(recorder.Messages) != 1 || len(store.stored) != 1 || recorder.Messages[0] != store.stored[0] {
+		t.Errorf("Expected the message handled and stored, got: %v handled, %v stored", len(recorder.Messages), len(store.stored))
+	}
+
+	// a message the handler turns down isn't stored
+	server.Handler = func(*Message) error { return NewError(550, "5.7.1 no thanks") }
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	expectReply(t, c, 550, "From: sender@example.org\r\n\r\nRejected\r\n.")
+	if len(store.stored) != 1 {
+		t.Errorf("Expected the rejected message not to be stored, got: %v", len(store.stored))
+	}
+}
+
+func TestSMTPServerHandlerDefer(t *testing.T) {
+	server := NewServer(func(*Message) error {
+		return Defer("storage busy")
+	})
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	send := func(code int) string {
+		t.Helper()
+		expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+		expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+		expectReply(t, c, 354, "DATA")
+		return expectReply(t, c, code, "From: sender@example.org\r\n\r\nHi\r\n.")
+	}
+
+	if msg := send(451); msg != "4.3.0 storage busy" {
+		t.Errorf("Expected a temporary failure, got: %v", msg)
+	}
+
+	server.Handler = func(*Message) error { return Reject("") }
+	if msg := send(550); msg != "5.7.1 message rejected" {
+		t.Errorf("Expected a permanent failure, got: %v", msg)
+	}
+}
+
+func TestSMTPServerLoopDetection(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.MaxReceivedHops = 3
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	send := func(code int, headers string) string {
+		t.Helper()
+		expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+		expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+		expectReply(t, c, 354, "DATA")
+		return expectReply(t, c, code, "%vFrom: sender@example.org\r\n\r\nHi\r\n.", headers)
+	}
+
+	if msg := send(554, "Delivered-To: Recipient@example.net\r\n"); msg != "5.4.6 routing loop detected" {
+		t.Errorf("Expected a routing loop rejection, got: %v", msg)
+	}
+	send(554, strings.Repeat("Received: from relay.example.com\r\n", 4))
+
+	// delivered to someone else before, and within the hop count
+	send(250, "Delivered-To: other@example.net\r\n"+strings.Repeat("Received: from relay.example.com\r\n", 3))
+	if len(recorder.Messages) != 1 {
+		t.Errorf("Expected only the last message delivered, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerAcceptReply(t *testing.T) {
+	server := NewServer(func(m *Message) error {
+		m.AcceptReply = "2.0.0 Message accepted for delivery: " + m.MessageID
+		return nil
+	})
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	msg := expectReply(t, c, 250, "From: sender@example.org\r\n\r\nHi\r\n.")
+	if !strings.HasPrefix(msg, "2.0.0 Message accepted for delivery: ") || len(msg) == len("2.0.0 Message accepted for delivery: ") {
+		t.Errorf("Expected the handler's reply, got: %v", msg)
+	}
+}
+
+func TestSMTPServerOnMessageRejected(t *testing.T) {
+	type rejection struct {
+		phase  Phase
+		code   int
+		reason string
+	}
+	var rejections []rejection
+
+	server := NewServer(func(*Message) error { return Defer("busy") })
+	server.OpenRelayRecipientPolicy = func(conn *Conn, to *mail.Address) Decision {
+		if strings.HasSuffix(to.Address, "@elsewhere.example.org") {
+			return DecisionReject
+		}
+		return DecisionAccept
+	}
+	server.OnMessageRejected = func(conn *Conn, phase Phase, code int, reason string) {
+		rejections = append(rejections, rejection{phase, code, reason})
+	}
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 550, "RCPT TO:<someone@elsewhere.example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	expectReply(t, c, 451, "From: sender@example.org\r\n\r\nHi\r\n.")
+
+	want := []rejection{
+		{PhaseRcpt, 550, "5.7.1 relaying denied"},
+		{PhaseHandler, 451, "4.3.0 busy"},
+	}
+	if !reflect.DeepEqual(rejections, want) {
+		t.Errorf("Expected rejections %v, got: %v", want, rejections)
+	}
+}
+
+func TestSMTPServerNoValidRecipients(t *testing.T) {
+	called := false
+	server := NewServer(func(*Message) error {
+		called = true
+		return nil
+	})
+	server.OpenRelayRecipientPolicy = func(conn *Conn, to *mail.Address) Decision {
+		return DecisionReject
+	}
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 550, "RCPT TO:<someone@elsewhere.example.org>")
+	expectReply(t, c, 550, "RCPT TO:<another@elsewhere.example.org>")
+	if msg := expectReply(t, c, 554, "DATA"); msg != "5.5.1 no valid recipients" {
+		t.Errorf("Expected DATA to be refused, got: %v", msg)
+	}
+	expectReply(t, c, 250, "NOOP")
+	if called {
+		t.Error("Expected the handler not to be called")
+	}
+}
+
+func TestSMTPServerNullRecipient(t *testing.T) {
+	server := NewServer(func(*Message) error { return nil })
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	if msg := expectReply(t, c, 501, "RCPT TO:<>"); msg != "5.1.3 bad recipient address" {
+		t.Errorf("Expected the empty recipient to be refused, got: %v", msg)
+	}
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.org>")
+}
+
+func TestSMTPServerRequireResolvableSenderDomain(t *testing.T) {
+	server := NewServer(func(*Message) error { return nil })
+	server.RequireResolvableSenderDomain = true
+	server.Resolver = &fakeResolver{
+		mx:    map[string][]*net.MX{"example.org": {{Host: "mx.example.org.", Pref: 10}}},
+		hosts: map[string][]string{"example.net": {"192.0.2.25"}},
+	}
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	if msg := expectReply(t, c, 450, "MAIL FROM:<sender@nowhere.invalid>"); msg != "4.1.8 sender domain does not resolve" {
+		t.Errorf("Expected the sender to be refused, got: %v", msg)
+	}
+	expectReply(t, c, 503, "RCPT TO:<recipient@example.org>")
+
+	// an MX record, or an address when there's no MX, will do
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RSET")
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.net>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.org>")
+
+	// bounces have no sender domain to look up
+	expectReply(t, c, 250, "RSET")
+	expectReply(t, c, 250, "MAIL FROM:<>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.org>")
+}
+
+func TestSMTPServerNullSender(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	original, err := NewMessage(nil, []byte("From: sender@example.org\r\nTo: someone@example.net\r\nSubject: Hi\r\n\r\nHello\r\n"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn, err := GenerateDSN(original, "5.1.1", "550 5.1.1 no such user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SendTestMessage("", []string{"sender@example.org"}, dsn.Source); err != nil {
+		t.Fatalf("Expected the bounce to be accepted from the null sender: %v", err)
+	}
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+	if from := recorder.Messages[0].From; from == nil || !strings.HasPrefix(from.Address, "MAILER-DAEMON@") {
+		t.Errorf("Expected the DSN delivered, got From: %v", from)
+	}
+}
+
+func TestSMTPServerDeduplicateRecipients(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.DeduplicateRecipients = true
+
+	c, _ := pipeSession(server)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@EXAMPLE.net>")
+	expectReply(t, c, 250, "RCPT TO:<Recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	expectReply(t, c, 250, "From: sender@example.org\r\n\r\nHi\r\n.")
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+	var got []string
+	for _, rcpt := range recorder.Messages[0].Rcpt {
+		got = append(got, rcpt.Address)
+	}
+	if want := []string{"recipient@example.net", "Recipient@example.net"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected recipients %v, got: %v", want, got)
+	}
+}
+
+func TestSMTPServerRejectAllOnFirstBadRcpt(t *testing.T) {
+	for _, failFast := range []bool{false, true} {
+		recorder := &MessageRecorder{}
+		server := NewServer(recorder.Record)
+		server.RejectAllOnFirstBadRcpt = failFast
+		server.OpenRelayRecipientPolicy = func(conn *Conn, to *mail.Address) Decision {
+			if strings.HasSuffix(to.Address, "@elsewhere.example.org") {
+				return DecisionReject
+			}
+			return DecisionAccept
+		}
+
+		c, _ := pipeSession(server)
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("Expected greeting: %v", err)
+		}
+		expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+		expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+		expectReply(t, c, 550, "RCPT TO:<someone@elsewhere.example.org>")
+		if failFast {
+			expectReply(t, c, 503, "RCPT TO:<another@example.net>")
+			expectReply(t, c, 554, "DATA")
+		} else {
+			expectReply(t, c, 250, "RCPT TO:<another@example.net>")
+			expectReply(t, c, 354, "DATA")
+			expectReply(t, c, 250, "From: sender@example.org\r\n\r\nHi\r\n.")
+		}
+
+		// either way the next transaction starts afresh
+		expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+		expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+		expectReply(t, c, 354, "DATA")
+		expectReply(t, c, 250, "From: sender@example.org\r\n\r\nHi\r\n.")
+		c.Close()
+
+		wantMessages := 2
+		if failFast {
+			wantMessages = 1
+		}
+		if len(recorder.Messages) != wantMessages {
+			t.Fatalf("failFast %v: expected %v messages, got: %v", failFast, wantMessages, len(recorder.Messages))
+		}
+		if !failFast && len(recorder.Messages[0].Rcpt) != 2 {
+			t.Errorf("Expected both valid recipients to be kept, got: %v", recorder.Messages[0].Rcpt)
+		}
+	}
+}
+
+func TestSMTPServerQuitMidTransaction(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+
+	// QUIT with a transaction open drops it
+	c, _ := pipeSession(server)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	if msg := expectReply(t, c, 221, "QUIT"); msg != "2.0.0 Bye" {
+		t.Errorf("Wrong QUIT reply: %v", msg)
+	}
+	c.Close()
+	if len(recorder.Messages) != 0 {
+		t.Errorf("Expected the open transaction to be dropped, got: %v messages", len(recorder.Messages))
+	}
+
+	// QUIT right after a message was accepted keeps it
+	c, _ = pipeSession(server)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+	expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+	expectReply(t, c, 354, "DATA")
+	expectReply(t, c, 250, "From: sender@example.org\r\n\r\nHi\r\n.")
+	expectReply(t, c, 221, "QUIT")
+	c.Close()
+	if len(recorder.Messages) != 1 {
+		t.Errorf("Expected the accepted message to be delivered, got: %v messages", len(recorder.Messages))
+	}
+}
+
+func TestSendTestMessage(t *testing.T) {
+	recorder := &MessageRecorder{}
+	server := NewServer(recorder.Record)
+	server.OpenRelayRecipientPolicy = func(conn *Conn, to *mail.Address) Decision {
+		if strings.HasSuffix(to.Address, "@elsewhere.example.org") {
+			return DecisionReject
+		}
+		return DecisionAccept
+	}
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+	WaitUntilAlive(server)
+
+	data := []byte("From: sender@example.org\r\nSubject: Hi\r\n\r\nHello\r\n")
+	if err := server.SendTestMessage("sender@example.org", []string{"recipient@example.net", "other@example.net"}, data); err != nil {
+		t.Fatalf("Expected the message to be accepted: %v", err)
+	}
+	if len(recorder.Messages) != 1 || len(recorder.Messages[0].Rcpt) != 2 || recorder.Messages[0].Subject != "Hi" {
+		t.Fatalf("Expected the message to be handed over, got: %v", recorder.Messages)
+	}
+
+	err := server.SendTestMessage("sender@example.org", []string{"someone@elsewhere.example.org"}, data)
+	if serr, ok := err.(SMTPError); !ok || serr.Code != 550 {
+		t.Errorf("Expected the server's 550 back, got: %v", err)
+	}
+}
+
+func TestSMTPServerMaxWriteTime(t *testing.T) {
+	var logged bytes.Buffer
+	server := NewServerWithLogger(nil, log.New(&logged, "", 0))
+	server.MaxWriteTime = time.Millisecond * 200
+	closed := make(chan struct{})
+	server.ConnState = func(conn *Conn, state ConnState) {
+		if state == StateClosed {
+			close(closed)
+		}
+	}
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	go server.HandleSMTP(server.newConn(serverSide))
+
+	// take the greeting a byte at a time, slower than the server is willing to wait for
+	var received []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := clientSide.Read(b); err != nil {
+			break
+		}
+		received = append(received, b[0])
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the session to end")
+	}
+	if len(received) == 0 || bytes.HasSuffix(received, []byte("\r\n")) {
+		t.Errorf("Expected the greeting to be cut off, got: %q", received)
+	}
+	if !strings.Contains(logged.String(), "Client too slow reading replies") {
+		t.Errorf("Expected the stall to be logged, got: %v", logged.String())
+	}
+}
+
+func TestSMTPServerConnectionLostDuringData(t *testing.T) {
+	for _, verb := range []string{"DATA", "BDAT"} {
+		t.Run(verb, func(t *testing.T) {
+			called := false
+			var logged bytes.Buffer
+			server := NewServerWithLogger(func(m *Message) error {
+				called = true
+				return nil
+			}, log.New(&logged, "", 0))
+			closed := make(chan struct{})
+			server.ConnState = func(conn *Conn, state ConnState) {
+				if state == StateClosed {
+					close(closed)
+				}
+			}
+
+			c, _ := pipeSession(server)
+			if _, _, err := c.ReadResponse(220); err != nil {
+				t.Fatalf("Expected greeting: %v", err)
+			}
+			expectReply(t, c, 250, "MAIL FROM:<sender@example.org>")
+			expectReply(t, c, 250, "RCPT TO:<recipient@example.net>")
+			if verb == "DATA" {
+				expectReply(t, c, 354, "DATA")
+				c.PrintfLine("From: sender@example.org\r\nSubject: Hi\r\n\r\nHello")
+			} else {
+				c.PrintfLine("BDAT 500 LAST\r\nFrom: sender@example.org\r\nSubject: Hi\r\n\r\nHello")
+			}
+			c.Close()
+
+			select {
+			case <-closed:
+			case <-time.After(time.Second):
+				t.Fatal("Expected the session to end")
+			}
+			if called {
+				t.Error("Expected the handler not to see a cut off message")
+			}
+			if want := "Connection lost during " + verb; !strings.Contains(logged.String(), want) {
+				t.Errorf("Expected %q to be logged, got: %v", want, logged.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"mime"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// SMIMEResult is the outcome of checking an S/MIME signature
+type SMIMEResult struct {
+	// Signer is the certificate the message was signed with, when the signature could be read
+	Signer *x509.Certificate
+	// Valid is set when the signature matches the content and the signer chains up to a trusted root
+	Valid bool
+}
+
+// ErrNotSMIMESigned is returned by VerifySMIME for messages without a PKCS#7 signature
+var ErrNotSMIMESigned = errors.New("message is not S/MIME signed")
+
+// VerifySMIME checks the detached PKCS#7 signature of a multipart/signed message against the
+// signed part, using roots as the trusted certificates (nil for the system roots). When the
+// signature can be read but doesn't verify, the result has the Signer set and the verification
+// error is returned.
+func (m *Message) VerifySMIME(roots *x509.CertPool) (SMIMEResult, error) {
+	var result SMIMEResult
+
+	_, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		return result, err
+	}
+	signature, ok := m.Signature()
+	if !ok {
+		return result, ErrNotSMIMESigned
+	}
+	sigType, _, err := mime.ParseMediaType(signature.Header.Get("Content-Type"))
+	if err != nil {
+		return result, err
+	}
+	if sigType != "application/pkcs7-signature" && sigType != "application/x-pkcs7-signature" {
+		return result, ErrNotSMIMESigned
+	}
+
+	signed, err := firstPartSource(m.RawBody, params["boundary"])
+	if err != nil {
+		return result, err
+	}
+
+	p7, err := pkcs7.Parse(signature.Body)
+	if err != nil {
+		return result, err
+	}
+	p7.Content = canonicalLineEndings(signed)
+	result.Signer = p7.GetOnlySigner()
+
+	if roots == nil {
+		if roots, err = x509.SystemCertPool(); err != nil {
+			return result, err
+		}
+	}
+	if err := p7.VerifyWithChain(roots); err != nil {
+		return result, err
+	}
+	result.Valid = true
+	return result, nil
+}
+
+// firstPartSource returns the first part of a multipart body as it was sent, headers included.
+// The line ending before the closing delimiter belongs to the delimiter, see
+// https://tools.ietf.org/html/rfc2046#section-5.1.1
+func firstPartSource(body []byte, boundary string) ([]byte, error) {
+	if boundary == "" {
+		return nil, errors.New("multipart body has no boundary")
+	}
+	delimiter := []byte("--" + boundary)
+
+	start := -1
+	for offset := 0; offset < len(body); {
+		i := bytes.Index(body[offset:], delimiter)
+		if i < 0 {
+			break
+		}
+		i += offset
+		if i == 0 || body[i-1] == '\n' {
+			start = i
+			break
+		}
+		offset = i + len(delimiter)
+	}
+	if start < 0 {
+		return nil, errors.New("multipart body has no parts")
+	}
+
+	eol := bytes.IndexByte(body[start:], '\n')
+	if eol < 0 {
+		return nil, errors.New("multipart body has no parts")
+	}
+	part := body[start+eol+1:]
+
+	end := bytes.Index(part, append([]byte("\n"), delimiter...))
+	if end < 0 {
+		return nil, errors.New("multipart part is not terminated")
+	}
+	part = part[:end]
+	return bytes.TrimSuffix(part, []byte("\r")), nil
+}
+
+// canonicalLineEndings turns bare LF line endings into CRLF, the canonical form signatures are
+// calculated over
+func canonicalLineEndings(b []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(b))
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			out.WriteByte('\r')
+		}
+		out.WriteByte(c)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,160 @@
+package smtpd_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailsac/smtpd"
+	"go.mozilla.org/pkcs7"
+)
+
+// testSigner creates a CA and a certificate it issued to sender@example.com
+func testSigner(t *testing.T) (*x509.CertPool, *x509.Certificate, *ecdsa.PrivateKey) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: "sender@example.com"},
+		EmailAddresses: []string{"sender@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return roots, cert, key
+}
+
+// signedMessage signs content (with CRLF line endings) and wraps it in a multipart/signed message
+// that uses bare LF line endings, like messages often are once stored
+func signedMessage(t *testing.T, cert *x509.Certificate, key *ecdsa.PrivateKey, content, sent string) []byte {
+	sd, err := pkcs7.NewSignedData([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	sd.Detach()
+	signature, err := sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []byte(`From: Sender <sender@example.com>
+Subject: Signed Message
+MIME-Version: 1.0
+Content-Type: multipart/signed; protocol="application/pkcs7-signature"; micalg=sha-256;
+ boundary="signed-boundary"
+To: recipient1@example.com
+
+This is a cryptographically signed message in MIME format.
+
+--signed-boundary
+` + strings.ReplaceAll(sent, "\r\n", "\n") + `
+--signed-boundary
+Content-Type: application/pkcs7-signature; name="smime.p7s"
+Content-Transfer-Encoding: base64
+Content-Disposition: attachment; filename="smime.p7s"
+
+` + base64.StdEncoding.EncodeToString(signature) + `
+--signed-boundary--
+`)
+}
+
+func TestMessageVerifySMIME(t *testing.T) {
+	roots, cert, key := testSigner(t)
+	content := "Content-Type: text/plain; charset=\"UTF-8\"\r\n\r\nSigned bees\r\n"
+
+	msg, err := smtpd.NewMessage(nil, signedMessage(t, cert, key, content, content), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+
+	if plain, err := msg.Plain(); err != nil || strings.TrimSpace(string(plain)) != "Signed bees" {
+		t.Errorf("Expected the signed content to be readable, got: %q, %v", plain, err)
+	}
+
+	result, err := msg.VerifySMIME(roots)
+	if err != nil {
+		t.Fatalf("Expected the signature to verify, got: %v", err)
+	}
+	if !result.Valid {
+		t.Error("Expected a valid result")
+	}
+	if result.Signer == nil || result.Signer.Subject.CommonName != "sender@example.com" {
+		t.Errorf("Wrong signer: %v", result.Signer)
+	}
+
+	// untrusted signer
+	if result, err := msg.VerifySMIME(x509.NewCertPool()); err == nil || result.Valid {
+		t.Error("Expected a signer outside the roots to fail verification")
+	}
+
+	// content altered after signing
+	tampered := strings.Replace(content, "Signed bees", "Forged bees", 1)
+	msg, err = smtpd.NewMessage(nil, signedMessage(t, cert, key, content, tampered), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+	result, err = msg.VerifySMIME(roots)
+	if err == nil || result.Valid {
+		t.Error("Expected altered content to fail verification")
+	}
+	if result.Signer == nil {
+		t.Error("Expected the signer to be reported even when verification fails")
+	}
+}
+
+func TestMessageVerifySMIMEUnsigned(t *testing.T) {
+	msg, err := smtpd.NewMessage(nil, []byte(plainHTMLEmail), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating message: %v", err)
+	}
+	if _, err := msg.VerifySMIME(nil); err != smtpd.ErrNotSMIMESigned {
+		t.Errorf("Expected ErrNotSMIMESigned, got: %v", err)
+	}
+}
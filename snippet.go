@@ -0,0 +1,90 @@
+package smtpd
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Snippet is a preview of the message for mail listings: the first n characters of the
+// text/plain body, or of the text in the text/html body when there's no plain one. Whitespace is
+// collapsed to single spaces and quoted reply lines (starting with ">", or in a <blockquote>) are
+// left out, unless the message is nothing but quotes. It is empty when the message has no text.
+func (m *Message) Snippet(n int) string {
+	var text, all string
+	if plain, err := m.Plain(); err == nil || isCharsetError(err) {
+		text, all = plainSnippetText(plain)
+	} else if body, err := m.HTML(); err == nil || isCharsetError(err) {
+		text, all = htmlSnippetText(body)
+	}
+	if text == "" {
+		text = all
+	}
+
+	if utf8.RuneCountInString(text) <= n {
+		return text
+	}
+	// cut on a rune boundary, not a byte one
+	cut := 0
+	for i := 0; i < n; i++ {
+		_, size := utf8.DecodeRuneInString(text[cut:])
+		cut += size
+	}
+	return strings.TrimSpace(text[:cut])
+}
+
+// plainSnippetText collapses the whitespace of a plain text body, returning the text without
+// quoted lines and all of it
+func plainSnippetText(body []byte) (text, all string) {
+	var kept []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), ">") {
+			kept = append(kept, line)
+		}
+	}
+	return collapseSpace(strings.Join(kept, " ")), collapseSpace(string(body))
+}
+
+// htmlSnippetText pulls the text out of an HTML body, leaving out what isn't shown (like
+// <script> and <style>), returning the text without <blockquote>s and all of it
+func htmlSnippetText(body []byte) (text, all string) {
+	var unquoted, everything strings.Builder
+	hidden, quotes := 0, 0
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch token := z.Next(); token {
+		case html.ErrorToken:
+			return collapseSpace(unquoted.String()), collapseSpace(everything.String())
+		case html.StartTagToken, html.EndTagToken:
+			name, _ := z.TagName()
+			depth := 1
+			if token == html.EndTagToken {
+				depth = -1
+			}
+			switch atom.Lookup(name) {
+			case atom.Head, atom.Script, atom.Style, atom.Title:
+				hidden += depth
+			case atom.Blockquote:
+				quotes += depth
+			}
+			// tags like <br> and <p> separate words
+			unquoted.WriteByte(' ')
+			everything.WriteByte(' ')
+		case html.TextToken:
+			if hidden > 0 {
+				continue
+			}
+			if quotes <= 0 {
+				unquoted.Write(z.Text())
+			}
+			everything.Write(z.Text())
+		}
+	}
+}
+
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
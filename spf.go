@@ -0,0 +1,60 @@
+package smtpd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SPFResult is the outcome of an SPF check, see https://tools.ietf.org/html/rfc7208#section-2.6
+type SPFResult string
+
+// SPF results, as they appear in Received-SPF and Authentication-Results headers
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+// BuildReceivedSPF formats the value of a Received-SPF header recording the SPF verdict for
+// the sender domain (or address) checked from the client ip, see
+// https://tools.ietf.org/html/rfc7208#section-9.1. Add it with
+// conn.AddInfoHeader("Received-SPF", ...). helo may be left empty.
+func BuildReceivedSPF(result SPFResult, domain, ip, helo string) string {
+	var comment string
+	switch result {
+	case SPFPass:
+		comment = fmt.Sprintf("domain of %v designates %v as permitted sender", domain, ip)
+	case SPFFail:
+		comment = fmt.Sprintf("domain of %v does not designate %v as permitted sender", domain, ip)
+	case SPFSoftFail:
+		comment = fmt.Sprintf("domain of transitioning %v does not designate %v as permitted sender", domain, ip)
+	case SPFNeutral:
+		comment = fmt.Sprintf("%v is neither permitted nor denied by domain of %v", ip, domain)
+	case SPFNone:
+		comment = fmt.Sprintf("domain of %v does not designate permitted sender hosts", domain)
+	case SPFTempError:
+		comment = fmt.Sprintf("error in processing during lookup of %v", domain)
+	default:
+		comment = fmt.Sprintf("domain of %v has an invalid SPF record", domain)
+	}
+
+	header := fmt.Sprintf("%v (%v) client-ip=%v; envelope-from=%v;", result, comment, ip, spfValue(domain))
+	if helo != "" {
+		header += fmt.Sprintf(" helo=%v;", spfValue(helo))
+	}
+	return header
+}
+
+// spfValue quotes a key-value-pair value that isn't a dot-atom, like an address
+func spfValue(value string) string {
+	if value != "" && strings.IndexFunc(value, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-/=?^_`{|}~.", r))
+	}) < 0 {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
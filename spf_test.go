@@ -0,0 +1,32 @@
+package smtpd_test
+
+import (
+	"testing"
+
+	"github.com/mailsac/smtpd"
+)
+
+func TestBuildReceivedSPF(t *testing.T) {
+	tests := []struct {
+		result           smtpd.SPFResult
+		domain, ip, helo string
+		want             string
+	}{
+		{
+			smtpd.SPFPass, "example.com", "192.0.2.1", "foo.example.com",
+			"pass (domain of example.com designates 192.0.2.1 as permitted sender) " +
+				"client-ip=192.0.2.1; envelope-from=example.com; helo=foo.example.com;",
+		},
+		{
+			smtpd.SPFFail, "myname@example.com", "192.0.2.1", "",
+			"fail (domain of myname@example.com does not designate 192.0.2.1 as permitted sender) " +
+				`client-ip=192.0.2.1; envelope-from="myname@example.com";`,
+		},
+	}
+
+	for _, test := range tests {
+		if got := smtpd.BuildReceivedSPF(test.result, test.domain, test.ip, test.helo); got != test.want {
+			t.Errorf("Wrong Received-SPF for %v:\n got: %v\nwant: %v", test.result, got, test.want)
+		}
+	}
+}
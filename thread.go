@@ -0,0 +1,96 @@
+package smtpd
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ThreadInfo is what a message says about the conversation it is part of, for grouping messages
+// into threads
+type ThreadInfo struct {
+	// InReplyTo and References are the message ids from those headers, without angle brackets
+	InReplyTo  []string
+	References []string
+
+	// Topic is the decoded Thread-Topic, Outlook's conversation subject without any "RE:"
+	Topic string
+
+	// Index is the decoded Thread-Index, nil when the message has none or it can't be read
+	Index *ThreadIndex
+}
+
+// ThreadIndex is an Outlook Thread-Index header taken apart, see
+// https://learn.microsoft.com/en-us/office/client-developer/outlook/mapi/tracking-conversations
+type ThreadIndex struct {
+	// GUID identifies the conversation and is the same for every message in it, as 32 hex digits
+	GUID string
+	// Started is when the first message of the conversation was written
+	Started time.Time
+	// Depth is how many replies and forwards down the conversation this message is
+	Depth int
+}
+
+// ThreadingInfo gathers the In-Reply-To, References, Thread-Topic and Thread-Index headers
+func (m *Message) ThreadingInfo() ThreadInfo {
+	info := ThreadInfo{
+		InReplyTo:  messageIDList(m.Header.Get("In-Reply-To")),
+		References: messageIDList(m.Header.Get("References")),
+		Topic:      m.DecodeHeader("Thread-Topic"),
+	}
+	if index, err := parseThreadIndex(m.Header.Get("Thread-Index")); err == nil {
+		info.Index = index
+	}
+	return info
+}
+
+// messageIDList picks the <id> tokens out of a header, falling back to whitespace separated
+// words for the odd client that leaves out the angle brackets
+func messageIDList(value string) []string {
+	var ids []string
+	for rest := value; ; {
+		start := strings.Index(rest, "<")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], ">")
+		if end < 0 {
+			break
+		}
+		if id := strings.TrimSpace(rest[start+1 : start+end]); id != "" {
+			ids = append(ids, id)
+		}
+		rest = rest[start+end+1:]
+	}
+	if len(ids) == 0 {
+		ids = strings.Fields(value)
+	}
+	return ids
+}
+
+// parseThreadIndex decodes a Thread-Index: a 22 byte header block of a reserved byte, the high 40
+// bits of a FILETIME and the conversation GUID, then a 5 byte block for each reply
+func parseThreadIndex(value string) (*ThreadIndex, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 22 || (len(raw)-22)%5 != 0 {
+		return nil, fmt.Errorf("malformed Thread-Index %q", value)
+	}
+
+	// FILETIME counts 100ns intervals since 1601, 116444736000000000 of them before the Unix epoch
+	var filetime uint64
+	for _, b := range raw[1:6] {
+		filetime = filetime<<8 | uint64(b)
+	}
+	filetime <<= 24
+
+	return &ThreadIndex{
+		GUID:    hex.EncodeToString(raw[6:22]),
+		Started: time.Unix(0, int64(filetime-116444736000000000)*100).UTC(),
+		Depth:   (len(raw) - 22) / 5,
+	}, nil
+}